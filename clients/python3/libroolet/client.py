@@ -3,12 +3,11 @@
 # @github: unaxfromsibiria
 
 import asyncio
-import base64
+import jwt
 import socket
 import time
 
 from contextlib import contextmanager
-from jwt.algorithms import get_default_algorithms
 from random import SystemRandom
 
 from .common import Configuration
@@ -54,28 +53,29 @@ class Connection(object):
         auth_data = None
         try:
             with open(priv_key_path, 'r') as key_file:
-                priv_rsakey = key_file.read()
-                algorithms = get_default_algorithms()
-                # 2 random parts
-                segments = [
-                    base64.urlsafe_b64encode(''.join(
+                priv_key = key_file.read()
+                now = int(time.time())
+                # claims checked by node
+                claims = {
+                    'iss': conf.get('crypto_pub_key_name'),
+                    'aud': conf.get('node'),
+                    'iat': now,
+                    'exp': now + int(conf.get('token_lifetime')),
+                    'jti': ''.join(
                         # get ascii from [48, 122]
-                        chr(rand.randint(48, 123))
+                        chr(rand.randint(48, 122))
                         for _ in range(_random_part_size)
-                    ).encode(encoding=encoding))
-                    for _ in range(2)
-                ]
+                    ),
+                }
                 algorithm = conf.get('crypto_algorithm')
                 try:
-                    alg_obj = algorithms[algorithm]
-                    signature = alg_obj.sign(
-                        b'.'.join(segments),
-                        alg_obj.prepare_key(priv_rsakey))
+                    auth_data = jwt.encode(
+                        claims, priv_key, algorithm=algorithm)
 
-                    segments.append(base64.urlsafe_b64encode(signature))
-                    auth_data = b'.'.join(segments)
+                    if isinstance(auth_data, str):
+                        auth_data = auth_data.encode(encoding=encoding)
 
-                except KeyError:
+                except NotImplementedError:
                     if not silently:
                         raise NotImplementedError(
                             'Algorithm "{}" not supported.'.format(algorithm))
@@ -89,6 +89,10 @@ class Configuration(metaclass=MetaOnceObject):
         'crypto_pub_key_name': 'pub.key',
         # filepath to your client private key
         'crypto_priv_key_path': None,
+        # node name of server (audience of auth token)
+        'node': None,
+        # auth token lifetime in sec. (not more than tokens.max_age of node)
+        'token_lifetime': 60,
     }
 
     _content = None
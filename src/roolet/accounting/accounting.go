@@ -0,0 +1,264 @@
+package accounting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"roolet/helpers"
+	"roolet/options"
+	"roolet/rllogger"
+	"sync"
+	"time"
+)
+
+const (
+	anyKeyName  = "*"
+	dayFormat   = "2006-01-02"
+	flushPeriod = 10 * time.Second
+	// names of exceeded quota
+	QuotaCalls         = "calls"
+	QuotaBytes         = "bytes"
+	QuotaWorkerSeconds = "worker_seconds"
+)
+
+// consumption of one key for one day
+type Usage struct {
+	Calls         int64   `json:"calls"`
+	BytesIn       int64   `json:"bytes_in"`
+	BytesOut      int64   `json:"bytes_out"`
+	WorkerSeconds float64 `json:"worker_seconds"`
+}
+
+func (usage Usage) Bytes() int64 {
+	return usage.BytesIn + usage.BytesOut
+}
+
+// day in UTC, counters start again at midnight
+func Today() string {
+	return time.Now().UTC().Format(dayFormat)
+}
+
+// time before counters of new day
+func ResetAfter() time.Duration {
+	now := time.Now().UTC()
+	return now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+}
+
+// daily counters by key name, saved to "usage-<day>.json" in dir
+// (without dir counters only in memory)
+type Accounting struct {
+	helpers.AsyncSafeObject
+	dir         string
+	quotas      map[string]options.Quota
+	day         string
+	usage       map[string]*Usage
+	changed     bool
+	stopChannel chan bool
+	wait        sync.WaitGroup
+}
+
+func NewAccounting(option options.SysOption) (*Accounting, error) {
+	acc := Accounting{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		dir:             option.AccountingDir,
+		quotas:          option.Quotas,
+		day:             Today(),
+		usage:           make(map[string]*Usage),
+		stopChannel:     make(chan bool, 1)}
+	if len(acc.dir) > 0 {
+		if err := os.MkdirAll(acc.dir, 0700); err != nil {
+			return nil, err
+		}
+		usage, err := acc.load(acc.day)
+		if err != nil {
+			return nil, err
+		}
+		for keyName, keyUsage := range usage {
+			value := keyUsage
+			acc.usage[keyName] = &value
+		}
+	}
+	acc.wait.Add(1)
+	go acc.flushProcessing()
+	return &acc, nil
+}
+
+func (acc *Accounting) filePath(day string) string {
+	return filepath.Join((*acc).dir, fmt.Sprintf("usage-%s.json", day))
+}
+
+func (acc *Accounting) load(day string) (map[string]Usage, error) {
+	result := make(map[string]Usage)
+	data, err := ioutil.ReadFile(acc.filePath(day))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, errors.New(fmt.Sprintf("Usage file of %s is broken: %s", day, err))
+	}
+	return result, nil
+}
+
+// lock required
+func (acc *Accounting) save() {
+	if len((*acc).dir) == 0 || !(*acc).changed {
+		return
+	}
+	data, err := json.Marshal((*acc).usage)
+	if err != nil {
+		rllogger.Outputf(rllogger.LogError, "Usage dump problem: %s", err)
+		return
+	}
+	path := acc.filePath((*acc).day)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err == nil {
+		if err := os.Rename(tmpPath, path); err == nil {
+			(*acc).changed = false
+		} else {
+			rllogger.Outputf(rllogger.LogError, "Usage file %s not saved: %s", path, err)
+		}
+	} else {
+		rllogger.Outputf(rllogger.LogError, "Usage file %s not saved: %s", tmpPath, err)
+	}
+}
+
+// lock required, counters of previous day saved and cleaned
+func (acc *Accounting) checkDay() {
+	if day := Today(); day != (*acc).day {
+		acc.save()
+		(*acc).day = day
+		(*acc).usage = make(map[string]*Usage)
+		(*acc).changed = false
+	}
+}
+
+func (acc *Accounting) flushProcessing() {
+	defer acc.wait.Done()
+	ticker := time.NewTicker(flushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-(*acc).stopChannel:
+			return
+		case <-ticker.C:
+			{
+				acc.Lock(true)
+				acc.checkDay()
+				acc.save()
+				acc.Unlock(true)
+			}
+		}
+	}
+}
+
+// lock required
+func (acc *Accounting) get(keyName string) *Usage {
+	usage, exists := (*acc).usage[keyName]
+	if !exists {
+		usage = &Usage{}
+		(*acc).usage[keyName] = usage
+	}
+	return usage
+}
+
+func (acc *Accounting) Setup(quotas map[string]options.Quota) {
+	acc.Lock(true)
+	defer acc.Unlock(true)
+	(*acc).quotas = quotas
+}
+
+// name of exceeded quota and its limit, connections without key not limited
+func (acc *Accounting) Check(keyName string) (string, float64, bool) {
+	if len(keyName) == 0 {
+		return "", 0, true
+	}
+	acc.Lock(true)
+	defer acc.Unlock(true)
+	quota, exists := (*acc).quotas[keyName]
+	if !exists {
+		if quota, exists = (*acc).quotas[anyKeyName]; !exists {
+			return "", 0, true
+		}
+	}
+	acc.checkDay()
+	usage, exists := (*acc).usage[keyName]
+	if !exists {
+		return "", 0, true
+	}
+	if quota.Calls > 0 && usage.Calls >= quota.Calls {
+		return QuotaCalls, float64(quota.Calls), false
+	}
+	if quota.Bytes > 0 && usage.Bytes() >= quota.Bytes {
+		return QuotaBytes, float64(quota.Bytes), false
+	}
+	if quota.WorkerSeconds > 0 && usage.WorkerSeconds >= quota.WorkerSeconds {
+		return QuotaWorkerSeconds, quota.WorkerSeconds, false
+	}
+	return "", 0, true
+}
+
+// call routed to server, size of call params
+func (acc *Accounting) AddCall(keyName string, size int) {
+	if len(keyName) == 0 {
+		return
+	}
+	acc.Lock(true)
+	defer acc.Unlock(true)
+	acc.checkDay()
+	usage := acc.get(keyName)
+	usage.Calls++
+	usage.BytesIn += int64(size)
+	(*acc).changed = true
+}
+
+// result returned by server, size of result and time of task
+func (acc *Accounting) AddResult(keyName string, size int, duration time.Duration) {
+	if len(keyName) == 0 {
+		return
+	}
+	acc.Lock(true)
+	defer acc.Unlock(true)
+	acc.checkDay()
+	usage := acc.get(keyName)
+	usage.BytesOut += int64(size)
+	usage.WorkerSeconds += duration.Seconds()
+	(*acc).changed = true
+}
+
+// counters of all keys for day, empty day is today
+func (acc *Accounting) GetUsage(day string) (map[string]Usage, error) {
+	if len(day) == 0 {
+		day = Today()
+	} else if _, err := time.Parse(dayFormat, day); err != nil {
+		return nil, errors.New(fmt.Sprintf("Day must be in format YYYY-MM-DD: '%s'.", day))
+	}
+	acc.Lock(true)
+	defer acc.Unlock(true)
+	acc.checkDay()
+	if day == (*acc).day {
+		result := make(map[string]Usage, len((*acc).usage))
+		for keyName, usage := range (*acc).usage {
+			result[keyName] = *usage
+		}
+		return result, nil
+	}
+	if len((*acc).dir) == 0 {
+		return make(map[string]Usage), nil
+	}
+	return acc.load(day)
+}
+
+// counters saved, later changes stay in memory only
+func (acc *Accounting) Close() {
+	(*acc).stopChannel <- true
+	acc.wait.Wait()
+	acc.Lock(true)
+	defer acc.Unlock(true)
+	acc.save()
+}
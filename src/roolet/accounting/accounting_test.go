@@ -0,0 +1,79 @@
+package accounting_test
+
+import (
+	"io/ioutil"
+	"os"
+	"roolet/accounting"
+	"roolet/options"
+	"testing"
+	"time"
+)
+
+func TestQuotaCalls(t *testing.T) {
+	acc, err := accounting.NewAccounting(options.SysOption{
+		Quotas: map[string]options.Quota{"*": options.Quota{Calls: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acc.Close()
+	for index := 0; index < 2; index++ {
+		if _, _, allow := acc.Check("client1"); !allow {
+			t.Fatalf("Call %d must be allowed.", index)
+		}
+		acc.AddCall("client1", 10)
+	}
+	if quota, limit, allow := acc.Check("client1"); allow || quota != accounting.QuotaCalls || limit != 2 {
+		t.Errorf("Calls quota must be exceeded: %s %f %t", quota, limit, allow)
+	}
+	if _, _, allow := acc.Check("client2"); !allow {
+		t.Error("Other key must be allowed.")
+	}
+	// without key
+	if _, _, allow := acc.Check(""); !allow {
+		t.Error("Connection without key must be allowed.")
+	}
+	acc.Setup(map[string]options.Quota{"client1": options.Quota{Bytes: 100}})
+	if _, _, allow := acc.Check("client1"); !allow {
+		t.Error("Call must be allowed after reload.")
+	}
+	acc.AddResult("client1", 80, time.Second)
+	if quota, _, allow := acc.Check("client1"); allow || quota != accounting.QuotaBytes {
+		t.Errorf("Bytes quota must be exceeded: %s %t", quota, allow)
+	}
+}
+
+func TestUsageSaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	option := options.SysOption{AccountingDir: dir}
+	acc, err := accounting.NewAccounting(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc.AddCall("client1", 10)
+	acc.AddResult("client1", 20, 1500*time.Millisecond)
+	acc.Close()
+
+	acc, err = accounting.NewAccounting(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer acc.Close()
+	usage, err := acc.GetUsage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := accounting.Usage{Calls: 1, BytesIn: 10, BytesOut: 20, WorkerSeconds: 1.5}
+	if usage["client1"] != expected {
+		t.Errorf("Incorrect usage after restart: %v", usage)
+	}
+	if usage, err := acc.GetUsage("2000-01-01"); err != nil || len(usage) > 0 {
+		t.Errorf("Old day must be empty: %v %v", usage, err)
+	}
+	if _, err := acc.GetUsage("yesterday"); err == nil {
+		t.Error("Wrong day format must be error.")
+	}
+}
@@ -0,0 +1,121 @@
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"roolet/connectionsupport"
+	"roolet/helpers"
+)
+
+const anyKeyName = "*"
+
+// allowed groups, callable and registrable methods of key,
+// values are patterns as "math.*" (see path.Match)
+type Rule struct {
+	Groups   []string `json:"groups"`
+	Call     []string `json:"call"`
+	Register []string `json:"register"`
+}
+
+func match(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rules by key name ("*" for any key), without file all allowed,
+// with file keys without rule denied,
+// calls forwarded by peer nodes are checked on node of caller only
+type AccessList struct {
+	helpers.AsyncSafeObject
+	active bool
+	rules  map[string]Rule
+}
+
+func NewAccessList() *AccessList {
+	list := AccessList{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		rules:           make(map[string]Rule)}
+	return &list
+}
+
+// rules from file, on error old rules are kept
+func (list *AccessList) Load(filePath string) error {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rules := make(map[string]Rule)
+	active := err == nil
+	if active {
+		if err := json.Unmarshal(content, &rules); err != nil {
+			return errors.New(fmt.Sprintf("ACL file %s format problem: %s", filePath, err))
+		}
+		for keyName, rule := range rules {
+			for _, patterns := range [][]string{rule.Groups, rule.Call, rule.Register} {
+				for _, pattern := range patterns {
+					if _, err := path.Match(pattern, ""); err != nil {
+						return errors.New(fmt.Sprintf("ACL pattern '%s' of '%s' is wrong.", pattern, keyName))
+					}
+				}
+			}
+		}
+	}
+	list.Lock(true)
+	defer list.Unlock(true)
+	(*list).active = active
+	(*list).rules = rules
+	return nil
+}
+
+func (list *AccessList) IsActive() bool {
+	list.Lock(false)
+	defer list.Unlock(false)
+	return (*list).active
+}
+
+// rule of key, false if key denied at all
+func (list *AccessList) getRule(keyName string) (Rule, bool) {
+	list.Lock(false)
+	defer list.Unlock(false)
+	if !(*list).active {
+		return Rule{Groups: []string{"*"}, Call: []string{"*"}, Register: []string{"*"}}, true
+	}
+	rule, exists := (*list).rules[keyName]
+	if !exists {
+		rule, exists = (*list).rules[anyKeyName]
+	}
+	return rule, exists
+}
+
+func (list *AccessList) AllowGroup(keyName string, group int) bool {
+	groupName, exists := connectionsupport.GetGroupName(group)
+	if !exists {
+		return false
+	}
+	rule, exists := list.getRule(keyName)
+	return exists && match(rule.Groups, groupName)
+}
+
+func (list *AccessList) AllowCall(keyName, method string) bool {
+	rule, exists := list.getRule(keyName)
+	return exists && match(rule.Call, method)
+}
+
+// first denied method returned
+func (list *AccessList) AllowRegister(keyName string, methods []string) (string, bool) {
+	rule, exists := list.getRule(keyName)
+	for _, method := range methods {
+		if !exists || !match(rule.Register, method) {
+			return method, false
+		}
+	}
+	return "", true
+}
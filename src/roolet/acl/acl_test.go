@@ -0,0 +1,62 @@
+package acl_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"roolet/acl"
+	"roolet/connectionsupport"
+	"testing"
+)
+
+const testRules = `{
+	"cli": {"groups": ["client"], "call": ["math.*", "echo"]},
+	"worker": {"groups": ["server"], "register": ["math.*"]},
+	"*": {"groups": ["client", "web"], "call": ["echo"]}
+}`
+
+func TestWithoutFile(t *testing.T) {
+	list := acl.NewAccessList()
+	if err := list.Load(path.Join(os.TempDir(), "not-exists", "acl.json")); err != nil {
+		t.Fatal(err)
+	}
+	if list.IsActive() || !list.AllowCall("any", "any") ||
+		!list.AllowGroup("any", connectionsupport.GroupConnectionServer) {
+		t.Error("Without file all must be allowed.")
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "acl.json")
+	ioutil.WriteFile(filePath, []byte(testRules), 0600)
+	list := acl.NewAccessList()
+	if err := list.Load(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if !list.AllowCall("cli", "math.sum") || list.AllowCall("cli", "admin.drop") {
+		t.Error("Call rules of key not applied.")
+	}
+	if !list.AllowCall("other", "echo") || list.AllowCall("other", "math.sum") {
+		t.Error("Default rule not applied.")
+	}
+	if list.AllowGroup("cli", connectionsupport.GroupConnectionServer) ||
+		!list.AllowGroup("worker", connectionsupport.GroupConnectionServer) {
+		t.Error("Group rules not applied.")
+	}
+	if method, allow := list.AllowRegister("worker", []string{"math.sum", "os.exec"}); allow || method != "os.exec" {
+		t.Errorf("Register rules not applied: %s", method)
+	}
+	// broken file, old rules kept
+	ioutil.WriteFile(filePath, []byte("{\"cli\": {\"call\": [\"[\"]}}"), 0600)
+	if err := list.Load(filePath); err == nil {
+		t.Error("Wrong pattern must be error.")
+	}
+	if !list.AllowCall("cli", "math.sum") {
+		t.Error("Old rules must be kept.")
+	}
+}
@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"roolet/accounting"
+	"roolet/acl"
+	"roolet/connectionserver"
+	"roolet/coremethods"
+	"roolet/coreprocessing"
+	"roolet/coresupport"
+	"roolet/federation"
+	"roolet/helpers"
+	"roolet/keyregistry"
+	"roolet/options"
+	"roolet/replication"
+	"roolet/resultstore"
+	"roolet/rllogger"
+	"roolet/statistic"
+	"sync/atomic"
+)
+
+const (
+	// broker events for hooks
+	EventStarted  = "started"
+	EventReloaded = "reloaded"
+	EventStopping = "stopping"
+	EventStopped  = "stopped"
+)
+
+const (
+	stateNew int32 = iota
+	stateStarted
+	stateStopping
+	stateStopped
+)
+
+type Hook func(broker *Broker)
+
+// node of roolet in process, several instances can work together
+// (with different ports)
+type Broker struct {
+	helpers.AsyncSafeObject
+	option     options.SysOption
+	core       *coreprocessing.Core
+	stat       *statistic.Statistic
+	store      resultstore.ResultStore
+	accounting *accounting.Accounting
+	accessList *acl.AccessList
+	keys       *keyregistry.Registry
+	manager    *coresupport.CoreWorkerManager
+	server     *connectionserver.ConnectionServer
+	peers      *federation.PeerManager
+	standby    *replication.StandbyLink
+	hooks      map[string][]Hook
+	done       chan struct{}
+	state      int32
+}
+
+func NewBroker(option options.SysOption) (*Broker, error) {
+	core := coreprocessing.NewCore()
+	coremethods.Setup(core)
+	store, err := resultstore.NewResultStore(option)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Result store problem: %s", err))
+	}
+	core.RpcManager.SetResultStore(store)
+	acc, err := accounting.NewAccounting(option)
+	if err != nil {
+		store.Close()
+		return nil, errors.New(fmt.Sprintf("Accounting problem: %s", err))
+	}
+	accessList := acl.NewAccessList()
+	if err := accessList.Load(option.GetAclFile()); err != nil {
+		store.Close()
+		acc.Close()
+		return nil, errors.New(fmt.Sprintf("ACL problem: %s", err))
+	}
+	broker := Broker{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		option:          option,
+		core:            core,
+		stat:            statistic.NewStatistic(option),
+		store:           store,
+		accounting:      acc,
+		accessList:      accessList,
+		keys:            keyregistry.NewRegistry(option),
+		hooks:           make(map[string][]Hook),
+		done:            make(chan struct{})}
+	return &broker, nil
+}
+
+// methods, native methods and interceptors, change it before start only
+func (broker *Broker) Core() *coreprocessing.Core {
+	return (*broker).core
+}
+
+func (broker *Broker) Option() options.SysOption {
+	broker.Lock(false)
+	defer broker.Unlock(false)
+	return (*broker).option
+}
+
+func (broker *Broker) AddHook(event string, hook Hook) {
+	broker.Lock(true)
+	defer broker.Unlock(true)
+	(*broker).hooks[event] = append((*broker).hooks[event], hook)
+}
+
+func (broker *Broker) runHooks(event string) {
+	broker.Lock(false)
+	hooks := (*broker).hooks[event]
+	broker.Unlock(false)
+	for _, hook := range hooks {
+		hook(broker)
+	}
+}
+
+// broker is stopped after end of context or by Stop()
+func (broker *Broker) Start(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&(broker.state), stateNew, stateStarted) {
+		return errors.New("Broker can be started once.")
+	}
+	option := broker.Option()
+	broker.manager = coresupport.NewCoreWorkerManager(
+		broker.core, option, broker.stat, broker.accounting, broker.accessList, broker.keys)
+	broker.server = connectionserver.NewServer(option, broker.stat)
+	broker.server.Start(broker.manager)
+	broker.manager.Start(broker.server)
+	broker.keys.Start(broker.server.CloseKeySessions)
+	broker.peers = federation.NewPeerManager(option, broker.stat, broker.server, broker.core.RpcManager)
+	broker.peers.Start()
+	if len(option.ReplicaOf) > 0 {
+		broker.standby = replication.NewStandbyLink(option, broker.stat, broker.core.RpcManager)
+		broker.standby.Start()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			broker.Stop()
+		case <-broker.done:
+		}
+	}()
+	broker.runHooks(EventStarted)
+	return nil
+}
+
+// apply changed options, options for restart rejected all together
+func (broker *Broker) Reload(newOption options.SysOption) error {
+	if atomic.LoadInt32(&(broker.state)) != stateStarted || broker.manager.IsShuttingDown() {
+		return errors.New("Broker isn't running.")
+	}
+	level, exists := rllogger.GetLevelByName(newOption.LogLevel)
+	if !exists {
+		return errors.New(fmt.Sprintf("Unknown log level '%s'.", newOption.LogLevel))
+	}
+	option := broker.Option()
+	lines, err := option.Diff(newOption)
+	if len(lines) > 0 {
+		rllogger.OutputLines(rllogger.LogInfo, "options changes", &lines)
+	}
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		rllogger.Output(rllogger.LogInfo, "Reload: options not changed.")
+		return nil
+	}
+	rllogger.SetLevel(level)
+	broker.stat.Reload(newOption)
+	broker.manager.Reload(newOption)
+	broker.server.Reload(newOption)
+	broker.Lock(true)
+	(*broker).option = newOption
+	broker.Unlock(true)
+	rllogger.Output(rllogger.LogInfo, "Options reloaded.")
+	broker.runHooks(EventReloaded)
+	return nil
+}
+
+// wait tasks in progress (shutdown timeout) and stop all, returns after stop
+func (broker *Broker) Stop() {
+	if atomic.CompareAndSwapInt32(&(broker.state), stateNew, stateStopped) {
+		broker.close()
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&(broker.state), stateStarted, stateStopping) {
+		<-broker.done
+		return
+	}
+	broker.runHooks(EventStopping)
+	rllogger.Output(rllogger.LogInfo, "Stoping service, now wait..")
+	broker.server.Stop()
+	if broker.manager.Shutdown(broker.Option().GetShutdownTimeout()) {
+		rllogger.Output(rllogger.LogInfo, "All tasks completed.")
+	}
+	broker.keys.Stop()
+	broker.peers.Stop()
+	if broker.standby != nil {
+		broker.standby.Stop()
+	}
+	broker.manager.Stop()
+	<-broker.manager.OutSignalChannel
+	rllogger.Output(rllogger.LogInfo, "Close manager.")
+	broker.manager.Close()
+	atomic.StoreInt32(&(broker.state), stateStopped)
+	broker.close()
+	broker.runHooks(EventStopped)
+}
+
+func (broker *Broker) close() {
+	if err := broker.store.Close(); err != nil {
+		rllogger.Outputf(rllogger.LogError, "Result store close problem: %s", err)
+	}
+	broker.accounting.Close()
+	broker.stat.Close()
+	close(broker.done)
+}
+
+// address of client listener (real port if port in options is 0)
+func (broker *Broker) Addr() string {
+	if broker.server == nil {
+		return broker.Option().Socket()
+	}
+	return broker.server.Addr()
+}
+
+// closed after stop
+func (broker *Broker) Done() <-chan struct{} {
+	return broker.done
+}
+
+func (broker *Broker) IsShuttingDown() bool {
+	return atomic.LoadInt32(&(broker.state)) != stateStarted || broker.manager.IsShuttingDown()
+}
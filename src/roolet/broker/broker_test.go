@@ -0,0 +1,142 @@
+package broker_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"roolet/broker"
+	"roolet/coreprocessing"
+	"roolet/options"
+	"roolet/transport"
+	"testing"
+	"time"
+)
+
+func newTestBroker(t *testing.T, shutdownTimeout int) *broker.Broker {
+	option := options.SysOption{
+		Port:             0,
+		Addr:             "127.0.0.1",
+		BufferSize:       16,
+		Workers:          2,
+		LogLevel:         "error",
+		ShutdownTimeout:  shutdownTimeout,
+		AnonymousMethods: []string{"ping", "test_native", "test_block"}}
+	node, err := broker.NewBroker(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// answer to command with new connection
+func call(t *testing.T, addr string, method string) transport.Answer {
+	connection, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(5 * time.Second))
+	data, _ := transport.NewCommand(1, "", method, "").Dump()
+	connection.Write([]byte(*data))
+	line, err := bufio.NewReader(connection).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := transport.Answer{}
+	if err := json.Unmarshal(line, &answer); err != nil {
+		t.Fatalf("Wrong answer %s: %s", line, err)
+	}
+	return answer
+}
+
+func TestBrokerInstances(t *testing.T) {
+	first := newTestBroker(t, 10)
+	second := newTestBroker(t, 1)
+	first.Core().SetupNativeMethod(
+		"test_native",
+		func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+			return time.Now().Unix(), nil
+		})
+	events := make(chan string, 4)
+	first.AddHook(broker.EventStopped, func(node *broker.Broker) { events <- broker.EventStopped })
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := first.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Start(ctx); err == nil {
+		t.Error("Broker started twice.")
+	}
+	for _, node := range []*broker.Broker{first, second} {
+		if answer := call(t, node.Addr(), "ping"); answer.Error.Code > 0 {
+			t.Errorf("Ping failed: %s", answer.Error)
+		}
+	}
+	if answer := call(t, first.Addr(), "test_native"); answer.Error.Code > 0 {
+		t.Errorf("Native method failed: %s", answer.Error)
+	}
+	if answer := call(t, second.Addr(), "test_native"); answer.Error.Code == 0 {
+		t.Error("Native method of other instance called.")
+	}
+	// not taken result of native call doesn't delay stop
+	cancel()
+	select {
+	case <-first.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broker not stopped by context.")
+	}
+	if event := <-events; event != broker.EventStopped {
+		t.Errorf("Unexpected event: %s", event)
+	}
+	second.Stop()
+}
+
+func TestReloadBusyWorkers(t *testing.T) {
+	node := newTestBroker(t, 1)
+	release := make(chan struct{})
+	node.Core().SetupNativeMethod(
+		"test_block",
+		func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+			<-release
+			return nil, nil
+		})
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+	defer close(release)
+	// all workers are busy
+	for index := 0; index < node.Option().Workers; index++ {
+		connection, err := net.Dial("tcp", node.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer connection.Close()
+		data, _ := transport.NewCommand(1, "", "test_block", "").Dump()
+		connection.Write([]byte(*data))
+	}
+	time.Sleep(100 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		option := node.Option()
+		for timeout := 10; timeout < 13; timeout++ {
+			option.TaskTimeout = timeout
+			if err := node.Reload(option); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload blocked by busy workers.")
+	}
+}
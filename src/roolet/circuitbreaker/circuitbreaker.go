@@ -0,0 +1,154 @@
+package circuitbreaker
+
+import (
+	"roolet/helpers"
+	"time"
+)
+
+const (
+	StateClosed   = 0
+	StateOpen     = 1
+	StateHalfOpen = 2
+	// defaults
+	DefaultThreshold = 5
+	DefaultOpenTime  = 30 * time.Second
+)
+
+func StateName(state int) string {
+	switch state {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type breaker struct {
+	state    int
+	failures int
+	probing  bool
+	openedAt time.Time
+}
+
+type BreakerInfo struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
+
+// circuit breakers of servers by cid
+type BreakerDict struct {
+	helpers.AsyncSafeObject
+	threshold int
+	openTime  time.Duration
+	breakers  map[string]*breaker
+}
+
+func NewBreakerDict() *BreakerDict {
+	dict := BreakerDict{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		threshold:       DefaultThreshold,
+		openTime:        DefaultOpenTime,
+		breakers:        make(map[string]*breaker)}
+	return &dict
+}
+
+func (dict *BreakerDict) Setup(threshold int, openTime time.Duration) {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	if threshold > 0 {
+		(*dict).threshold = threshold
+	}
+	if openTime > 0 {
+		(*dict).openTime = openTime
+	}
+}
+
+func (dict *BreakerDict) get(cid string) *breaker {
+	rec, exists := (*dict).breakers[cid]
+	if !exists {
+		rec = &breaker{state: StateClosed}
+		(*dict).breakers[cid] = rec
+	}
+	return rec
+}
+
+// server can take a new task, in half-open state only one probe task accepted
+func (dict *BreakerDict) Allow(cid string) bool {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	rec, exists := (*dict).breakers[cid]
+	if !exists {
+		return true
+	}
+	switch rec.state {
+	case StateOpen:
+		{
+			if time.Since(rec.openedAt) >= (*dict).openTime {
+				rec.state = StateHalfOpen
+				rec.probing = true
+				return true
+			}
+			return false
+		}
+	case StateHalfOpen:
+		{
+			if rec.probing {
+				return false
+			}
+			rec.probing = true
+			return true
+		}
+	}
+	return true
+}
+
+func (dict *BreakerDict) Success(cid string) {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	if rec, exists := (*dict).breakers[cid]; exists {
+		rec.state = StateClosed
+		rec.failures = 0
+		rec.probing = false
+	}
+}
+
+// returns true if breaker opened by this failure
+func (dict *BreakerDict) Failure(cid string) bool {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	rec := dict.get(cid)
+	rec.failures++
+	rec.probing = false
+	if rec.state == StateHalfOpen || (rec.state == StateClosed && rec.failures >= (*dict).threshold) {
+		rec.state = StateOpen
+		rec.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+func (dict *BreakerDict) Remove(cid string) {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	delete((*dict).breakers, cid)
+}
+
+func (dict *BreakerDict) GetInfo(cid string) BreakerInfo {
+	dict.Lock(false)
+	defer dict.Unlock(false)
+	result := BreakerInfo{State: StateName(StateClosed)}
+	if rec, exists := (*dict).breakers[cid]; exists {
+		state := rec.state
+		if state == StateOpen && time.Since(rec.openedAt) >= (*dict).openTime {
+			// will be probed by next task
+			state = StateHalfOpen
+		}
+		result.State = StateName(state)
+		result.Failures = rec.failures
+	}
+	return result
+}
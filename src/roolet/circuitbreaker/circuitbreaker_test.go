@@ -0,0 +1,62 @@
+package circuitbreaker_test
+
+import (
+	"roolet/circuitbreaker"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpenAndProbe(t *testing.T) {
+	cid := "27d90e5e-0000000000000011-1"
+	dict := circuitbreaker.NewBreakerDict()
+	dict.Setup(3, 100*time.Millisecond)
+	for index := 0; index < 2; index++ {
+		if dict.Failure(cid) {
+			t.Errorf("Breaker opened after %d failures.", index+1)
+		}
+	}
+	if !dict.Allow(cid) {
+		t.Error("Breaker must be closed yet.")
+	}
+	if !dict.Failure(cid) {
+		t.Error("Breaker must be opened by threshold.")
+	}
+	if dict.Allow(cid) {
+		t.Error("Open breaker accepted task.")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if info := dict.GetInfo(cid); info.State != "half-open" {
+		t.Errorf("Unexpected state: %s", info.State)
+	}
+	if !dict.Allow(cid) {
+		t.Error("Probe task not accepted after open time.")
+	}
+	if dict.Allow(cid) {
+		t.Error("Only one probe task must be accepted.")
+	}
+	// probe failed
+	if !dict.Failure(cid) || dict.Allow(cid) {
+		t.Error("Breaker must be opened again after failed probe.")
+	}
+	time.Sleep(150 * time.Millisecond)
+	dict.Allow(cid)
+	dict.Success(cid)
+	if info := dict.GetInfo(cid); info.State != "closed" || info.Failures != 0 {
+		t.Errorf("Unexpected state after success: %s (%d)", info.State, info.Failures)
+	}
+}
+
+func TestBreakerSuccessResetFailures(t *testing.T) {
+	cid := "27d90e5e-0000000000000012-1"
+	dict := circuitbreaker.NewBreakerDict()
+	dict.Setup(2, time.Minute)
+	dict.Failure(cid)
+	dict.Success(cid)
+	if dict.Failure(cid) {
+		t.Error("Failures counter must be reset by success.")
+	}
+	dict.Remove(cid)
+	if info := dict.GetInfo(cid); info.Failures != 0 {
+		t.Error("Breaker data must be removed.")
+	}
+}
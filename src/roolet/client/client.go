@@ -0,0 +1,575 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"roolet/connectionsupport"
+	"roolet/cryptosupport"
+	"roolet/helpers"
+	"roolet/rllogger"
+	"roolet/transport"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reconnectDelay    = time.Second
+	reconnectMaxDelay = 30 * time.Second
+	dialTimeout       = 10 * time.Second
+	resultPollPeriod  = 200 * time.Millisecond
+	tokenLifetime     = time.Minute
+
+	// auth and registration of reconnect
+	handshakeTimeout = 30 * time.Second
+)
+
+var ErrClosed = errors.New("Client closed.")
+var ErrConnectionLost = errors.New("Connection lost.")
+
+// error answer of node
+type RemoteError struct {
+	transport.ErrorDescription
+}
+
+func (err RemoteError) Error() string {
+	return fmt.Sprintf("Node error %d: %s", err.Code, err.Message)
+}
+
+// remote error code or 0
+func ErrorCode(err error) int {
+	var remoteErr RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.Code
+	}
+	return 0
+}
+
+type Option struct {
+	// node address host:port
+	Addr string
+	// key name (issuer of token)
+	Key string
+	// RSA, ECDSA, Ed25519 private key or []byte secret for HS256
+	PrivateKey crypto.PrivateKey
+	// audience of token, name of node from ping if empty
+	Node string
+	// methods of server, connection is registered as server if not empty
+	Methods []string
+	// commands from node (calls of server methods, events), called by read loop
+	OnCommand func(method string, params transport.MethodParams)
+	// called after each new connection ready for requests
+	OnConnect func(client *Client)
+}
+
+// command or answer from node
+type message struct {
+	Id     int                         `json:"id"`
+	Method string                      `json:"method"`
+	Params transport.MethodParams      `json:"params"`
+	Result string                      `json:"result"`
+	Error  *transport.ErrorDescription `json:"error"`
+}
+
+type routeData struct {
+	Cid  string `json:"cid"`
+	Task string `json:"task"`
+}
+
+type authResult struct {
+	Auth   bool   `json:"auth"`
+	Resume string `json:"resume"`
+}
+
+type resumeResult struct {
+	Cid    string `json:"cid"`
+	Resume string `json:"resume"`
+}
+
+// client of node, one connection is used by concurrent calls,
+// connection is restored (with session resumption if node supports it)
+// until Close()
+type Client struct {
+	helpers.AsyncSafeObject
+	option     Option
+	connection net.Conn
+	writeLock  sync.Mutex
+	cmdIndex   int
+	cid        string
+	resume     string
+	// closed when session is ready for requests
+	ready chan struct{}
+	// <command id>: answer of request
+	requests map[int]chan *message
+	// <task id>: method of task without taken result
+	tasks map[string]string
+	// <task id>: result sent by node
+	pushed  map[string]string
+	waiters map[string]chan string
+	done    chan struct{}
+	stopped int32
+}
+
+// first connection is created before return, errors of next
+// connections are logged
+func Dial(ctx context.Context, option Option) (*Client, error) {
+	client := Client{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		option:          option,
+		ready:           make(chan struct{}),
+		requests:        make(map[int]chan *message),
+		tasks:           make(map[string]string),
+		pushed:          make(map[string]string),
+		waiters:         make(map[string]chan string),
+		done:            make(chan struct{})}
+	reader, err := client.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go client.run(reader)
+	return &client, nil
+}
+
+func (client *Client) isActive() bool {
+	return atomic.LoadInt32(&(client.stopped)) == 0
+}
+
+func (client *Client) nextId() int {
+	client.Lock(true)
+	defer client.Unlock(true)
+	(*client).cmdIndex++
+	return (*client).cmdIndex
+}
+
+// cid of session on node
+func (client *Client) Cid() string {
+	client.Lock(false)
+	defer client.Unlock(false)
+	return (*client).cid
+}
+
+func (client *Client) send(cmd *transport.Command) error {
+	data := cmd.DataDump()
+	if data == nil {
+		return errors.New("Command dump problem.")
+	}
+	client.Lock(false)
+	connection := (*client).connection
+	client.Unlock(false)
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	_, err := connection.Write(append(*data, byte('\n')))
+	return err
+}
+
+func readMessage(reader *bufio.Reader) (*message, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	msg := message{}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// request before start of read loop
+func (client *Client) handshake(reader *bufio.Reader, method string, params transport.MethodParams) (string, error) {
+	id := client.nextId()
+	if err := client.send(transport.NewCommandWithParams(id, method, params)); err != nil {
+		return "", err
+	}
+	for {
+		msg, err := readMessage(reader)
+		if err != nil {
+			return "", err
+		}
+		if len(msg.Method) == 0 && msg.Id == id {
+			if msg.Error != nil && msg.Error.Code > 0 {
+				return "", RemoteError{*msg.Error}
+			}
+			return msg.Result, nil
+		}
+	}
+}
+
+func (client *Client) auth(reader *bufio.Reader) error {
+	node := client.option.Node
+	if len(node) == 0 {
+		data, err := client.handshake(reader, "ping", transport.MethodParams{})
+		if err != nil {
+			return err
+		}
+		ping := transport.PingResult{}
+		if err := json.Unmarshal([]byte(data), &ping); err != nil {
+			return err
+		}
+		node = ping.Node
+	}
+	token, err := cryptosupport.CreateToken(
+		client.option.PrivateKey, cryptosupport.NewClaims(client.option.Key, node, tokenLifetime))
+	if err != nil {
+		return err
+	}
+	keyData, _ := json.Marshal(map[string]string{"key": client.option.Key})
+	data, err := client.handshake(reader, "auth", transport.MethodParams{Json: string(keyData), Data: token})
+	if err != nil {
+		return err
+	}
+	result := authResult{}
+	if err := json.Unmarshal([]byte(data), &result); err != nil || !result.Auth {
+		return errors.New(fmt.Sprintf("Auth failed: %s", data))
+	}
+	client.Lock(true)
+	(*client).resume = result.Resume
+	client.Unlock(true)
+	return nil
+}
+
+// registration as client or as server with methods
+func (client *Client) register(reader *bufio.Reader) error {
+	info := struct {
+		Group   int      `json:"group"`
+		Methods []string `json:"methods,omitempty"`
+	}{Group: connectionsupport.GroupConnectionClient}
+	if len(client.option.Methods) > 0 {
+		info.Group = connectionsupport.GroupConnectionServer
+		info.Methods = client.option.Methods
+	}
+	regData, _ := json.Marshal(info)
+	data, err := client.handshake(reader, "registration", transport.MethodParams{Json: string(regData)})
+	if err != nil {
+		return err
+	}
+	registration := resumeResult{}
+	if err := json.Unmarshal([]byte(data), &registration); err != nil {
+		return err
+	}
+	client.Lock(true)
+	(*client).cid = registration.Cid
+	client.Unlock(true)
+	return nil
+}
+
+// old session of lost connection, false if node lost it
+func (client *Client) resumeSession(reader *bufio.Reader) (bool, error) {
+	client.Lock(false)
+	token := (*client).resume
+	client.Unlock(false)
+	if len(token) == 0 {
+		return false, nil
+	}
+	data, err := client.handshake(reader, connectionsupport.MethodResume, transport.MethodParams{Data: token})
+	if err != nil {
+		if ErrorCode(err) > 0 {
+			return false, nil
+		}
+		return false, err
+	}
+	result := resumeResult{}
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return false, err
+	}
+	client.Lock(true)
+	(*client).cid = result.Cid
+	(*client).resume = result.Resume
+	client.Unlock(true)
+	return true, nil
+}
+
+// reads and writes of connection are interrupted by end of context,
+// returned function stops watching
+func watchContext(ctx context.Context, connection net.Conn) func() {
+	if deadline, exists := ctx.Deadline(); exists {
+		connection.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			connection.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		connection.SetDeadline(time.Time{})
+	}
+}
+
+// new connection with auth, ready for requests
+func (client *Client) connect(ctx context.Context) (*bufio.Reader, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	connection, err := dialer.DialContext(ctx, "tcp", client.option.Addr)
+	if err != nil {
+		return nil, err
+	}
+	client.Lock(true)
+	(*client).connection = connection
+	client.Unlock(true)
+	// node can accept connection without answers
+	release := watchContext(ctx, connection)
+	reader := bufio.NewReader(connection)
+	resumed, err := client.resumeSession(reader)
+	if err == nil && !resumed {
+		err = client.auth(reader)
+	}
+	// methods of server are removed with lost connection
+	if err == nil && (!resumed || len(client.option.Methods) > 0) {
+		err = client.register(reader)
+	}
+	release()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	client.Lock(true)
+	close((*client).ready)
+	client.Unlock(true)
+	if client.option.OnConnect != nil {
+		go client.option.OnConnect(client)
+	}
+	return reader, nil
+}
+
+// read loop of connection, returns on disconnect
+func (client *Client) session(reader *bufio.Reader) error {
+	for {
+		msg, err := readMessage(reader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(msg.Method) == 0:
+			{
+				client.Lock(true)
+				answerChannel, exists := (*client).requests[msg.Id]
+				delete((*client).requests, msg.Id)
+				client.Unlock(true)
+				if exists {
+					answerChannel <- msg
+				}
+			}
+		case msg.Method == "ping":
+			{
+				// heartbeat, any command is an answer
+				if err := client.send(transport.NewCommand(client.nextId(), "", "ping", "")); err != nil {
+					return err
+				}
+			}
+		case msg.Method == "result":
+			client.setResult(msg.Params.Task, msg.Params.Json)
+		default:
+			if client.option.OnCommand != nil {
+				client.option.OnCommand(msg.Method, msg.Params)
+			}
+		}
+	}
+}
+
+// requests of lost connection are failed
+func (client *Client) disconnect() {
+	client.Lock(true)
+	defer client.Unlock(true)
+	(*client).connection.Close()
+	(*client).ready = make(chan struct{})
+	for id, answerChannel := range (*client).requests {
+		close(answerChannel)
+		delete((*client).requests, id)
+	}
+}
+
+func (client *Client) run(reader *bufio.Reader) {
+	defer func() {
+		// connection created while closing
+		client.Lock(false)
+		(*client).connection.Close()
+		client.Unlock(false)
+	}()
+	delay := reconnectDelay
+	for client.isActive() {
+		if reader != nil {
+			delay = reconnectDelay
+			if err := client.session(reader); err != nil && client.isActive() {
+				rllogger.Outputf(rllogger.LogWarn, "Connection to %s lost: %s", client.option.Addr, err)
+			}
+			client.disconnect()
+		}
+		select {
+		case <-client.done:
+			return
+		case <-time.After(delay):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+		var err error
+		reader, err = client.connect(ctx)
+		cancel()
+		if err != nil {
+			rllogger.Outputf(rllogger.LogWarn, "Connection to %s problem: %s", client.option.Addr, err)
+			if delay *= 2; delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+		}
+	}
+}
+
+func (client *Client) waitReady(ctx context.Context) error {
+	client.Lock(false)
+	ready := (*client).ready
+	client.Unlock(false)
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-client.done:
+		return ErrClosed
+	}
+}
+
+// command to node, result of answer or RemoteError
+func (client *Client) Request(ctx context.Context, method string, params transport.MethodParams) (string, error) {
+	if err := client.waitReady(ctx); err != nil {
+		return "", err
+	}
+	id := client.nextId()
+	answerChannel := make(chan *message, 1)
+	client.Lock(true)
+	(*client).requests[id] = answerChannel
+	client.Unlock(true)
+	defer func() {
+		client.Lock(true)
+		delete((*client).requests, id)
+		client.Unlock(true)
+	}()
+	if err := client.send(transport.NewCommandWithParams(id, method, params)); err != nil {
+		// reader finds it too and reconnects
+		if _, isNet := err.(net.Error); isNet {
+			return "", ErrConnectionLost
+		}
+		return "", err
+	}
+	select {
+	case msg, ok := <-answerChannel:
+		if !ok {
+			return "", ErrConnectionLost
+		}
+		if msg.Error != nil && msg.Error.Code > 0 {
+			return "", RemoteError{*msg.Error}
+		}
+		return msg.Result, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-client.done:
+		return "", ErrClosed
+	}
+}
+
+// call of server method, task id for Result()
+func (client *Client) Call(ctx context.Context, method string, params transport.MethodParams) (string, error) {
+	data, err := client.Request(ctx, method, params)
+	if err != nil {
+		return "", err
+	}
+	route := routeData{}
+	if err := json.Unmarshal([]byte(data), &route); err != nil {
+		return "", err
+	}
+	client.Lock(true)
+	(*client).tasks[route.Task] = method
+	client.Unlock(true)
+	return route.Task, nil
+}
+
+func (client *Client) setResult(taskId, data string) {
+	client.Lock(true)
+	defer client.Unlock(true)
+	if waiter, exists := (*client).waiters[taskId]; exists {
+		delete((*client).waiters, taskId)
+		waiter <- data
+	} else {
+		(*client).pushed[taskId] = data
+	}
+}
+
+// result of task (JSON from server), sent by node or taken by "getresult"
+func (client *Client) Result(ctx context.Context, taskId string) (string, error) {
+	waiter := make(chan string, 1)
+	client.Lock(true)
+	data, exists := (*client).pushed[taskId]
+	delete((*client).pushed, taskId)
+	if !exists {
+		(*client).waiters[taskId] = waiter
+	}
+	client.Unlock(true)
+	defer func() {
+		client.Lock(true)
+		delete((*client).waiters, taskId)
+		client.Unlock(true)
+	}()
+	for !exists {
+		var err error
+		data, err = client.Request(ctx, "getresult", transport.MethodParams{Task: taskId})
+		if err == nil {
+			break
+		}
+		if code := ErrorCode(err); code != transport.ErrorCodeResultNotReady && err != ErrConnectionLost {
+			return "", err
+		}
+		select {
+		case data = <-waiter:
+			exists = true
+		case <-time.After(resultPollPeriod):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-client.done:
+			return "", ErrClosed
+		}
+	}
+	client.Lock(true)
+	delete((*client).tasks, taskId)
+	client.Unlock(true)
+	return data, nil
+}
+
+// call and wait result
+func (client *Client) CallWait(ctx context.Context, method string, params transport.MethodParams) (string, error) {
+	taskId, err := client.Call(ctx, method, params)
+	if err != nil {
+		return "", err
+	}
+	return client.Result(ctx, taskId)
+}
+
+// tasks without taken result
+func (client *Client) Tasks() []string {
+	client.Lock(false)
+	defer client.Unlock(false)
+	result := make([]string, 0, len((*client).tasks))
+	for taskId := range (*client).tasks {
+		result = append(result, taskId)
+	}
+	return result
+}
+
+func (client *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&(client.stopped), 0, 1) {
+		return ErrClosed
+	}
+	close(client.done)
+	client.Lock(false)
+	defer client.Unlock(false)
+	return (*client).connection.Close()
+}
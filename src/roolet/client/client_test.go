@@ -0,0 +1,115 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"roolet/broker"
+	"roolet/client"
+	"roolet/coreprocessing"
+	"roolet/testsupport"
+	"roolet/transport"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupEcho(node *broker.Broker) {
+	node.Core().SetupNativeMethod(
+		"test_echo",
+		func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+			return params.Data, nil
+		})
+}
+
+func TestClientCalls(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "cli")
+	option := testsupport.NewOption(keyDir)
+	option.ResumeTimeout = 5
+	node := testsupport.StartBroker(t, option, setupEcho)
+	addr := node.Addr()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	rlClient, err := client.Dial(ctx, client.Option{Addr: addr, Key: "cli", PrivateKey: keys["cli"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rlClient.Close()
+	if len(rlClient.Cid()) == 0 {
+		t.Error("Cid of session lost.")
+	}
+	// concurrent calls
+	var wait sync.WaitGroup
+	for index := 0; index < 10; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			value := fmt.Sprint(index)
+			result, err := rlClient.CallWait(ctx, "test_echo", transport.MethodParams{Data: value})
+			if err != nil || result != fmt.Sprintf("{\"result\":\"%s\"}", value) {
+				t.Errorf("Wrong result %s: %s", result, err)
+			}
+		}(index)
+	}
+	wait.Wait()
+	if tasks := rlClient.Tasks(); len(tasks) > 0 {
+		t.Errorf("Tasks with taken result: %v", tasks)
+	}
+	if _, err := rlClient.Call(ctx, "test_unknown", transport.MethodParams{}); client.ErrorCode(err) == 0 {
+		t.Errorf("Error of node expected: %s", err)
+	}
+	canceled, stop := context.WithCancel(ctx)
+	stop()
+	if _, err := rlClient.Result(canceled, "a1b2c3d4-0000000000000001"); err != context.Canceled {
+		t.Errorf("Canceled context expected: %s", err)
+	}
+	// new node on same port, session can't be resumed
+	node.Stop()
+	_, port, _ := net.SplitHostPort(addr)
+	option.Port, _ = strconv.Atoi(port)
+	testsupport.StartBroker(t, option, setupEcho)
+	// calls fail until client finds lost connection
+	result, err := rlClient.CallWait(ctx, "test_echo", transport.MethodParams{Data: "x"})
+	for err == client.ErrConnectionLost {
+		time.Sleep(100 * time.Millisecond)
+		result, err = rlClient.CallWait(ctx, "test_echo", transport.MethodParams{Data: "x"})
+	}
+	if err != nil {
+		t.Errorf("Call after reconnect failed: %s %s", result, err)
+	}
+}
+
+func TestDialSilentNode(t *testing.T) {
+	_, keys := testsupport.NewKeyDir(t, "cli")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// connections accepted without answers
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer connection.Close()
+		}
+	}()
+	option := client.Option{Addr: listener.Addr().String(), Key: "cli", PrivateKey: keys["cli"]}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.Dial(ctx, option); err != context.DeadlineExceeded {
+		t.Errorf("Deadline of context expected: %s", err)
+	}
+	canceled, stop := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, stop)
+	if _, err := client.Dial(canceled, option); err != context.Canceled {
+		t.Errorf("Canceled context expected: %s", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Dial waits too long.")
+	}
+}
@@ -2,6 +2,8 @@ package connectionserver
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -17,6 +19,8 @@ import (
 )
 
 const (
+	readCheckPeriod = time.Second
+	// server status
 	ServerStatusOn  = 1
 	ServerStatusOff = 2
 	// take some default answer
@@ -42,24 +46,63 @@ func (obj *statusAcceptedObject) GetStatus() int {
 
 type ConnectionServer struct {
 	statusAcceptedObject
+	listener              net.Listener
 	option                options.SysOption
 	stat                  statistic.StatisticUpdater
 	connectionDataManager *connectionsupport.ConnectionDataManager
+	workerManager         *coresupport.CoreWorkerManager
+	sessions              *connectionsupport.ResumeDict
 }
 
+// stop accepting new connections
 func (server *ConnectionServer) Stop() {
 	server.SetStatus(ServerStatusOff)
+	(*server).statusChangeLock.Lock()
+	if (*server).listener != nil {
+		(*server).listener.Close()
+	}
+	(*server).statusChangeLock.Unlock()
 	rllogger.Output(rllogger.LogInfo, "Connection server stopping..")
 }
 
+func (server *ConnectionServer) getOption() options.SysOption {
+	(*server).statusChangeLock.RLock()
+	defer (*server).statusChangeLock.RUnlock()
+	return (*server).option
+}
+
+// new timeouts and health check period used by open connections too
+func (server *ConnectionServer) Reload(option options.SysOption) {
+	(*server).statusChangeLock.Lock()
+	defer (*server).statusChangeLock.Unlock()
+	(*server).option = option
+}
+
 func (server *ConnectionServer) isAcceptForConnection() bool {
 	return server.GetStatus() != ServerStatusOff
 }
 
+func groupStatName(group int) string {
+	switch group {
+	case connectionsupport.GroupConnectionClient:
+		return "count_connection_client"
+	case connectionsupport.GroupConnectionServer:
+		return "count_connection_server"
+	case connectionsupport.GroupConnectionWsClient:
+		return "count_connection_web"
+	case connectionsupport.GroupConnectionPeer:
+		return "count_connection_peer"
+	case connectionsupport.GroupConnectionReplica:
+		return "count_connection_replica"
+	}
+	return ""
+}
+
 // answer worker
 func connectionWriteProcessing(
 	connection net.Conn,
 	backChannel *chan coreprocessing.CoreInstruction,
+	doneChannel chan bool,
 	dataManager *connectionsupport.ConnectionDataManager,
 	stat statistic.StatisticUpdater,
 	label string) {
@@ -71,7 +114,7 @@ func connectionWriteProcessing(
 	for wait {
 		newInstruction = <-*backChannel
 		if newInstruction.IsEmpty() {
-			rllogger.Outputf(rllogger.LogWarn, "Closed write process for %s empty instruction!", label)
+			rllogger.Outputf(rllogger.LogDebug, "Closed write process for %s empty instruction.", label)
 			wait = false
 		} else {
 			// write
@@ -111,14 +154,7 @@ func connectionWriteProcessing(
 				if newInstruction.StateChanges != nil {
 					// so simple.. without some visitor for statistic
 					if newInstruction.StateChanges.ChangeType == connectionsupport.StateChangesTypeGroup {
-						switch newInstruction.StateChanges.ConnectionClientGroup {
-						case connectionsupport.GroupConnectionClient:
-							statGroupName = "count_connection_client"
-						case connectionsupport.GroupConnectionServer:
-							statGroupName = "count_connection_server"
-						case connectionsupport.GroupConnectionWsClient:
-							statGroupName = "count_connection_web"
-						}
+						statGroupName = groupStatName(newInstruction.StateChanges.ConnectionClientGroup)
 						stat.AddOneMsg(statGroupName)
 					}
 					// update data in manager
@@ -139,7 +175,130 @@ func connectionWriteProcessing(
 		}
 	}
 	stat.DelOneMsg(statGroupName)
-	close(*backChannel)
+	close(doneChannel)
+}
+
+// timestamps of connection activity
+type connectionTimer struct {
+	connected     time.Time
+	lastActivity  time.Time
+	lineStart     time.Time
+	lastHeartbeat time.Time
+}
+
+func newConnectionTimer() *connectionTimer {
+	now := time.Now()
+	timer := connectionTimer{connected: now, lastActivity: now}
+	return &timer
+}
+
+// statistic code of disconnect reason, empty if connection can wait more
+func (server *ConnectionServer) checkTimeouts(
+	connectionData *connectionsupport.ConnectionData,
+	timer *connectionTimer,
+	hasPartLine bool) string {
+	//
+	option := server.getOption()
+	now := time.Now()
+	if hasPartLine && option.ReadTimeout > 0 && now.Sub(timer.lineStart) > option.GetReadTimeout() {
+		return "disconnect_read_timeout"
+	}
+	if option.AuthTimeout > 0 && now.Sub(timer.connected) > option.GetAuthTimeout() &&
+		!server.connectionDataManager.IsAuth(connectionData.Cid) {
+		return "disconnect_auth_timeout"
+	}
+	if option.IdleTimeout > 0 && now.Sub(timer.lastActivity) > option.GetIdleTimeout() {
+		return "disconnect_idle"
+	}
+	return ""
+}
+
+// ping silent connection, client can answer with any command
+func (server *ConnectionServer) sendHeartbeat(
+	connectionData *connectionsupport.ConnectionData,
+	timer *connectionTimer,
+	workerManager *coresupport.CoreWorkerManager) {
+	//
+	option := server.getOption()
+	now := time.Now()
+	period := option.GetHeartbeatPeriod()
+	if option.HeartbeatPeriod > 0 && now.Sub(timer.lastActivity) >= period && now.Sub(timer.lastHeartbeat) >= period {
+		timer.lastHeartbeat = now
+		ping := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionPing)
+		ping.SetCommand(transport.NewCommand(0, connectionData.Cid, "ping", ""))
+		if workerManager.SendToConnection(connectionData.Cid, ping) {
+			server.stat.AddOneMsg("heartbeat_sent")
+		}
+	}
+}
+
+// rebind parked session to this connection, connection data of session returned
+func (server *ConnectionServer) resumeSession(
+	cmd *transport.Command,
+	connectionData *connectionsupport.ConnectionData,
+	backChannel *chan coreprocessing.CoreInstruction,
+	workerManager *coresupport.CoreWorkerManager) *connectionsupport.ConnectionData {
+	//
+	inIns := coreprocessing.NewCoreInstructionForMessage(coreprocessing.TypeInstructionOk, connectionData.Cid, cmd)
+	grace := server.getOption().GetResumeTimeout()
+	var sessionData *connectionsupport.ConnectionData
+	var token string
+	var errStr string
+	if grace <= 0 || server.connectionDataManager.IsAuth(connectionData.Cid) {
+		errStr = "Session can't be resumed on this connection."
+	} else if cid, newToken, ok := server.sessions.Resume(cmd.Params.Data, grace); !ok {
+		errStr = "Session not found, expired or not closed yet."
+	} else if data, err := connectionsupport.ExtractConnectionData(cid); err != nil {
+		errStr = fmt.Sprint(err)
+	} else {
+		sessionData = data
+		token = newToken
+	}
+	if sessionData == nil {
+		server.stat.AddOneMsg("session_resume_failed")
+		outIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionProblem)
+		outIns.Cid = connectionData.Cid
+		outIns.SetAnswer(inIns.MakeErrAnswer(transport.ErrorCodeMethodAuthFailed, errStr))
+		(*backChannel) <- (*outIns)
+		return connectionData
+	}
+	workerManager.RemoveBackChannel(connectionData)
+	server.connectionDataManager.RemoveConnection(connectionData.Cid)
+	outIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionOk)
+	outIns.Cid = sessionData.Cid
+	outIns.SetAnswer(inIns.MakeOkAnswer(
+		fmt.Sprintf("{\"ok\": true, \"cid\": \"%s\", \"resume\": \"%s\"}", sessionData.Cid, token)))
+	// answer before instructions queued for session
+	(*backChannel) <- (*outIns)
+	workerManager.ResumeBackChannel(sessionData, backChannel)
+	server.stat.AddOneMsg("session_resumed")
+	if name := groupStatName(server.connectionDataManager.GetGroup(sessionData.Cid)); len(name) > 0 {
+		server.stat.AddOneMsg(name)
+	}
+	rllogger.Outputf(rllogger.LogInfo, "Session %s resumed by %s", sessionData.Cid, connectionData.Cid)
+	return sessionData
+}
+
+// session of lost connection can wait resumption
+func (server *ConnectionServer) canParkSession(connectionData *connectionsupport.ConnectionData) bool {
+	if server.getOption().GetResumeTimeout() <= 0 {
+		return false
+	}
+	switch server.connectionDataManager.GetGroup(connectionData.Cid) {
+	case connectionsupport.GroupConnectionPeer, connectionsupport.GroupConnectionReplica:
+		// nodes reconnect with new session
+		return false
+	}
+	return server.sessions.Exists(connectionData.Cid)
+}
+
+// parked session without resumption
+func (server *ConnectionServer) closeParkedSession(cid string, workerManager *coresupport.CoreWorkerManager) {
+	if connectionData, err := connectionsupport.ExtractConnectionData(cid); err == nil {
+		workerManager.RemoveBackChannel(connectionData)
+		server.connectionDataManager.RemoveConnection(cid)
+		rllogger.Outputf(rllogger.LogDebug, "Parked session %s closed.", cid)
+	}
 }
 
 func (server *ConnectionServer) connectionReadProcessing(
@@ -150,32 +309,61 @@ func (server *ConnectionServer) connectionReadProcessing(
 	defer connection.Close()
 	buffer := bufio.NewReader(connection)
 	wait := true
-	hasAnswerChannel := false
 	connectionData := server.connectionDataManager.NewConnection()
 	// TODO: rllogger.LogDebug
 	rllogger.Outputf(rllogger.LogInfo, "new connection %s", connectionData.Cid)
-	sizeBuffer := (*server).option.BufferSize
+	sizeBuffer := server.getOption().BufferSize
+	// back channel exists before first command
+	backChannel := make(chan coreprocessing.CoreInstruction, sizeBuffer)
+	writerDone := make(chan bool)
+	go connectionWriteProcessing(
+		connection, &backChannel, writerDone, (*server).connectionDataManager, server.stat, label)
+	workerManager.AppendBackChannel(connectionData, &backChannel)
+	useDeadline := false
+	timer := newConnectionTimer()
+	canPark := false
+	var lineData []byte
 
 	for wait {
-		//
-		lineData, _, err := buffer.ReadLine()
+		// timeouts can be changed by reload
+		if server.getOption().HasConnectionTimeouts() {
+			useDeadline = true
+			connection.SetReadDeadline(time.Now().Add(readCheckPeriod))
+		} else if useDeadline {
+			useDeadline = false
+			connection.SetReadDeadline(time.Time{})
+		}
+		data, err := buffer.ReadBytes('\n')
+		if len(data) > 0 {
+			if len(lineData) == 0 {
+				timer.lineStart = time.Now()
+			}
+			lineData = append(lineData, data...)
+		}
 		if err == nil {
+			lineData = bytes.TrimRight(lineData, "\r\n")
+			timer.lastActivity = time.Now()
+			server.connectionDataManager.Touch(connectionData)
 			server.stat.SendMsg("income_data_size", len(lineData))
 			if cmd, err := transport.ParseCommand(&lineData); err == nil {
-				workerManager.Processing(cmd, server.connectionDataManager, connectionData)
-				if !hasAnswerChannel {
-					// create
-					backChannel := make(chan coreprocessing.CoreInstruction, sizeBuffer)
-					// dont like closure, only realy need
-					go connectionWriteProcessing(
-						connection, &backChannel, (*server).connectionDataManager, server.stat, label)
-					workerManager.AppendBackChannel(connectionData, &backChannel)
-					hasAnswerChannel = true
+				if cmd.Method == connectionsupport.MethodResume {
+					connectionData = server.resumeSession(cmd, connectionData, &backChannel, workerManager)
+				} else {
+					workerManager.Processing(cmd, server.connectionDataManager, connectionData)
 				}
 			} else {
 				server.stat.SendMsg("bad_command_count", 1)
 				rllogger.Outputf(rllogger.LogWarn, "connection %s bad command: %s", connectionData.Cid, err)
 			}
+			lineData = nil
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if reason := server.checkTimeouts(connectionData, timer, len(lineData) > 0); len(reason) > 0 {
+				server.stat.AddOneMsg(reason)
+				rllogger.Outputf(rllogger.LogDebug, "connection %s closed: %s", connectionData.Cid, reason)
+				wait = false
+			} else {
+				server.sendHeartbeat(connectionData, timer, workerManager)
+			}
 		} else {
 			// has error
 			if err == io.EOF {
@@ -183,69 +371,226 @@ func (server *ConnectionServer) connectionReadProcessing(
 				workerManager.BrokenConnection(connectionData)
 				rllogger.Outputf(rllogger.LogDebug, "broken connection %s", connectionData.Cid)
 			}
+			// lost, not closed by node
+			canPark = !errors.Is(err, net.ErrClosed)
 			wait = false
 		}
 	}
 	server.stat.DelOneMsg("connection_count")
-	// remove from methods
+	parked := canPark && server.canParkSession(connectionData)
+	// remove from methods, server registers methods again after resumption
 	if server.connectionDataManager.ClientInGroup(connectionData.Cid, connectionsupport.GroupConnectionServer) {
-		cidMethods := coreprocessing.NewRpcServerManager()
-		cidMethods.Remove(connectionData.Cid)
+		workerManager.Core().RpcManager.Remove(connectionData.Cid)
 		server.stat.DelOneMsg("count_connection_server")
+	} else if server.connectionDataManager.ClientInGroup(connectionData.Cid, connectionsupport.GroupConnectionPeer) {
+		workerManager.Core().RpcManager.Remove(connectionData.Cid)
+		server.stat.DelOneMsg("count_connection_peer")
+	} else if server.connectionDataManager.ClientInGroup(connectionData.Cid, connectionsupport.GroupConnectionReplica) {
+		workerManager.Core().RpcManager.Remove(connectionData.Cid)
+		server.stat.DelOneMsg("count_connection_replica")
 	} else {
 		server.stat.DelOneMsg("count_connection_client")
 	}
-	workerManager.RemoveBackChannel(connectionData)
+	if parked {
+		workerManager.ParkBackChannel(connectionData)
+	} else {
+		workerManager.RemoveBackChannel(connectionData)
+	}
+	// stop writer
+	select {
+	case backChannel <- coreprocessing.CoreInstruction{}:
+	case <-writerDone:
+	}
+	// session is resumable only after methods and back channel released
+	if parked && !server.sessions.Park(connectionData.Cid) {
+		workerManager.RemoveBackChannel(connectionData)
+		parked = false
+	}
+	if parked {
+		server.stat.AddOneMsg("session_parked")
+		rllogger.Outputf(rllogger.LogInfo, "out connection %s, session parked", connectionData.Cid)
+	} else {
+		server.sessions.Remove(connectionData.Cid)
+		server.connectionDataManager.RemoveConnection(connectionData.Cid)
+		// TODO: rllogger.LogDebug
+		rllogger.Outputf(rllogger.LogInfo, "out connection %s", connectionData.Cid)
+	}
+}
+
+// connection without socket for calls from peer node
+func (server *ConnectionServer) OpenLocalConnection(
+	backChannel *chan coreprocessing.CoreInstruction) *connectionsupport.ConnectionData {
+	//
+	connectionData := server.connectionDataManager.NewConnection()
+	server.connectionDataManager.UpdateState(
+		connectionData.Cid,
+		connectionsupport.StateChanges{
+			ChangeType:            connectionsupport.StateChangesTypeAll,
+			Auth:                  true,
+			KeyName:               server.getOption().Node,
+			ConnectionClientGroup: connectionsupport.GroupConnectionPeer,
+			Status:                connectionsupport.ClientStatusActive})
+	(*server).workerManager.AppendBackChannel(connectionData, backChannel)
+	return connectionData
+}
+
+func (server *ConnectionServer) SendLocalCommand(
+	connectionData *connectionsupport.ConnectionData,
+	cmd *transport.Command) {
+	//
+	(*server).workerManager.Processing(cmd, server.connectionDataManager, connectionData)
+}
+
+func (server *ConnectionServer) CloseLocalConnection(connectionData *connectionsupport.ConnectionData) {
+	(*server).workerManager.RemoveBackChannel(connectionData)
 	server.connectionDataManager.RemoveConnection(connectionData.Cid)
-	// TODO: rllogger.LogDebug
-	rllogger.Outputf(rllogger.LogInfo, "out connection %s", connectionData.Cid)
+}
+
+// close sessions authenticated with revoked or removed key
+func (server *ConnectionServer) CloseKeySessions(keyName string) {
+	for _, cid := range server.connectionDataManager.GetKeyConnections(keyName) {
+		rllogger.Outputf(rllogger.LogInfo, "Session %s of key '%s' closing.", cid, keyName)
+		server.stat.AddOneMsg("disconnect_revoked")
+		if server.sessions.IsParked(cid) {
+			server.sessions.Remove(cid)
+			server.closeParkedSession(cid, (*server).workerManager)
+		} else {
+			server.sessions.Remove(cid)
+			(*server).workerManager.SendToConnection(cid, coreprocessing.NewExitCoreInstruction())
+		}
+	}
 }
 
 func (server *ConnectionServer) WorkerHandlerConfigure(handler *coreprocessing.Handler) {
 	(*handler).StateCheker = (*server).connectionDataManager
+	(*handler).Sessions = (*server).sessions
+}
+
+// ping registered servers, silent servers look like busy and closed after grace
+func (server *ConnectionServer) healthCheckProcessing(workerManager *coresupport.CoreWorkerManager) {
+	period := server.getOption().GetStatusCheckPeriod()
+	closing := make(map[string]bool)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for server.isAcceptForConnection() {
+		now := <-ticker.C
+		option := server.getOption()
+		misses, closeMisses := option.GetHealthMisses()
+		if newPeriod := option.GetStatusCheckPeriod(); newPeriod != period {
+			period = newPeriod
+			ticker.Reset(period)
+		}
+		servers := server.connectionDataManager.GetGroupHealth(connectionsupport.GroupConnectionServer)
+		active := make(map[string]bool)
+		for _, health := range servers {
+			active[health.Cid] = true
+			if closing[health.Cid] {
+				continue
+			}
+			missed := int(now.Sub(health.LastSeen) / period)
+			if missed >= closeMisses {
+				rllogger.Outputf(
+					rllogger.LogWarn, "Server %s lost (last seen %s), closing.", health.Cid, health.LastSeen)
+				// full channel of stuck server, try again on next check
+				if workerManager.TrySendToConnection(health.Cid, coreprocessing.NewExitCoreInstruction()) {
+					server.stat.AddOneMsg("health_closed")
+					closing[health.Cid] = true
+				}
+				continue
+			}
+			if missed >= misses && health.Healthy {
+				rllogger.Outputf(
+					rllogger.LogWarn, "Server %s unhealthy (last seen %s).", health.Cid, health.LastSeen)
+				server.stat.AddOneMsg("health_unhealthy")
+				server.connectionDataManager.SetHealthy(health.Cid, false)
+			}
+			ping := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionPing)
+			ping.SetCommand(transport.NewCommand(0, health.Cid, "ping", ""))
+			if !workerManager.TrySendToConnection(health.Cid, ping) {
+				// last seen isn't changed, it is missed ping
+				server.stat.AddOneMsg("health_ping_dropped")
+			}
+		}
+		for cid, _ := range closing {
+			if !active[cid] {
+				delete(closing, cid)
+			}
+		}
+		for _, cid := range server.sessions.Expired(option.GetResumeTimeout()) {
+			server.stat.AddOneMsg("session_expired")
+			server.closeParkedSession(cid, workerManager)
+		}
+	}
 }
 
 func (server *ConnectionServer) Start(workerManager *coresupport.CoreWorkerManager) {
 	options := (*server).option
 	(*server).connectionDataManager = connectionsupport.NewConnectionDataManager(options)
-	go server.startListener(workerManager)
+	(*server).workerManager = workerManager
+	server.startListener(workerManager)
+	go server.healthCheckProcessing(workerManager)
 }
 
+// address of listener, real port if port in options is 0
+func (server *ConnectionServer) Addr() string {
+	(*server).statusChangeLock.RLock()
+	defer (*server).statusChangeLock.RUnlock()
+	if (*server).listener != nil {
+		return (*server).listener.Addr().String()
+	}
+	return (*server).option.Socket()
+}
+
+// listener is ready after return, connections accepted in background
 func (server *ConnectionServer) startListener(workerManager *coresupport.CoreWorkerManager) {
 	if server.GetStatus() != ServerStatusOn {
 		server.SetStatus(ServerStatusOn)
-		options := (*server).option
-		socket := options.Socket()
+		socket := server.getOption().Socket()
 		listener, err := net.Listen("tcp", socket)
 		if err == nil {
-			defer listener.Close()
-			defer (*server).connectionDataManager.Close()
-			for server.isAcceptForConnection() {
-				newConnection, err := listener.Accept()
-				if err != nil {
-					rllogger.Outputf(
-						rllogger.LogTerminate, "Can't create connection to %s error: %s", socket, err)
-					server.stat.SendMsg("lost_connection_count", 1)
-				} else {
-					clientAddr := fmt.Sprintf("connection:%s", newConnection.RemoteAddr())
-					rllogger.Outputf(rllogger.LogDebug, "new %s", clientAddr)
-					tcpConnection := newConnection.(*net.TCPConn)
-					tcpConnection.SetKeepAlive(true)
-					tcpConnection.SetKeepAlivePeriod(
-						time.Duration(1+options.StatusCheckPeriod) * time.Second)
-					server.stat.SendMsg("connection_count", 1)
-					go server.connectionReadProcessing(
-						newConnection,
-						workerManager,
-						clientAddr)
-				}
-			}
+			(*server).statusChangeLock.Lock()
+			(*server).listener = listener
+			(*server).statusChangeLock.Unlock()
+			go server.acceptProcessing(listener, workerManager)
 		} else {
 			rllogger.Outputf(rllogger.LogTerminate, "Can't start server at %s error: %s", socket, err)
 		}
 	}
 }
 
+func (server *ConnectionServer) acceptProcessing(
+	listener net.Listener,
+	workerManager *coresupport.CoreWorkerManager) {
+	//
+	options := server.getOption()
+	socket := listener.Addr().String()
+	defer listener.Close()
+	defer (*server).connectionDataManager.Close()
+	for server.isAcceptForConnection() {
+		newConnection, err := listener.Accept()
+		if err != nil && !server.isAcceptForConnection() {
+			// listener closed by stop
+			rllogger.Output(rllogger.LogDebug, "Listener closed.")
+		} else if err != nil {
+			rllogger.Outputf(
+				rllogger.LogTerminate, "Can't create connection to %s error: %s", socket, err)
+			server.stat.SendMsg("lost_connection_count", 1)
+		} else {
+			clientAddr := fmt.Sprintf("connection:%s", newConnection.RemoteAddr())
+			rllogger.Outputf(rllogger.LogDebug, "new %s", clientAddr)
+			tcpConnection := newConnection.(*net.TCPConn)
+			tcpConnection.SetKeepAlive(true)
+			tcpConnection.SetKeepAlivePeriod(
+				time.Duration(1+options.StatusCheckPeriod) * time.Second)
+			server.stat.SendMsg("connection_count", 1)
+			go server.connectionReadProcessing(
+				newConnection,
+				workerManager,
+				clientAddr)
+		}
+	}
+}
+
 func NewServer(option options.SysOption, stat *statistic.Statistic) *ConnectionServer {
 	stat.AddItem("connection_count", "Client conntection count")
 	stat.AddItem("income_data_size", "Income data size")
@@ -254,14 +599,30 @@ func NewServer(option options.SysOption, stat *statistic.Statistic) *ConnectionS
 	stat.AddItem("lost_connection_count", "Lost connection count")
 	stat.AddItem("auth_request", "Request for auth count")
 	stat.AddItem("auth_successfull", "Successfully auth request count")
+	stat.AddItem("auth_challenge", "Challenge for auth request count")
 	stat.AddItem("count_connection_client", "Connection count (service clients)")
 	stat.AddItem("count_connection_server", "Connection count (servers)")
 	stat.AddItem("count_connection_web", "Connection count (web-socket)")
+	stat.AddItem("count_connection_peer", "Connection count (peer nodes)")
+	stat.AddItem("count_connection_replica", "Connection count (standby nodes)")
+	stat.AddItem("health_unhealthy", "Servers marked unhealthy count")
+	stat.AddItem("health_closed", "Lost servers closed count")
+	stat.AddItem("health_ping_dropped", "Pings to servers with full channel count")
+	stat.AddItem("disconnect_idle", "Idle connections closed count")
+	stat.AddItem("disconnect_read_timeout", "Read timeout connections closed count")
+	stat.AddItem("disconnect_auth_timeout", "Not authenticated connections closed count")
+	stat.AddItem("heartbeat_sent", "Heartbeat to silent connections count")
+	stat.AddItem("disconnect_revoked", "Sessions of revoked keys closed count")
+	stat.AddItem("session_parked", "Sessions of lost connections parked count")
+	stat.AddItem("session_resumed", "Parked sessions resumed count")
+	stat.AddItem("session_resume_failed", "Failed resume requests count")
+	stat.AddItem("session_expired", "Parked sessions expired count")
 	//
 	server := ConnectionServer{
 		statusAcceptedObject: statusAcceptedObject{
 			statusChangeLock: new(sync.RWMutex)},
-		option: option,
-		stat:   stat}
+		option:   option,
+		stat:     stat,
+		sessions: connectionsupport.NewResumeDict()}
 	return &server
 }
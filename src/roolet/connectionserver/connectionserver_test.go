@@ -0,0 +1,237 @@
+package connectionserver_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"roolet/broker"
+	"roolet/connectionsupport"
+	"roolet/coreprocessing"
+	"roolet/cryptosupport"
+	"roolet/testsupport"
+	"roolet/transport"
+	"testing"
+	"time"
+)
+
+type nodeMessage struct {
+	Id     int                         `json:"id"`
+	Method string                      `json:"method"`
+	Params transport.MethodParams      `json:"params"`
+	Result string                      `json:"result"`
+	Error  *transport.ErrorDescription `json:"error"`
+}
+
+func dialNode(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	connection, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	return connection, bufio.NewReader(connection)
+}
+
+// next message from node or io error
+func readNode(connection net.Conn, reader *bufio.Reader, timeout time.Duration) (*nodeMessage, error) {
+	connection.SetReadDeadline(time.Now().Add(timeout))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	msg := nodeMessage{}
+	return &msg, json.Unmarshal(line, &msg)
+}
+
+// command and its answer, other messages are skipped
+func requestNode(t *testing.T, connection net.Conn, reader *bufio.Reader, cmd *transport.Command) *nodeMessage {
+	data, _ := cmd.Dump()
+	if _, err := connection.Write([]byte(*data)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := readNode(connection, reader, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Answer to '%s' lost: %s", cmd.Method, err)
+		}
+		if len(msg.Method) == 0 && msg.Id == cmd.Id {
+			return msg
+		}
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	option := testsupport.NewOption("")
+	option.AuthTimeout = 1
+	node := testsupport.StartBroker(t, option, nil)
+	// timer of connection is started on server after dial
+	start := time.Now()
+	connection, reader := dialNode(t, node.Addr())
+	if msg, err := readNode(connection, reader, 5*time.Second); err != io.EOF {
+		t.Fatalf("Connection without auth must be closed: %v %s", msg, err)
+	}
+	if wait := time.Since(start); wait < time.Second {
+		t.Errorf("Connection closed before auth timeout: %s", wait)
+	}
+}
+
+func TestIdleHeartbeat(t *testing.T) {
+	option := testsupport.NewOption("")
+	option.HeartbeatPeriod = 1
+	option.IdleTimeout = 3
+	node := testsupport.StartBroker(t, option, nil)
+	// timer of connection is started on server after dial
+	start := time.Now()
+	connection, reader := dialNode(t, node.Addr())
+	msg, err := readNode(connection, reader, 5*time.Second)
+	if err != nil || msg.Method != "ping" {
+		t.Fatalf("Heartbeat expected: %v %s", msg, err)
+	}
+	// silent client is closed after idle timeout
+	for err == nil {
+		msg, err = readNode(connection, reader, 5*time.Second)
+	}
+	if err != io.EOF {
+		t.Fatalf("Idle connection must be closed: %s", err)
+	}
+	if wait := time.Since(start); wait < 3*time.Second {
+		t.Errorf("Connection closed before idle timeout: %s", wait)
+	}
+}
+
+func TestResumeQueuedResult(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "web1")
+	option := testsupport.NewOption(keyDir)
+	option.ResumeTimeout = 10
+	release := make(chan struct{})
+	node := testsupport.StartBroker(t, option, func(node *broker.Broker) {
+		node.Core().SetupNativeMethod(
+			"test_wait",
+			func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+				<-release
+				return "done", nil
+			})
+	})
+	connection, reader := dialNode(t, node.Addr())
+	token, _ := cryptosupport.CreateClientToken(option, "web1", keys["web1"])
+	msg := requestNode(t, connection, reader, transport.NewCommandWithParams(
+		1, "auth", transport.MethodParams{Json: "{\"key\": \"web1\"}", Data: token}))
+	authData := struct {
+		Resume string `json:"resume"`
+	}{}
+	if err := json.Unmarshal([]byte(msg.Result), &authData); err != nil || len(authData.Resume) == 0 {
+		t.Fatalf("Auth with resume token expected: %v %s", msg, err)
+	}
+	msg = requestNode(t, connection, reader, transport.NewCommandWithParams(
+		2, "registration", transport.MethodParams{
+			Json: fmt.Sprintf("{\"group\": %d, \"methods\": []}", connectionsupport.GroupConnectionClient)}))
+	if msg.Error != nil && msg.Error.Code > 0 {
+		t.Fatalf("Registration failed: %s", msg.Error)
+	}
+	// answer with task is ready when session is parked already
+	cmd := transport.NewCommandWithParams(3, "test_wait", transport.MethodParams{})
+	data, _ := cmd.Dump()
+	connection.Write([]byte(*data))
+	time.Sleep(200 * time.Millisecond)
+	connection.Close()
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+
+	connection, reader = dialNode(t, node.Addr())
+	msg = requestNode(t, connection, reader, transport.NewCommandWithParams(
+		1, connectionsupport.MethodResume, transport.MethodParams{Data: authData.Resume}))
+	if msg.Error != nil && msg.Error.Code > 0 {
+		t.Fatalf("Session must be resumed: %s", msg.Error)
+	}
+	var route struct {
+		Task string `json:"task"`
+	}
+	for len(route.Task) == 0 {
+		msg, err := readNode(connection, reader, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Queued answer lost: %s", err)
+		}
+		if msg.Id == cmd.Id {
+			json.Unmarshal([]byte(msg.Result), &route)
+		}
+	}
+	msg = requestNode(t, connection, reader, transport.NewCommandWithParams(
+		4, "getresult", transport.MethodParams{Task: route.Task}))
+	if msg.Result != "{\"result\":\"done\"}" {
+		t.Errorf("Unexpected result: %v", msg)
+	}
+}
+
+func TestResumeAfterDisconnect(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "web1")
+	option := testsupport.NewOption(keyDir)
+	option.ResumeTimeout = 10
+	node := testsupport.StartBroker(t, option, func(node *broker.Broker) {
+		node.Core().SetupNativeMethod(
+			"test_echo",
+			func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+				return params.Data, nil
+			})
+	})
+	connection, reader := dialNode(t, node.Addr())
+	token, _ := cryptosupport.CreateClientToken(option, "web1", keys["web1"])
+	msg := requestNode(t, connection, reader, transport.NewCommandWithParams(
+		1, "auth", transport.MethodParams{Json: "{\"key\": \"web1\"}", Data: token}))
+	authData := struct {
+		Resume string `json:"resume"`
+	}{}
+	if err := json.Unmarshal([]byte(msg.Result), &authData); err != nil || len(authData.Resume) == 0 {
+		t.Fatalf("Auth with resume token expected: %v %s", msg, err)
+	}
+	msg = requestNode(t, connection, reader, transport.NewCommandWithParams(
+		2, "registration", transport.MethodParams{
+			Json: fmt.Sprintf("{\"group\": %d, \"methods\": []}", connectionsupport.GroupConnectionClient)}))
+	if msg.Error != nil && msg.Error.Code > 0 {
+		t.Fatalf("Registration failed: %s", msg.Error)
+	}
+	// resume commands are sent without pause while old connection is closed on server side
+	for cycle := 0; cycle < 10; cycle++ {
+		nextConnection, nextReader := dialNode(t, node.Addr())
+		resumeToken := authData.Resume
+		stop := make(chan struct{})
+		sent := make(chan int)
+		go func() {
+			id := 0
+			defer func() { sent <- id }()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id++
+				data, _ := transport.NewCommandWithParams(
+					id, connectionsupport.MethodResume, transport.MethodParams{Data: resumeToken}).Dump()
+				if _, err := nextConnection.Write([]byte(*data)); err != nil {
+					return
+				}
+			}
+		}()
+		connection.Close()
+		connection, reader = nextConnection, nextReader
+		resumed := false
+		for !resumed {
+			msg, err := readNode(connection, reader, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Session must be resumed: %s", err)
+			}
+			if msg.Error == nil || msg.Error.Code == 0 {
+				json.Unmarshal([]byte(msg.Result), &authData)
+				resumed = true
+			}
+		}
+		close(stop)
+		<-sent
+		msg = requestNode(t, connection, reader, transport.NewCommandWithParams(
+			-1, "test_echo", transport.MethodParams{Data: "alive"}))
+		if msg.Error != nil && msg.Error.Code > 0 {
+			t.Fatalf("Resumed session must work: %s", msg.Error)
+		}
+	}
+}
@@ -228,3 +228,80 @@ func TestNormalDistributionOfMissesAndHits(t *testing.T) {
 		t.Error("Async work problem with misses")
 	}
 }
+
+func TestServerHealthState(t *testing.T) {
+	option := options.SysOption{}
+	manager := connectionsupport.NewConnectionDataManager(option)
+	connData := manager.NewConnection()
+	manager.UpdateState(connData.Cid, connectionsupport.StateChanges{
+		ChangeType:            connectionsupport.StateChangesTypeGroup,
+		ConnectionClientGroup: connectionsupport.GroupConnectionServer})
+	servers := manager.GetGroupHealth(connectionsupport.GroupConnectionServer)
+	if len(servers) != 1 || servers[0].Cid != connData.Cid || !servers[0].Healthy {
+		t.Fatalf("Unexpected health data: %v", servers)
+	}
+	manager.SetHealthy(connData.Cid, false)
+	if !manager.ClientBusy(connData.Cid) {
+		t.Error("Unhealthy server must look like busy.")
+	}
+	lastSeen := manager.GetLastSeen(connData.Cid)
+	time.Sleep(10 * time.Millisecond)
+	manager.Touch(connData)
+	if manager.ClientBusy(connData.Cid) || !manager.GetLastSeen(connData.Cid).After(lastSeen) {
+		t.Error("Server must be healthy after new data.")
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	dict := connectionsupport.NewResumeDict()
+	cid := "abcd-0000000000000001-1"
+	token := dict.Issue(cid)
+	if !dict.Exists(cid) || dict.Exists("abcd-0000000000000002-1") {
+		t.Error("Session must exist only for connection with token.")
+	}
+	if _, _, ok := dict.Resume(token, time.Minute); ok {
+		t.Error("Active session can't be resumed.")
+	}
+	if dict.Park("abcd-0000000000000002-1") {
+		t.Error("Connection without session can't be parked.")
+	}
+	if !dict.Park(cid) || !dict.IsParked(cid) {
+		t.Fatal("Session must be parked.")
+	}
+	resumedCid, newToken, ok := dict.Resume(token, time.Minute)
+	if !ok || resumedCid != cid || newToken == token {
+		t.Fatalf("Session must be resumed with new token: %s %s", resumedCid, newToken)
+	}
+	dict.Park(cid)
+	if _, _, ok := dict.Resume(token, time.Minute); ok {
+		t.Error("Old token must be rejected.")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := dict.Resume(newToken, time.Millisecond); ok {
+		t.Error("Session after grace period can't be resumed.")
+	}
+	if expired := dict.Expired(time.Millisecond); len(expired) != 1 || expired[0] != cid {
+		t.Errorf("Session must be expired: %v", expired)
+	}
+	if dict.IsParked(cid) {
+		t.Error("Expired session must be removed.")
+	}
+}
+
+func TestUnknownCid(t *testing.T) {
+	option := options.SysOption{}
+	manager := connectionsupport.NewConnectionDataManager(option)
+	manager.NewConnection()
+	// malformed index, index of cell not created yet and unknown id
+	for _, cid := range []string{"a-1-0", "a-1--5", "abcd-0000000000000001-100", "abcd-00000000000fffff-1"} {
+		group := connectionsupport.GroupConnectionServer
+		if manager.ClientInGroup(cid, group) || manager.IsAuth(cid) || manager.GetGroup(cid) != 0 {
+			t.Errorf("Unexpected state of unknown connection %s.", cid)
+		}
+		if manager.GetKeyName(cid) != "" || !manager.GetLastSeen(cid).IsZero() {
+			t.Errorf("Unexpected data of unknown connection %s.", cid)
+		}
+		manager.SetHealthy(cid, false)
+		manager.RemoveConnection(cid)
+	}
+}
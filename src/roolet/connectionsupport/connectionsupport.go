@@ -8,6 +8,7 @@ import (
 	"roolet/rllogger"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -19,9 +20,12 @@ const (
 	GroupConnectionServer   = 1
 	GroupConnectionClient   = 2
 	GroupConnectionWsClient = 3
+	GroupConnectionPeer     = 4
+	GroupConnectionReplica  = 5
 	// client status
 	ClientStatusActive = 1
 	ClientStatusBusy   = 2
+	ClientStatusDrain  = 3
 	// state change types
 	StateChangesTypeSkip   = 0
 	StateChangesTypeAll    = 1
@@ -30,6 +34,19 @@ const (
 	StateChangesTypeStatus = 4
 )
 
+// names of groups in options
+var groupNames = map[int]string{
+	GroupConnectionServer:   "server",
+	GroupConnectionClient:   "client",
+	GroupConnectionWsClient: "web",
+	GroupConnectionPeer:     "peer",
+	GroupConnectionReplica:  "replica"}
+
+func GetGroupName(group int) (string, bool) {
+	name, exists := groupNames[group]
+	return name, exists
+}
+
 type ConnectionData struct {
 	Cid string
 	// [1...n]
@@ -89,14 +106,18 @@ func (connData *ConnectionData) GetResourceIndex() int {
 }
 
 type ClientStateData struct {
-	TempData []byte
-	auth     bool
-	group    int
-	status   uint16
-}
-
-func newClientStateData() *ClientStateData {
-	result := ClientStateData{}
+	TempData  []byte
+	cid       string
+	auth      bool
+	keyName   string
+	group     int
+	status    uint16
+	lastSeen  time.Time
+	unhealthy bool
+}
+
+func newClientStateData(cid string) *ClientStateData {
+	result := ClientStateData{cid: cid, lastSeen: time.Now()}
 	return &result
 }
 
@@ -105,6 +126,7 @@ func (stateData *ClientStateData) clear() {
 	(*stateData).auth = false
 	(*stateData).group = 0
 	(*stateData).auth = false
+	(*stateData).keyName = ""
 }
 
 // update state way
@@ -116,6 +138,7 @@ type StateChanges struct {
 	// accepted field for changes in base state
 	ChangeType            int
 	Auth                  bool
+	KeyName               string
 	ConnectionClientGroup int
 	Status                uint16
 }
@@ -124,6 +147,11 @@ func (changes StateChanges) update(state *ClientStateData) {
 	t := changes.ChangeType
 	if t == StateChangesTypeAll || t == StateChangesTypeAuth {
 		(*state).auth = changes.Auth
+		if changes.Auth {
+			(*state).keyName = changes.KeyName
+		} else {
+			(*state).keyName = ""
+		}
 	}
 	if t == StateChangesTypeAll || t == StateChangesTypeGroup {
 		(*state).group = changes.ConnectionClientGroup
@@ -139,10 +167,19 @@ type ConnectionDataStorageCell struct {
 	data map[int64]*ClientStateData
 }
 
-func (cell *ConnectionDataStorageCell) create(id int64) {
+func (cell *ConnectionDataStorageCell) create(id int64, cid string) {
+	cell.Lock(true)
+	defer cell.Unlock(true)
+	(*cell).data[id] = newClientStateData(cid)
+}
+
+func (cell *ConnectionDataStorageCell) touch(id int64) {
 	cell.Lock(true)
 	defer cell.Unlock(true)
-	(*cell).data[id] = newClientStateData()
+	if rec, exists := (*cell).data[id]; exists {
+		(*rec).lastSeen = time.Now()
+		(*rec).unhealthy = false
+	}
 }
 
 func (cell *ConnectionDataStorageCell) Clear(id int64) {
@@ -165,7 +202,7 @@ func (cell *ConnectionDataStorageCell) IsBusy(id int64) bool {
 	cell.Lock(false)
 	defer cell.Unlock(false)
 	if rec, exists := (*cell).data[id]; exists {
-		return (*rec).status == ClientStatusBusy
+		return (*rec).status == ClientStatusBusy || (*rec).unhealthy
 	} else {
 		return false
 	}
@@ -184,6 +221,14 @@ type ConnectionStateChecker interface {
 	ClientBusy(cid string) bool
 	CheckStorageExists(index int) bool
 	IsAuth(cid string) bool
+	GetKeyName(cid string) string
+	GetLastSeen(cid string) time.Time
+}
+
+type ConnectionHealth struct {
+	Cid      string
+	LastSeen time.Time
+	Healthy  bool
 }
 
 type ConnectionDataManager struct {
@@ -246,8 +291,8 @@ func (manager *ConnectionDataManager) NewConnection() *ConnectionData {
 		(*manager).storage[index-1] = newConnectionDataStorageCell()
 	}
 	manager.Unlock(true)
-	(*manager).storage[index-1].create(value)
 	connectionData := newConnectionData(prefix, value, index)
+	(*manager).storage[index-1].create(value, connectionData.Cid)
 	return connectionData
 }
 
@@ -255,9 +300,13 @@ func (manager *ConnectionDataManager) NewConnection() *ConnectionData {
 func (manager *ConnectionDataManager) UpdateState(cid string, updater ClientDataUpdater) {
 	if connData, err := ExtractConnectionData(cid); err == nil {
 		if manager.CheckStorageExists(connData.index) {
-			manager.Lock(true)
-			updater.update(manager.storage[connData.index-1].data[connData.id])
-			manager.Unlock(true)
+			cell := manager.storage[connData.index-1]
+			cell.Lock(true)
+			// connection can be closed already
+			if rec, exists := (*cell).data[connData.id]; exists {
+				updater.update(rec)
+			}
+			cell.Unlock(true)
 		}
 	}
 }
@@ -279,14 +328,14 @@ func (manager *ConnectionDataManager) ClientBusy(cid string) bool {
 }
 
 func (manager *ConnectionDataManager) RemoveConnection(cid string) {
-	if connData, err := ExtractConnectionData(cid); err == nil {
+	if connData, err := ExtractConnectionData(cid); err == nil && manager.CheckStorageExists(connData.index) {
 		manager.storage[connData.index-1].Remove(connData.id)
 	}
 }
 
 func (manager *ConnectionDataManager) ClientInGroup(cid string, group int) bool {
 	result := false
-	if connData, err := ExtractConnectionData(cid); err == nil {
+	if connData, err := ExtractConnectionData(cid); err == nil && manager.CheckStorageExists(connData.index) {
 		cell := manager.storage[connData.index-1]
 		cell.Lock(false)
 		defer cell.Unlock(false)
@@ -299,7 +348,7 @@ func (manager *ConnectionDataManager) ClientInGroup(cid string, group int) bool
 
 func (manager *ConnectionDataManager) IsAuth(cid string) bool {
 	result := false
-	if connData, err := ExtractConnectionData(cid); err == nil {
+	if connData, err := ExtractConnectionData(cid); err == nil && manager.CheckStorageExists(connData.index) {
 		cell := manager.storage[connData.index-1]
 		cell.Lock(false)
 		defer cell.Unlock(false)
@@ -310,6 +359,114 @@ func (manager *ConnectionDataManager) IsAuth(cid string) bool {
 	return result
 }
 
+func (manager *ConnectionDataManager) GetGroup(cid string) int {
+	result := 0
+	if connData, err := ExtractConnectionData(cid); err == nil && manager.CheckStorageExists(connData.index) {
+		cell := manager.storage[connData.index-1]
+		cell.Lock(false)
+		defer cell.Unlock(false)
+		if rec, exists := (*cell).data[connData.id]; exists {
+			result = (*rec).group
+		}
+	}
+	return result
+}
+
+// name of client key used for auth
+func (manager *ConnectionDataManager) GetKeyName(cid string) string {
+	result := ""
+	if connData, err := ExtractConnectionData(cid); err == nil && manager.CheckStorageExists(connData.index) {
+		cell := manager.storage[connData.index-1]
+		cell.Lock(false)
+		defer cell.Unlock(false)
+		if rec, exists := (*cell).data[connData.id]; exists {
+			result = (*rec).keyName
+		}
+	}
+	return result
+}
+
+// connection is alive, any data received
+func (manager *ConnectionDataManager) Touch(connData *ConnectionData) {
+	if manager.CheckStorageExists(connData.index) {
+		manager.storage[connData.index-1].touch(connData.id)
+	}
+}
+
+func (manager *ConnectionDataManager) GetLastSeen(cid string) time.Time {
+	var result time.Time
+	if connData, err := ExtractConnectionData(cid); err == nil && manager.CheckStorageExists(connData.index) {
+		cell := manager.storage[connData.index-1]
+		cell.Lock(false)
+		defer cell.Unlock(false)
+		if rec, exists := (*cell).data[connData.id]; exists {
+			result = (*rec).lastSeen
+		}
+	}
+	return result
+}
+
+// unhealthy connection looks like busy
+func (manager *ConnectionDataManager) SetHealthy(cid string, value bool) {
+	if connData, err := ExtractConnectionData(cid); err == nil && manager.CheckStorageExists(connData.index) {
+		cell := manager.storage[connData.index-1]
+		cell.Lock(true)
+		defer cell.Unlock(true)
+		if rec, exists := (*cell).data[connData.id]; exists {
+			(*rec).unhealthy = !value
+		}
+	}
+}
+
+// health data of all connections in group
+func (manager *ConnectionDataManager) GetGroupHealth(group int) []ConnectionHealth {
+	manager.Lock(false)
+	cells := make([]*ConnectionDataStorageCell, 0, len((*manager).storage))
+	for _, cell := range (*manager).storage {
+		if cell != nil {
+			cells = append(cells, cell)
+		}
+	}
+	manager.Unlock(false)
+	var result []ConnectionHealth
+	for _, cell := range cells {
+		cell.Lock(false)
+		for _, rec := range (*cell).data {
+			if (*rec).group == group {
+				result = append(result, ConnectionHealth{
+					Cid:      (*rec).cid,
+					LastSeen: (*rec).lastSeen,
+					Healthy:  !(*rec).unhealthy})
+			}
+		}
+		cell.Unlock(false)
+	}
+	return result
+}
+
+// connections authenticated with key
+func (manager *ConnectionDataManager) GetKeyConnections(keyName string) []string {
+	manager.Lock(false)
+	cells := make([]*ConnectionDataStorageCell, 0, len((*manager).storage))
+	for _, cell := range (*manager).storage {
+		if cell != nil {
+			cells = append(cells, cell)
+		}
+	}
+	manager.Unlock(false)
+	var result []string
+	for _, cell := range cells {
+		cell.Lock(false)
+		for _, rec := range (*cell).data {
+			if (*rec).auth && (*rec).keyName == keyName {
+				result = append(result, (*rec).cid)
+			}
+		}
+		cell.Unlock(false)
+	}
+	return result
+}
+
 // testing only (not use it)
 type TestingData interface {
 	GetTestingData() (int64, int64)
@@ -0,0 +1,129 @@
+package connectionsupport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"roolet/helpers"
+	"time"
+)
+
+const (
+	// command for rebind of parked session to new connection
+	MethodResume    = "resume"
+	resumeTokenSize = 24
+)
+
+type resumeSession struct {
+	token    string
+	parked   bool
+	parkedAt time.Time
+}
+
+// sessions of authenticated connections, closed connection is parked
+// and can be resumed by token before grace period end
+type ResumeDict struct {
+	helpers.AsyncSafeObject
+	// <token>: <cid>
+	tokens map[string]string
+	// <cid>: session
+	sessions map[string]*resumeSession
+}
+
+func NewResumeDict() *ResumeDict {
+	dict := ResumeDict{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		tokens:          make(map[string]string),
+		sessions:        make(map[string]*resumeSession)}
+	return &dict
+}
+
+func newResumeToken() string {
+	buf := make([]byte, resumeTokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return helpers.NewSystemRandom().CreatePassword(resumeTokenSize * 2)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// new token for session of cid, old token isn't valid after it
+func (dict *ResumeDict) Issue(cid string) string {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	token := newResumeToken()
+	if session, exists := (*dict).sessions[cid]; exists {
+		delete((*dict).tokens, session.token)
+	}
+	(*dict).sessions[cid] = &resumeSession{token: token}
+	(*dict).tokens[token] = cid
+	return token
+}
+
+// false if connection has no session, data of it can be removed
+func (dict *ResumeDict) Park(cid string) bool {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	if session, exists := (*dict).sessions[cid]; exists {
+		session.parked = true
+		session.parkedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// connection has session, it can be parked
+func (dict *ResumeDict) Exists(cid string) bool {
+	dict.Lock(false)
+	defer dict.Unlock(false)
+	_, exists := (*dict).sessions[cid]
+	return exists
+}
+
+func (dict *ResumeDict) IsParked(cid string) bool {
+	dict.Lock(false)
+	defer dict.Unlock(false)
+	session, exists := (*dict).sessions[cid]
+	return exists && session.parked
+}
+
+// cid of parked session and new token of it
+func (dict *ResumeDict) Resume(token string, grace time.Duration) (string, string, bool) {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	cid, exists := (*dict).tokens[token]
+	if !exists {
+		return "", "", false
+	}
+	session := (*dict).sessions[cid]
+	if !session.parked || time.Since(session.parkedAt) > grace {
+		return "", "", false
+	}
+	delete((*dict).tokens, token)
+	session.token = newResumeToken()
+	session.parked = false
+	(*dict).tokens[session.token] = cid
+	return cid, session.token, true
+}
+
+func (dict *ResumeDict) Remove(cid string) {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	if session, exists := (*dict).sessions[cid]; exists {
+		delete((*dict).tokens, session.token)
+		delete((*dict).sessions, cid)
+	}
+}
+
+// parked sessions after grace period, removed from dict
+func (dict *ResumeDict) Expired(grace time.Duration) []string {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	var result []string
+	for cid, session := range (*dict).sessions {
+		if session.parked && time.Since(session.parkedAt) > grace {
+			delete((*dict).tokens, session.token)
+			delete((*dict).sessions, cid)
+			result = append(result, cid)
+		}
+	}
+	return result
+}
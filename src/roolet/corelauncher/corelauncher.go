@@ -1,47 +1,68 @@
 package corelauncher
 
 import (
+	"context"
 	"os"
 	"os/signal"
-	"roolet/connectionserver"
-	"roolet/coresupport"
-	"roolet/coremethods"
+	"roolet/broker"
 	"roolet/options"
 	"roolet/rllogger"
-	"roolet/statistic"
 	"syscall"
 )
 
-func Launch(option *options.SysOption) {
+func reload(node *broker.Broker, loader options.OptionLoder) {
+	newOption, err := loader.Load(false)
+	if err == nil {
+		err = node.Reload(*newOption)
+	}
+	if err != nil {
+		rllogger.Outputf(rllogger.LogError, "Reload failed: %s", err)
+	}
+}
+
+func Launch(option *options.SysOption, loader options.OptionLoder) {
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, os.Interrupt)
 	signal.Notify(signalChannel, syscall.SIGTERM)
-	coremethods.Setup()
-	mustExit := false
-	stat := statistic.NewStatistic(*option)
-	manager := coresupport.NewCoreWorkerManager(*option, stat)
-	server := connectionserver.NewServer(*option, stat)
-	server.Start(manager)
-	manager.Start(server)
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+	if level, exists := rllogger.GetLevelByName(option.LogLevel); exists {
+		rllogger.SetLevel(level)
+	} else {
+		rllogger.Outputf(rllogger.LogWarn, "Unknown log level '%s'.", option.LogLevel)
+	}
+	node, err := broker.NewBroker(*option)
+	if err != nil {
+		rllogger.Outputf(rllogger.LogTerminate, "%s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := node.Start(ctx); err != nil {
+		rllogger.Outputf(rllogger.LogTerminate, "%s", err)
+	}
 	// wait
+	mustExit := false
 	for !mustExit {
 		select {
+		case <-reloadChannel:
+			{
+				if !node.IsShuttingDown() {
+					rllogger.Output(rllogger.LogInfo, "Reload options..")
+					reload(node, loader)
+				}
+			}
 		case newSig := <-signalChannel:
 			{
 				if newSig != nil {
-					rllogger.Output(rllogger.LogInfo, "Stoping service, now wait..")
-					server.Stop()
-					manager.Stop()
+					cancel()
 				}
 			}
-		case <-manager.OutSignalChannel:
+		case <-node.Done():
 			{
-				rllogger.Output(rllogger.LogInfo, "Close manager.")
 				mustExit = true
 			}
 		}
 	}
-	manager.Close()
-	stat.Close()
+	signal.Stop(reloadChannel)
 	close(signalChannel)
 }
@@ -1,20 +1,27 @@
 package coremethods
 
 import (
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"roolet/accounting"
+	"roolet/circuitbreaker"
 	"roolet/connectionsupport"
 	"roolet/coreprocessing"
 	"roolet/cryptosupport"
 	"roolet/options"
 	"roolet/rllogger"
 	"roolet/transport"
+	"sort"
 	"strconv"
+	"time"
 )
 
 type AuthData struct {
-	Key   string
+	Key string
+	// token (by default) or hmac (see "authchallenge")
+	Mode  string
 	Token string
 }
 
@@ -30,14 +37,73 @@ func (auth *AuthData) Load(data string) error {
 	}
 }
 
-func (auth *AuthData) Check(option options.SysOption) error {
+// response to nonce of connection by shared secret of key
+func (auth *AuthData) checkChallenge(handler *coreprocessing.Handler, cid string) error {
+	var secret []byte
+	var err error
+	if handler.Keys != nil {
+		secret, err = handler.Keys.GetSecret(auth.Key)
+	} else {
+		secret, err = handler.Option.GetClientSecret(auth.Key)
+	}
+	if err != nil {
+		return &cryptosupport.AuthError{Reason: cryptosupport.ReasonKey, Message: err.Error()}
+	}
+	var nonce string
+	var exists bool
+	if handler.Challenges != nil {
+		nonce, exists = handler.Challenges.Take(cid)
+	}
+	if !exists {
+		return &cryptosupport.AuthError{
+			Reason: cryptosupport.ReasonChallenge, Message: "Challenge not requested or expired."}
+	}
+	return cryptosupport.CheckChallenge(secret, nonce, auth.Token)
+}
+
+// public key or shared secret of key exists and key isn't revoked
+func (auth *AuthData) checkEnrolled(handler *coreprocessing.Handler) error {
+	var err error
+	if handler.Keys != nil {
+		if _, err = handler.Keys.GetKey(auth.Key); err != nil {
+			_, err = handler.Keys.GetSecret(auth.Key)
+		}
+	} else if _, err = handler.Option.GetClientPubKey(auth.Key); err != nil {
+		_, err = handler.Option.GetClientSecret(auth.Key)
+	}
+	return err
+}
+
+// keys from registry if it's used, failure as *cryptosupport.AuthError
+func (auth *AuthData) Check(handler *coreprocessing.Handler, cid string) error {
 	var result error
-	if key, err := option.GetClientPubKey(auth.Key); err == nil {
-		if err := cryptosupport.Check(key, auth.Token); err != nil {
-			result = err
+	var key crypto.PublicKey
+	var err error
+	switch auth.Mode {
+	case "", cryptosupport.AuthModeToken:
+		// signed token, see below
+	case cryptosupport.AuthModeHmac:
+		return auth.checkChallenge(handler, cid)
+	default:
+		return &cryptosupport.AuthError{
+			Reason: cryptosupport.ReasonMalformed, Message: fmt.Sprintf("Auth mode '%s' unknown.", auth.Mode)}
+	}
+	if cryptosupport.TokenAlgorithm(auth.Token) == cryptosupport.AlgorithmHS256 {
+		// secret of node is common, so only enrolled keys without admin rights
+		if handler.Option.IsAdminKey(auth.Key) {
+			err = errors.New(fmt.Sprintf("HMAC token of admin key '%s' not accepted.", auth.Key))
+		} else {
+			err = auth.checkEnrolled(handler)
 		}
+	} else if handler.Keys != nil {
+		key, err = handler.Keys.GetKey(auth.Key)
 	} else {
-		result = err
+		key, err = handler.Option.GetClientPubKey(auth.Key)
+	}
+	if err == nil {
+		result = cryptosupport.CheckToken(key, auth.Token, auth.Key, handler.Option, handler.Replay)
+	} else {
+		result = &cryptosupport.AuthError{Reason: cryptosupport.ReasonKey, Message: err.Error()}
 	}
 	return result
 }
@@ -65,7 +131,8 @@ func ProcPing(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruc
 	if cmd, exists := inIns.GetCommand(); exists {
 		insType = coreprocessing.TypeInstructionPong
 		result = fmt.Sprintf(
-			"{\"data\": %d, \"exists\": true}", len(cmd.Params.Data) + len(cmd.Params.Json))
+			"{\"data\": %d, \"exists\": true, \"node\": \"%s\"}",
+			len(cmd.Params.Data)+len(cmd.Params.Json), handler.Option.Node)
 	} else {
 		insType = coreprocessing.TypeInstructionSkip
 	}
@@ -76,7 +143,7 @@ func ProcPing(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruc
 	return outIns
 }
 
-// check token by client public key
+// check token by client public key or response to challenge
 func ProcAuth(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
 	// client sends in params:
 	//  - json: {"key": "<key name>"}
@@ -90,9 +157,11 @@ func ProcAuth(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruc
 	var errCode int
 	if cmd, exists := inIns.GetCommand(); exists {
 		if authData, err := newAuthData(cmd.Params); err == nil {
-			if err := authData.Check(handler.Option); err != nil {
+			if err := authData.Check(handler, inIns.Cid); err != nil {
 				errCode = transport.ErrorCodeMethodAuthFailed
 				resultErr = err
+			} else {
+				changes.KeyName = authData.Key
 			}
 		} else {
 			resultErr = err
@@ -106,13 +175,27 @@ func ProcAuth(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruc
 	var insType int
 	if errCode > 0 {
 		changes.Auth = false
-		answer = inIns.MakeErrAnswer(errCode, fmt.Sprint(resultErr))
+		if handler.Sessions != nil {
+			handler.Sessions.Remove(inIns.Cid)
+		}
+		if authErr, ok := resultErr.(*cryptosupport.AuthError); ok {
+			answer = inIns.MakeErrAnswerWithData(
+				errCode, fmt.Sprint(resultErr), map[string]string{"reason": authErr.Reason})
+		} else {
+			answer = inIns.MakeErrAnswer(errCode, fmt.Sprint(resultErr))
+		}
 		insType = coreprocessing.TypeInstructionProblem
 		rllogger.Outputf(rllogger.LogWarn, "Failed auth from %s with error: %s", inIns.Cid, resultErr)
 	} else {
 		changes.Auth = true
 		handler.Stat.AddOneMsg("auth_successfull")
-		answer = inIns.MakeOkAnswer("{\"auth\":true}")
+		if handler.Sessions != nil && handler.Option.GetResumeTimeout() > 0 {
+			// token for reconnect with this cid (see "resume")
+			answer = inIns.MakeOkAnswer(
+				fmt.Sprintf("{\"auth\":true,\"resume\":\"%s\"}", handler.Sessions.Issue(inIns.Cid)))
+		} else {
+			answer = inIns.MakeOkAnswer("{\"auth\":true}")
+		}
 		insType = coreprocessing.TypeInstructionOk
 		rllogger.Outputf(rllogger.LogDebug, "Successfull auth from %s", inIns.Cid)
 	}
@@ -122,6 +205,52 @@ func ProcAuth(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruc
 	return result
 }
 
+// nonce for auth in hmac mode, client sends hex of HMAC-SHA256
+// over it with shared secret of key (KeyDir/secret/<key name>)
+func ProcAuthChallenge(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
+	handler.Stat.AddOneMsg("auth_challenge")
+	var answer *transport.Answer
+	insType := coreprocessing.TypeInstructionProblem
+	if handler.Challenges == nil {
+		answer = inIns.MakeErrAnswer(transport.ErrorCodeInternalProblem, "Challenge auth isn't available.")
+	} else if nonce, err := handler.Challenges.Issue(inIns.Cid); err != nil {
+		answer = inIns.MakeErrAnswer(transport.ErrorCodeInternalProblem, fmt.Sprint(err))
+	} else {
+		insType = coreprocessing.TypeInstructionOk
+		answer = inIns.MakeOkAnswer(fmt.Sprintf("{\"nonce\": \"%s\"}", nonce))
+	}
+	result := coreprocessing.NewCoreInstruction(insType)
+	result.SetAnswer(answer)
+	return result
+}
+
+// reason of ACL denial for key of connection, empty if allowed
+func registrationDenied(handler *coreprocessing.Handler, cid string, info ClientInfo) string {
+	groupName, exists := connectionsupport.GetGroupName(info.Group)
+	// connection without auth denied anyway
+	if !exists || !handler.StateCheker.IsAuth(cid) {
+		return ""
+	}
+	keyName := handler.StateCheker.GetKeyName(cid)
+	// peer gets calls of other clients, trusted nodes only
+	if info.Group == connectionsupport.GroupConnectionPeer && !handler.Option.IsPeerKey(keyName) {
+		return fmt.Sprintf("Key '%s' isn't allowed for peer nodes.", keyName)
+	}
+	if handler.Acl == nil {
+		return ""
+	}
+	if !handler.Acl.AllowGroup(keyName, info.Group) {
+		return fmt.Sprintf("Group '%s' not allowed for key '%s'.", groupName, keyName)
+	}
+	switch info.Group {
+	case connectionsupport.GroupConnectionServer, connectionsupport.GroupConnectionPeer:
+		if method, allow := handler.Acl.AllowRegister(keyName, info.Methods); !allow {
+			return fmt.Sprintf("Registration of method '%s' not allowed for key '%s'.", method, keyName)
+		}
+	}
+	return ""
+}
+
 func ProcRegistration(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
 	insType := coreprocessing.TypeInstructionSkip
 	var answer *transport.Answer
@@ -132,8 +261,11 @@ func ProcRegistration(handler *coreprocessing.Handler, inIns *coreprocessing.Cor
 	if cmd, exists := inIns.GetCommand(); exists {
 		info := ClientInfo{}
 		if loadErr := json.Unmarshal([]byte((*cmd).Params.Json), &info); loadErr == nil {
-			if (*handler).StateCheker.IsAuth(inIns.Cid) {
-				// TODO: need implimentation for replace current cid to old
+			if denied := registrationDenied(handler, inIns.Cid, info); len(denied) > 0 {
+				errCode = transport.ErrorCodeAccessDenied
+				errStr = denied
+			} else if (*handler).StateCheker.IsAuth(inIns.Cid) {
+				// old cid is restored by "resume" command with token from auth
 				switch info.Group {
 				case connectionsupport.GroupConnectionClient:
 					{
@@ -146,9 +278,9 @@ func ProcRegistration(handler *coreprocessing.Handler, inIns *coreprocessing.Cor
 					}
 				case connectionsupport.GroupConnectionServer:
 					{
-						dict := coreprocessing.NewMethodInstructionDict()
+						dict := handler.Core.MethodsDict
 						methodsCount := dict.RegisterClientMethods(info.Methods...)
-						rpcManager := coreprocessing.NewRpcServerManager()
+						rpcManager := handler.Core.RpcManager
 						rpcManager.Append(inIns.Cid, &(info.Methods))
 						answer = inIns.MakeOkAnswer(
 							fmt.Sprintf(
@@ -160,6 +292,24 @@ func ProcRegistration(handler *coreprocessing.Handler, inIns *coreprocessing.Cor
 							ConnectionClientGroup: connectionsupport.GroupConnectionServer}
 						resultChanges = &changes
 					}
+				case connectionsupport.GroupConnectionPeer:
+					{
+						// other node announces methods of own servers, repeated on changes
+						dict := handler.Core.MethodsDict
+						methodsCount := dict.RegisterClientMethods(info.Methods...)
+						rpcManager := handler.Core.RpcManager
+						rpcManager.AppendPeer(inIns.Cid, &(info.Methods))
+						answer = inIns.MakeOkAnswer(
+							fmt.Sprintf(
+								"{\"methods_count\": %d, \"ok\": true, \"cid\": \"%s\"}",
+								methodsCount, inIns.Cid))
+						if !(*handler).StateCheker.ClientInGroup(inIns.Cid, connectionsupport.GroupConnectionPeer) {
+							changes := connectionsupport.StateChanges{
+								ChangeType:            connectionsupport.StateChangesTypeGroup,
+								ConnectionClientGroup: connectionsupport.GroupConnectionPeer}
+							resultChanges = &changes
+						}
+					}
 				case connectionsupport.GroupConnectionWsClient:
 					{
 						// denied
@@ -210,6 +360,13 @@ func ProcUpdateStatus(handler *coreprocessing.Handler, inIns *coreprocessing.Cor
 				ChangeType: connectionsupport.StateChangesTypeStatus,
 				Status:     uint16(newStatus)}
 			resultChanges = &changes
+			// drain state is kept until active status
+			switch newStatus {
+			case connectionsupport.ClientStatusDrain:
+				handler.Core.RpcManager.SetDrain(inIns.Cid, true)
+			case connectionsupport.ClientStatusActive:
+				handler.Core.RpcManager.SetDrain(inIns.Cid, false)
+			}
 			answer = inIns.MakeOkAnswer(
 				fmt.Sprintf("{\"ok\": true, \"status\": %d}", newStatus))
 			insType = coreprocessing.TypeInstructionOk
@@ -240,45 +397,92 @@ func (rpcData RpcAnswerData) String() string {
 	return fmt.Sprintf("task: %s to: %s", rpcData.Task, rpcData.Cid)
 }
 
+// servers of this node first, calls from peers never go to other peer
+func preferLocal(rpcManager *coreprocessing.RpcServerManager, variants []string, onlyLocal bool) []string {
+	result := make([]string, 0, len(variants))
+	var peers []string
+	for _, serverCid := range variants {
+		if !rpcManager.IsPeer(serverCid) {
+			result = append(result, serverCid)
+		} else if !onlyLocal {
+			peers = append(peers, serverCid)
+		}
+	}
+	return append(result, peers...)
+}
+
+// quota problem description for error data, nil if calls allowed
+func checkQuota(handler *coreprocessing.Handler, keyName string) map[string]interface{} {
+	if handler.Accounting == nil {
+		return nil
+	}
+	if quota, limit, allow := handler.Accounting.Check(keyName); !allow {
+		return map[string]interface{}{
+			"quota":       quota,
+			"limit":       limit,
+			"reset_after": accounting.ResetAfter().Seconds()}
+	}
+	return nil
+}
+
 // main method for client routing to server methods
 func ProcRouteRpc(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
 	var answer *transport.Answer
 	var errStr string
 	var answerData string
+	var errData interface{}
 	insType := coreprocessing.TypeInstructionSkip
 	errCode := 0
 	// check methods
 	if cmd, exists := inIns.GetCommand(); exists {
-		rpcManager := coreprocessing.NewRpcServerManager()
-		variants := rpcManager.GetCidVariants((*cmd).Method)
-		if len(variants) > 0 {
-			var freeCid string
-			for _, serverCid := range variants {
-				if !handler.StateCheker.ClientBusy(serverCid) {
-					freeCid = serverCid
-					break
+		keyName := handler.StateCheker.GetKeyName((*inIns).Cid)
+		// call forwarded by peer node is checked by ACL of that node for key of caller,
+		// key of peer connection is name of node and hasn't rules
+		fromPeer := handler.StateCheker.ClientInGroup((*inIns).Cid, connectionsupport.GroupConnectionPeer)
+		if handler.Acl != nil && !fromPeer && !handler.Acl.AllowCall(keyName, (*cmd).Method) {
+			errCode = transport.ErrorCodeAccessDenied
+			errStr = fmt.Sprintf("Method '%s' not allowed for key '%s'.", (*cmd).Method, keyName)
+		} else if quotaData := checkQuota(handler, keyName); quotaData != nil {
+			errCode = transport.ErrorCodeQuotaExceeded
+			errStr = fmt.Sprintf("Daily quota of '%s' exceeded.", quotaData["quota"])
+			errData = quotaData
+		} else if _, native := handler.Core.GetNativeMethod((*cmd).Method); native {
+			// executed by broker in post method
+			answerData, errCode, errStr = createTask(handler, inIns, keyName, "")
+		} else {
+			rpcManager := handler.Core.RpcManager
+			variants := rpcManager.GetCidVariants((*cmd).Method)
+			if handler.Option.RoutingStrategy == options.RoutingLeastTasks {
+				// order of map is random already
+				counts := make(map[string]int, len(variants))
+				for _, serverCid := range variants {
+					counts[serverCid] = rpcManager.TaskCount(serverCid)
 				}
+				sort.SliceStable(variants, func(i, j int) bool {
+					return counts[variants[i]] < counts[variants[j]]
+				})
 			}
-			if len(freeCid) > 0 {
-				data := RpcAnswerData{
-					Cid:  freeCid,
-					Task: handler.TaskIdGenerator.CreateTaskId()}
-				// TODO: to debug
-				rllogger.Outputf(rllogger.LogInfo, "rpc call: '%s()' -> %s", (*cmd).Method, data)
-				if strData, err := json.Marshal(data); err == nil {
-					answerData = string(strData)
-					rpcManager.ResultDirectionDict.Set(data.Task, (*inIns).Cid)
+			variants = preferLocal(
+				rpcManager, variants,
+				handler.StateCheker.ClientInGroup(inIns.Cid, connectionsupport.GroupConnectionPeer))
+			if len(variants) > 0 {
+				var freeCid string
+				for _, serverCid := range variants {
+					if !handler.StateCheker.ClientBusy(serverCid) && rpcManager.Breakers.Allow(serverCid) {
+						freeCid = serverCid
+						break
+					}
+				}
+				if len(freeCid) > 0 {
+					answerData, errCode, errStr = createTask(handler, inIns, keyName, freeCid)
 				} else {
-					errCode = transport.ErrorCodeInternalProblem
-					errStr = fmt.Sprintf("Error dump %T: '%s'", data, err)
+					errCode = transport.ErrorCodeAllServerBusy
+					errStr = fmt.Sprintf("All server busy for method '%s'.", (*cmd).Method)
 				}
 			} else {
-				errCode = transport.ErrorCodeAllServerBusy
-				errStr = fmt.Sprintf("All server busy for method '%s'.", (*cmd).Method)
+				errCode = transport.ErrorCodeRemouteMethodNotExists
+				errStr = fmt.Sprintf("Method '%s' unregistred or workers lost.", (*cmd).Method)
 			}
-		} else {
-			errCode = transport.ErrorCodeRemouteMethodNotExists
-			errStr = fmt.Sprintf("Method '%s' unregistred or workers lost.", (*cmd).Method)
 		}
 	} else {
 		errCode = transport.ErrorCodeCommandFormatWrong
@@ -286,7 +490,7 @@ func ProcRouteRpc(handler *coreprocessing.Handler, inIns *coreprocessing.CoreIns
 	}
 	if errCode > 0 {
 		insType = coreprocessing.TypeInstructionProblem
-		answer = inIns.MakeErrAnswer(errCode, errStr)
+		answer = inIns.MakeErrAnswerWithData(errCode, errStr, errData)
 	} else {
 		insType = coreprocessing.TypeInstructionOk
 		answer = inIns.MakeOkAnswer(answerData)
@@ -296,6 +500,38 @@ func ProcRouteRpc(handler *coreprocessing.Handler, inIns *coreprocessing.CoreIns
 	return result
 }
 
+// new task of client call, server cid is empty for native method
+func createTask(
+	handler *coreprocessing.Handler,
+	inIns *coreprocessing.CoreInstruction,
+	keyName, serverCid string) (string, int, string) {
+	//
+	cmd, _ := inIns.GetCommand()
+	rpcManager := handler.Core.RpcManager
+	data := RpcAnswerData{
+		Cid:  serverCid,
+		Task: handler.TaskIdGenerator.CreateTaskId()}
+	// TODO: to debug
+	rllogger.Outputf(rllogger.LogInfo, "rpc call: '%s()' -> %s", (*cmd).Method, data)
+	strData, err := json.Marshal(data)
+	if err != nil {
+		return "", transport.ErrorCodeInternalProblem, fmt.Sprintf("Error dump %T: '%s'", data, err)
+	}
+	rpcManager.ResultDirectionDict.Set(data.Task, (*inIns).Cid)
+	// client can take result from other connection with same key
+	if len(keyName) > 0 {
+		rpcManager.ResultOwnerDict.Set(data.Task, keyName)
+	}
+	if len(serverCid) > 0 {
+		rpcManager.StartTask(data.Task, serverCid)
+	}
+	if handler.Accounting != nil {
+		handler.Accounting.AddCall(
+			keyName, len((*cmd).Params.Data)+len((*cmd).Params.Json))
+	}
+	return string(strData), 0, ""
+}
+
 func ProcCallServerMethod(
 	handler *coreprocessing.Handler,
 	inIns *coreprocessing.CoreInstruction,
@@ -309,14 +545,24 @@ func ProcCallServerMethod(
 				rpcData := RpcAnswerData{}
 				// little overhead - parse JSON
 				if loadErr := json.Unmarshal([]byte((*answer).Result), &rpcData); loadErr == nil {
+					// route record goes before result, delete of delivered result must be last
+					record := coreprocessing.ReplicaRecord{
+						Op:    coreprocessing.ReplicaOpRoute,
+						Task:  rpcData.Task,
+						Owner: handler.StateCheker.GetKeyName(inIns.Cid)}
+					result = handler.Core.RpcManager.ReplicaInstructions(record, "")
 					srcParams := (*srcCmd).Params
 					srcParams.Task = rpcData.Task
-					// replace cid
-					srcParams.Cid = rpcData.Cid
-					newCmd := transport.NewCommandWithParams(0, (*srcCmd).Method, srcParams)
-					resultIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionExecute)
-					resultIns.SetCommand(newCmd)
-					result = []*coreprocessing.CoreInstruction{resultIns}
+					if method, native := handler.Core.GetNativeMethod((*srcCmd).Method); native {
+						result = append(result, callNativeMethod(handler, method, srcParams)...)
+					} else {
+						// replace cid
+						srcParams.Cid = rpcData.Cid
+						newCmd := transport.NewCommandWithParams(0, (*srcCmd).Method, srcParams)
+						resultIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionExecute)
+						resultIns.SetCommand(newCmd)
+						result = append(result, resultIns)
+					}
 				} else {
 					rllogger.Outputf(
 						rllogger.LogError,
@@ -333,6 +579,17 @@ func ProcCallServerMethod(
 	return result
 }
 
+// worker result as {"error": ...} is failure of server
+func resultHasError(data string) bool {
+	result := struct {
+		Error *json.RawMessage `json:"error"`
+	}{}
+	if err := json.Unmarshal([]byte(data), &result); err == nil {
+		return result.Error != nil && string(*result.Error) != "null"
+	}
+	return false
+}
+
 func ProcResultReturned(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
 	var answer *transport.Answer
 	var resultChanges *connectionsupport.StateChanges
@@ -349,6 +606,27 @@ func ProcResultReturned(handler *coreprocessing.Handler, inIns *coreprocessing.C
 		if len((*cmd).Params.Task) < 1 {
 			errCode = transport.ErrorCodeMethodParamsFormatWrong
 			errStr = "Task Id does not exist."
+		} else {
+			rpcManager := handler.Core.RpcManager
+			serverCid := inIns.Cid
+			if duration, exists, err := rpcManager.FinishTask((*cmd).Params.Task, serverCid); err != nil {
+				errCode = transport.ErrorCodeAccessDenied
+				errStr = fmt.Sprint(err)
+			} else if exists {
+				ownerPtr := rpcManager.ResultOwnerDict.Get((*cmd).Params.Task)
+				if ownerPtr != nil && handler.Accounting != nil {
+					handler.Accounting.AddResult(*ownerPtr, len((*cmd).Params.Json), duration)
+				}
+				if resultHasError((*cmd).Params.Json) {
+					handler.Stat.AddOneMsg("breaker_error_result")
+					if rpcManager.Breakers.Failure(serverCid) {
+						handler.Stat.AddOneMsg("breaker_open")
+						rllogger.Outputf(rllogger.LogWarn, "Circuit breaker opened for %s", serverCid)
+					}
+				} else {
+					rpcManager.Breakers.Success(serverCid)
+				}
+			}
 		}
 	} else {
 		errCode = transport.ErrorCodeCommandFormatWrong
@@ -376,36 +654,437 @@ func ProcRecordResult(
 	var result []*coreprocessing.CoreInstruction
 	if answer, _ := outIns.GetAnswer(); (*answer).Error.Code == 0 {
 		if srcCmd, hasCmd := inIns.GetCommand(); hasCmd {
-			rpcManager := coreprocessing.NewRpcServerManager()
-			taskId := (*srcCmd).Params.Task
-			if targetCidPtr := rpcManager.ResultDirectionDict.Get(taskId); targetCidPtr != nil {
-				// check client group
-				if handler.StateCheker.ClientInGroup(*targetCidPtr, connectionsupport.GroupConnectionWsClient) {
-					cmd := transport.NewCommandWithParams(
-						0, "result", transport.MethodParams{
-							Cid:  *targetCidPtr,
-							Task: taskId,
-							Json: (*srcCmd).Params.Json})
-					clientIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionSetResult)
-					clientIns.SetCommand(cmd)
-					result = make([]*coreprocessing.CoreInstruction, 1)
-					result[0] = clientIns
-				} else {
-					rpcManager.ResultBufferDict.Set(taskId, (*srcCmd).Params.Json)
-				}
+			result = deliverResult(handler, (*srcCmd).Params.Task, (*srcCmd).Params.Json)
+			result = append(result, drainEvents(handler, inIns.Cid)...)
+		}
+	}
+	return result
+}
+
+// result to client or to buffer for "getresult"
+func deliverResult(handler *coreprocessing.Handler, taskId, data string) []*coreprocessing.CoreInstruction {
+	var result []*coreprocessing.CoreInstruction
+	rpcManager := handler.Core.RpcManager
+	if targetCidPtr := rpcManager.ResultDirectionDict.Get(taskId); targetCidPtr != nil {
+		// check client group, web-socket clients and peer nodes don't wait "getresult"
+		if handler.StateCheker.ClientInGroup(*targetCidPtr, connectionsupport.GroupConnectionWsClient) ||
+			handler.StateCheker.ClientInGroup(*targetCidPtr, connectionsupport.GroupConnectionPeer) {
+			cmd := transport.NewCommandWithParams(
+				0, "result", transport.MethodParams{
+					Cid:  *targetCidPtr,
+					Task: taskId,
+					Json: data})
+			clientIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionSetResult)
+			clientIns.SetCommand(cmd)
+			result = append(result, clientIns)
+			// nobody asks "getresult" for this task
+			rpcManager.DeleteResult(taskId)
+			result = append(result, rpcManager.ReplicaInstructions(
+				coreprocessing.ReplicaRecord{Op: coreprocessing.ReplicaOpDelete, Task: taskId}, "")...)
+		} else {
+			result = append(result, bufferResult(rpcManager, taskId, data)...)
+		}
+	} else if rpcManager.ResultOwnerDict.Exists(taskId) {
+		// task routed by other node before failover
+		result = append(result, bufferResult(rpcManager, taskId, data)...)
+	} else {
+		rllogger.Outputf(rllogger.LogError, "Processing pass for task: %s", taskId)
+	}
+	return result
+}
+
+// panic of native method is error of task, worker of broker continues
+func safeNativeCall(
+	handler *coreprocessing.Handler,
+	method coreprocessing.NativeMethod,
+	params transport.MethodParams) (value interface{}, err error) {
+	//
+	defer func() {
+		if problem := recover(); problem != nil {
+			rllogger.Outputf(rllogger.LogError, "Native method of task %s panic: %v", params.Task, problem)
+			value = nil
+			err = errors.New(fmt.Sprintf("Native method problem: %v", problem))
+		}
+	}()
+	return method(handler, params)
+}
+
+// native method result in format of server result
+func callNativeMethod(
+	handler *coreprocessing.Handler,
+	method coreprocessing.NativeMethod,
+	params transport.MethodParams) []*coreprocessing.CoreInstruction {
+	//
+	start := time.Now()
+	data := make(map[string]interface{})
+	if value, err := safeNativeCall(handler, method, params); err == nil {
+		data["result"] = value
+	} else {
+		data["error"] = map[string]interface{}{
+			"code":    transport.ErrorCodeInternalProblem,
+			"message": err.Error()}
+	}
+	strData, err := json.Marshal(data)
+	if err != nil {
+		strData, _ = json.Marshal(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    transport.ErrorCodeInternalProblem,
+				"message": fmt.Sprintf("Error dump %T: '%s'", data["result"], err)}})
+	}
+	handler.Stat.AddOneMsg("native_call")
+	rpcManager := handler.Core.RpcManager
+	if ownerPtr := rpcManager.ResultOwnerDict.Get(params.Task); ownerPtr != nil && handler.Accounting != nil {
+		handler.Accounting.AddResult(*ownerPtr, len(strData), time.Since(start))
+	}
+	return deliverResult(handler, params.Task, string(strData))
+}
+
+// result waits "getresult", standby nodes get copy
+func bufferResult(rpcManager *coreprocessing.RpcServerManager, taskId, data string) []*coreprocessing.CoreInstruction {
+	rpcManager.ResultBufferDict.Set(taskId, data)
+	return rpcManager.ReplicaInstructions(
+		coreprocessing.ReplicaRecord{Op: coreprocessing.ReplicaOpResult, Task: taskId, Data: data}, "")
+}
+
+// drained event to server when last task finished
+func drainEvents(handler *coreprocessing.Handler, cid string) []*coreprocessing.CoreInstruction {
+	var result []*coreprocessing.CoreInstruction
+	if handler.Core.RpcManager.CompleteDrain(cid) {
+		handler.Stat.AddOneMsg("server_drained")
+		rllogger.Outputf(rllogger.LogInfo, "Server %s drained.", cid)
+		result = []*coreprocessing.CoreInstruction{coreprocessing.NewDrainedCoreInstruction(cid)}
+	}
+	return result
+}
+
+func ProcStatusDrainEvent(
+	handler *coreprocessing.Handler,
+	inIns *coreprocessing.CoreInstruction,
+	outIns *coreprocessing.CoreInstruction) []*coreprocessing.CoreInstruction {
+	//
+	return drainEvents(handler, inIns.Cid)
+}
+
+// client takes the buffered result of own task
+func ProcGetResult(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
+	var answer *transport.Answer
+	var errStr string
+	var answerData string
+	insType := coreprocessing.TypeInstructionSkip
+	errCode := 0
+	if cmd, exists := inIns.GetCommand(); exists {
+		taskId := (*cmd).Params.Task
+		rpcManager := handler.Core.RpcManager
+		if isResultOwner(handler, inIns.Cid, taskId) {
+			if data := rpcManager.ResultBufferDict.Get(taskId); data != nil {
+				answerData = *data
+				rpcManager.DeleteResult(taskId)
 			} else {
-				rllogger.Outputf(rllogger.LogError, "Processing pass for: %s", srcCmd)
+				errCode = transport.ErrorCodeResultNotReady
+				errStr = fmt.Sprintf("Result of task '%s' is not ready.", taskId)
 			}
+		} else {
+			errCode = transport.ErrorCodeUnexpectedValue
+			errStr = fmt.Sprintf("Unknown task '%s'.", taskId)
 		}
+	} else {
+		errCode = transport.ErrorCodeCommandFormatWrong
+		errStr = "Command is empty."
+	}
+	if errCode > 0 {
+		insType = coreprocessing.TypeInstructionProblem
+		answer = inIns.MakeErrAnswer(errCode, errStr)
+	} else {
+		insType = coreprocessing.TypeInstructionOk
+		answer = inIns.MakeOkAnswer(answerData)
 	}
+	result := coreprocessing.NewCoreInstruction(insType)
+	result.SetAnswer(answer)
+	return result
+}
+
+// task created by this connection or by connection with same key
+func isResultOwner(handler *coreprocessing.Handler, cid, taskId string) bool {
+	rpcManager := handler.Core.RpcManager
+	if targetCidPtr := rpcManager.ResultDirectionDict.Get(taskId); targetCidPtr != nil && *targetCidPtr == cid {
+		return true
+	}
+	if ownerPtr := rpcManager.ResultOwnerDict.Get(taskId); ownerPtr != nil && len(*ownerPtr) > 0 {
+		return *ownerPtr == handler.StateCheker.GetKeyName(cid)
+	}
+	return false
+}
+
+func ProcResultTakenEvent(
+	handler *coreprocessing.Handler,
+	inIns *coreprocessing.CoreInstruction,
+	outIns *coreprocessing.CoreInstruction) []*coreprocessing.CoreInstruction {
+	//
+	var result []*coreprocessing.CoreInstruction
+	if outIns.Type == coreprocessing.TypeInstructionOk {
+		if cmd, exists := inIns.GetCommand(); exists {
+			result = handler.Core.RpcManager.ReplicaInstructions(
+				coreprocessing.ReplicaRecord{Op: coreprocessing.ReplicaOpDelete, Task: (*cmd).Params.Task}, "")
+		}
+	}
+	return result
+}
+
+func isAdmin(handler *coreprocessing.Handler, cid string) bool {
+	checker := (*handler).StateCheker
+	return checker.IsAuth(cid) && handler.Option.IsAdminKey(checker.GetKeyName(cid))
+}
+
+type ServerInfo struct {
+	Cid      string                     `json:"cid"`
+	Methods  []string                   `json:"methods"`
+	Tasks    int                        `json:"tasks"`
+	Breaker  circuitbreaker.BreakerInfo `json:"breaker"`
+	Busy     bool                       `json:"busy"`
+	Drain    bool                       `json:"drain"`
+	LastSeen int64                      `json:"last_seen"`
+}
+
+// admin method, state of registered servers
+func ProcServerInfo(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
+	var answer *transport.Answer
+	var errStr string
+	var answerData string
+	insType := coreprocessing.TypeInstructionSkip
+	errCode := 0
+	if _, exists := inIns.GetCommand(); exists {
+		if isAdmin(handler, inIns.Cid) {
+			rpcManager := handler.Core.RpcManager
+			servers := rpcManager.GetServers()
+			info := make([]ServerInfo, 0, len(servers))
+			for cid, methods := range servers {
+				sort.Strings(methods)
+				info = append(info, ServerInfo{
+					Cid:      cid,
+					Methods:  methods,
+					Tasks:    rpcManager.TaskCount(cid),
+					Breaker:  rpcManager.Breakers.GetInfo(cid),
+					Busy:     handler.StateCheker.ClientBusy(cid),
+					Drain:    rpcManager.IsDrain(cid),
+					LastSeen: handler.StateCheker.GetLastSeen(cid).Unix()})
+			}
+			if strData, err := json.Marshal(info); err == nil {
+				answerData = string(strData)
+			} else {
+				errCode = transport.ErrorCodeInternalProblem
+				errStr = fmt.Sprintf("Error dump %T: '%s'", info, err)
+			}
+		} else {
+			errCode = transport.ErrorCodeAccessDenied
+			errStr = "Access denied."
+		}
+	} else {
+		errCode = transport.ErrorCodeCommandFormatWrong
+		errStr = "Command is empty."
+	}
+	if errCode > 0 {
+		insType = coreprocessing.TypeInstructionProblem
+		answer = inIns.MakeErrAnswer(errCode, errStr)
+	} else {
+		insType = coreprocessing.TypeInstructionOk
+		answer = inIns.MakeOkAnswer(answerData)
+	}
+	result := coreprocessing.NewCoreInstruction(insType)
+	result.SetAnswer(answer)
+	return result
+}
+
+type DrainData struct {
+	Cid   string `json:"cid"`
+	Drain bool   `json:"drain"`
+}
+
+// admin method, force drain state of server
+func ProcServerDrain(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
+	var answer *transport.Answer
+	var errStr string
+	insType := coreprocessing.TypeInstructionSkip
+	errCode := 0
+	if cmd, exists := inIns.GetCommand(); exists {
+		data := DrainData{}
+		if loadErr := json.Unmarshal([]byte((*cmd).Params.Json), &data); loadErr == nil {
+			if !isAdmin(handler, inIns.Cid) {
+				errCode = transport.ErrorCodeAccessDenied
+				errStr = "Access denied."
+			} else if !handler.StateCheker.ClientInGroup(data.Cid, connectionsupport.GroupConnectionServer) {
+				errCode = transport.ErrorCodeUnexpectedValue
+				errStr = fmt.Sprintf("Server '%s' not found.", data.Cid)
+			} else {
+				handler.Core.RpcManager.SetDrain(data.Cid, data.Drain)
+				rllogger.Outputf(
+					rllogger.LogInfo, "Drain state of %s changed to %t by %s", data.Cid, data.Drain, inIns.Cid)
+				answer = inIns.MakeOkAnswer(
+					fmt.Sprintf("{\"ok\": true, \"cid\": \"%s\", \"drain\": %t}", data.Cid, data.Drain))
+			}
+		} else {
+			errCode = transport.ErrorCodeMethodParamsFormatWrong
+			errStr = fmt.Sprint(loadErr)
+		}
+	} else {
+		errCode = transport.ErrorCodeCommandFormatWrong
+		errStr = "Command is empty."
+	}
+	if errCode > 0 {
+		insType = coreprocessing.TypeInstructionProblem
+		answer = inIns.MakeErrAnswer(errCode, errStr)
+	} else {
+		insType = coreprocessing.TypeInstructionOk
+	}
+	result := coreprocessing.NewCoreInstruction(insType)
+	result.SetAnswer(answer)
+	return result
+}
+
+func ProcServerDrainEvent(
+	handler *coreprocessing.Handler,
+	inIns *coreprocessing.CoreInstruction,
+	outIns *coreprocessing.CoreInstruction) []*coreprocessing.CoreInstruction {
+	//
+	var result []*coreprocessing.CoreInstruction
+	if outIns.Type == coreprocessing.TypeInstructionOk {
+		if cmd, exists := inIns.GetCommand(); exists {
+			data := DrainData{}
+			if json.Unmarshal([]byte((*cmd).Params.Json), &data) == nil {
+				result = drainEvents(handler, data.Cid)
+			}
+		}
+	}
+	return result
+}
+
+// admin method, connection of standby node gets records of results
+func ProcReplicate(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
+	var answer *transport.Answer
+	var resultChanges *connectionsupport.StateChanges
+	var errStr string
+	insType := coreprocessing.TypeInstructionSkip
+	errCode := 0
+	if _, exists := inIns.GetCommand(); exists {
+		if isAdmin(handler, inIns.Cid) {
+			handler.Core.RpcManager.AppendReplica(inIns.Cid)
+			resultChanges = &(connectionsupport.StateChanges{
+				ChangeType:            connectionsupport.StateChangesTypeGroup,
+				ConnectionClientGroup: connectionsupport.GroupConnectionReplica})
+			rllogger.Outputf(rllogger.LogInfo, "Standby node connected: %s", inIns.Cid)
+		} else {
+			errCode = transport.ErrorCodeAccessDenied
+			errStr = "Access denied."
+		}
+	} else {
+		errCode = transport.ErrorCodeCommandFormatWrong
+		errStr = "Command is empty."
+	}
+	if errCode > 0 {
+		insType = coreprocessing.TypeInstructionProblem
+		answer = inIns.MakeErrAnswer(errCode, errStr)
+	} else {
+		insType = coreprocessing.TypeInstructionOk
+		answer = inIns.MakeOkAnswer("{\"ok\": true}")
+	}
+	result := coreprocessing.NewCoreInstruction(insType)
+	result.SetAnswer(answer)
+	result.StateChanges = resultChanges
+	return result
+}
+
+func ProcReplicaSnapshot(
+	handler *coreprocessing.Handler,
+	inIns *coreprocessing.CoreInstruction,
+	outIns *coreprocessing.CoreInstruction) []*coreprocessing.CoreInstruction {
+	//
+	var result []*coreprocessing.CoreInstruction
+	if outIns.Type == coreprocessing.TypeInstructionOk {
+		rpcManager := handler.Core.RpcManager
+		for _, record := range rpcManager.ReplicaSnapshot() {
+			result = append(result, rpcManager.ReplicaInstructions(record, inIns.Cid)...)
+		}
+	}
+	return result
+}
+
+type UsageRequest struct {
+	Day string `json:"day"`
+	Key string `json:"key"`
+}
+
+type UsageData struct {
+	Day   string                      `json:"day"`
+	Usage map[string]accounting.Usage `json:"usage"`
+}
+
+// admin method, daily consumption of keys
+func ProcUsage(handler *coreprocessing.Handler, inIns *coreprocessing.CoreInstruction) *coreprocessing.CoreInstruction {
+	var answer *transport.Answer
+	var errStr string
+	var answerData string
+	insType := coreprocessing.TypeInstructionSkip
+	errCode := 0
+	if cmd, exists := inIns.GetCommand(); exists {
+		request := UsageRequest{}
+		var loadErr error
+		if len((*cmd).Params.Json) > 0 {
+			loadErr = json.Unmarshal([]byte((*cmd).Params.Json), &request)
+		}
+		if loadErr != nil {
+			errCode = transport.ErrorCodeMethodParamsFormatWrong
+			errStr = fmt.Sprint(loadErr)
+		} else if !isAdmin(handler, inIns.Cid) {
+			errCode = transport.ErrorCodeAccessDenied
+			errStr = "Access denied."
+		} else if handler.Accounting == nil {
+			errCode = transport.ErrorCodeInternalProblem
+			errStr = "Accounting is not available."
+		} else if usage, err := handler.Accounting.GetUsage(request.Day); err == nil {
+			if len(request.Key) > 0 {
+				keyUsage := usage[request.Key]
+				usage = map[string]accounting.Usage{request.Key: keyUsage}
+			}
+			data := UsageData{Day: request.Day, Usage: usage}
+			if len(data.Day) == 0 {
+				data.Day = accounting.Today()
+			}
+			if strData, err := json.Marshal(data); err == nil {
+				answerData = string(strData)
+			} else {
+				errCode = transport.ErrorCodeInternalProblem
+				errStr = fmt.Sprintf("Error dump %T: '%s'", data, err)
+			}
+		} else {
+			errCode = transport.ErrorCodeUnexpectedValue
+			errStr = fmt.Sprint(err)
+		}
+	} else {
+		errCode = transport.ErrorCodeCommandFormatWrong
+		errStr = "Command is empty."
+	}
+	if errCode > 0 {
+		insType = coreprocessing.TypeInstructionProblem
+		answer = inIns.MakeErrAnswer(errCode, errStr)
+	} else {
+		insType = coreprocessing.TypeInstructionOk
+		answer = inIns.MakeOkAnswer(answerData)
+	}
+	result := coreprocessing.NewCoreInstruction(insType)
+	result.SetAnswer(answer)
 	return result
 }
 
-func Setup() {
-	coreprocessing.SetupMethod(coreprocessing.TypeInstructionPing, ProcPing, nil)
-	coreprocessing.SetupMethod(coreprocessing.TypeInstructionAuth, ProcAuth, nil)
-	coreprocessing.SetupMethod(coreprocessing.TypeInstructionReg, ProcRegistration, nil)
-	coreprocessing.SetupMethod(coreprocessing.TypeInstructionStatus, ProcUpdateStatus, nil)
-	coreprocessing.SetupMethod(coreprocessing.TypeInstructionExternal, ProcRouteRpc, ProcCallServerMethod)
-	coreprocessing.SetupMethod(coreprocessing.TypeInstructionSetResult, ProcResultReturned, ProcRecordResult)
+func Setup(core *coreprocessing.Core) {
+	core.SetupMethod(coreprocessing.TypeInstructionPing, ProcPing, nil)
+	core.SetupMethod(coreprocessing.TypeInstructionAuth, ProcAuth, nil)
+	core.SetupMethod(coreprocessing.TypeInstructionChallenge, ProcAuthChallenge, nil)
+	core.SetupMethod(coreprocessing.TypeInstructionReg, ProcRegistration, nil)
+	core.SetupMethod(coreprocessing.TypeInstructionStatus, ProcUpdateStatus, ProcStatusDrainEvent)
+	core.SetupMethod(coreprocessing.TypeInstructionExternal, ProcRouteRpc, ProcCallServerMethod)
+	core.SetupMethod(coreprocessing.TypeInstructionSetResult, ProcResultReturned, ProcRecordResult)
+	core.SetupMethod(coreprocessing.TypeInstructionGetResult, ProcGetResult, ProcResultTakenEvent)
+	core.SetupMethod(coreprocessing.TypeInstructionServerInfo, ProcServerInfo, nil)
+	core.SetupMethod(coreprocessing.TypeInstructionServerDrain, ProcServerDrain, ProcServerDrainEvent)
+	core.SetupMethod(coreprocessing.TypeInstructionReplicate, ProcReplicate, ProcReplicaSnapshot)
+	core.SetupMethod(coreprocessing.TypeInstructionUsage, ProcUsage, nil)
 }
@@ -1,14 +1,24 @@
 package coremethods_test
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"roolet/acl"
 	"roolet/connectionsupport"
 	"roolet/coremethods"
 	"roolet/coreprocessing"
+	"roolet/cryptosupport"
+	"roolet/helpers"
 	"roolet/options"
 	"roolet/statistic"
+	"roolet/testsupport"
 	"roolet/transport"
+	"strings"
 	"testing"
+	"time"
 )
 
 // ProcUpdateStatus =>
@@ -17,7 +27,7 @@ func TestUpdateStatusEmptyParams(t *testing.T) {
 	option := options.SysOption{
 		Statistic: false}
 	stat := statistic.NewStatistic(option)
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
 	cmd := transport.NewCommand(0, "27d90e5e-0000000000000011-1", "statusupdate", "")
 	inIns.SetCommand(cmd)
@@ -35,7 +45,7 @@ func TestUpdateStatusValueLimits(t *testing.T) {
 	option := options.SysOption{
 		Statistic: false}
 	stat := statistic.NewStatistic(option)
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
 	cmd := transport.NewCommand(0, "27d90e5e-0000000000000011-1", "statusupdate", "65537")
 	inIns.SetCommand(cmd)
@@ -56,7 +66,7 @@ func TestUpdateStatusChanged(t *testing.T) {
 		Statistic: false}
 	var newStatus uint16 = 1
 	stat := statistic.NewStatistic(option)
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
 	cmd := transport.NewCommand(0, "27d90e5e-0000000000000011-1", "statusupdate", fmt.Sprint(newStatus))
 	inIns.SetCommand(cmd)
@@ -87,7 +97,7 @@ func TestRegistrationEmptyParams(t *testing.T) {
 	option := options.SysOption{
 		Statistic: false}
 	stat := statistic.NewStatistic(option)
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
 	cmd := transport.NewCommand(0, "27d90e5e-0000000000000011-1", "registration", "")
 	// expected methods as list of string
@@ -111,11 +121,14 @@ func TestRegistrationEmptyParams(t *testing.T) {
 
 // implimented interface ConnectionStateChecker for tests usage
 type forTestConnectionStateCheck struct {
-	Auth bool
+	Auth    bool
+	KeyName string
+	// connection in any group if empty
+	Group int
 }
 
 func (checker *forTestConnectionStateCheck) ClientInGroup(cid string, group int) bool {
-	return true
+	return (*checker).Group == 0 || (*checker).Group == group
 }
 
 func (checker *forTestConnectionStateCheck) ClientBusy(cid string) bool {
@@ -130,11 +143,19 @@ func (checker *forTestConnectionStateCheck) IsAuth(cid string) bool {
 	return (*checker).Auth
 }
 
+func (checker *forTestConnectionStateCheck) GetKeyName(cid string) string {
+	return (*checker).KeyName
+}
+
+func (checker *forTestConnectionStateCheck) GetLastSeen(cid string) time.Time {
+	return time.Now()
+}
+
 func TestRegistrationAuthFiled(t *testing.T) {
 	option := options.SysOption{
 		Statistic: false}
 	stat := statistic.NewStatistic(option)
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	cheker := forTestConnectionStateCheck{}
 	handler.StateCheker = &cheker
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
@@ -161,12 +182,12 @@ func TestRegistrationUnknownGroup(t *testing.T) {
 	option := options.SysOption{
 		Statistic: false}
 	stat := statistic.NewStatistic(option)
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	cheker := forTestConnectionStateCheck{Auth: true}
 	handler.StateCheker = &cheker
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
 	cmd := transport.NewCommand(0, "27d90e5e-0000000000000011-1", "registration", "")
-	(*cmd).Params.Json = "{\"methods\": [\"none\"], \"group\": 4}"
+	(*cmd).Params.Json = "{\"methods\": [\"none\"], \"group\": 99}"
 	inIns.SetCommand(cmd)
 	outIns := coremethods.ProcRegistration(handler, inIns)
 	if answer, exists := outIns.GetAnswer(); exists {
@@ -184,12 +205,38 @@ func TestRegistrationUnknownGroup(t *testing.T) {
 	}
 }
 
+func TestRegistrationPeerKey(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false,
+		Node:      "node1",
+		AdminKeys: []string{"admin"},
+		PeerKeys:  []string{"node2"}}
+	stat := statistic.NewStatistic(option)
+	cases := map[string]int{"client1": transport.ErrorCodeAccessDenied, "node2": 0, "admin": 0, "node1": 0}
+	for keyName, code := range cases {
+		handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+		handler.StateCheker = &forTestConnectionStateCheck{Auth: true, KeyName: keyName}
+		inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
+		cmd := transport.NewCommand(0, "27d90e5e-0000000000000011-1", "registration", "")
+		(*cmd).Params.Json = fmt.Sprintf(
+			"{\"methods\": [\"test_peer\"], \"group\": %d}", connectionsupport.GroupConnectionPeer)
+		inIns.SetCommand(cmd)
+		outIns := coremethods.ProcRegistration(handler, inIns)
+		if answer, _ := outIns.GetAnswer(); (*answer).Error.Code != code {
+			t.Errorf("Peer registration with key '%s': %s", keyName, (*answer).Error)
+		}
+		if registered := len(handler.Core.RpcManager.GetCidVariants("test_peer")) > 0; registered != (code == 0) {
+			t.Errorf("Methods of peer with key '%s' registered: %t", keyName, registered)
+		}
+	}
+}
+
 func TestRegistratioAddGroupClient(t *testing.T) {
 	option := options.SysOption{
 		Statistic: false}
 	stat := statistic.NewStatistic(option)
 	cid := "27d90e5e-0000000000000012-1"
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	cheker := forTestConnectionStateCheck{Auth: true}
 	handler.StateCheker = &cheker
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
@@ -236,7 +283,7 @@ func TestRegistratioAddGroupServer(t *testing.T) {
 	stat := statistic.NewStatistic(option)
 	methodName := "test_test"
 	cid := "27d90e5e-0000000000000011-1"
-	handler := coreprocessing.NewHandler(1, option, stat)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
 	cheker := forTestConnectionStateCheck{Auth: true}
 	handler.StateCheker = &cheker
 	inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionReg)
@@ -254,7 +301,7 @@ func TestRegistratioAddGroupServer(t *testing.T) {
 			if stCh != nil {
 				if (*stCh).ChangeType == connectionsupport.StateChangesTypeGroup {
 					if (*stCh).ConnectionClientGroup == connectionsupport.GroupConnectionServer {
-						cidMethods := coreprocessing.NewRpcServerManager()
+						cidMethods := handler.Core.RpcManager
 						cidList := cidMethods.GetCidVariants(methodName)
 						if len(cidList) > 0 {
 							exists := false
@@ -294,3 +341,339 @@ func TestRegistratioAddGroupServer(t *testing.T) {
 		t.Errorf("Empty answer to %s.", *cmd)
 	}
 }
+
+// ProcGetResult=>
+//
+func TestGetResultFromBuffer(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false}
+	stat := statistic.NewStatistic(option)
+	cid := "27d90e5e-0000000000000013-1"
+	taskId := "a1b2c3d4-0000000000000001"
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	rpcManager := handler.Core.RpcManager
+	rpcManager.ResultDirectionDict.Set(taskId, cid)
+	getResult := func() *transport.Answer {
+		inIns := coreprocessing.NewCoreInstructionForMessage(
+			coreprocessing.TypeInstructionGetResult,
+			cid,
+			transport.NewCommandWithParams(0, "getresult", transport.MethodParams{Task: taskId}))
+		answer, _ := coremethods.ProcGetResult(handler, inIns).GetAnswer()
+		return answer
+	}
+	if answer := getResult(); (*answer).Error.Code != transport.ErrorCodeResultNotReady {
+		t.Errorf("Unexpected answer for not ready result: %s", (*answer).Error)
+	}
+	rpcManager.ResultBufferDict.Set(taskId, "{\"result\": 3}")
+	if answer := getResult(); (*answer).Error.Code > 0 || (*answer).Result != "{\"result\": 3}" {
+		t.Errorf("Incorrect answer: %s %s", (*answer).Result, (*answer).Error)
+	}
+	if rpcManager.ResultBufferDict.Exists(taskId) || rpcManager.ResultDirectionDict.Exists(taskId) {
+		t.Error("Result must be removed after getting.")
+	}
+	if answer := getResult(); (*answer).Error.Code != transport.ErrorCodeUnexpectedValue {
+		t.Errorf("Unexpected answer for unknown task: %s", (*answer).Error)
+	}
+}
+
+func TestResultOfOtherServer(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false}
+	stat := statistic.NewStatistic(option)
+	cid := "27d90e5e-0000000000000020-1"
+	serverCid := "27d90e5e-0000000000000021-1"
+	otherCid := "27d90e5e-0000000000000022-1"
+	taskId := "a1b2c3d4-0000000000000003"
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	handler.StateCheker = &forTestConnectionStateCheck{Auth: true, Group: connectionsupport.GroupConnectionClient}
+	rpcManager := handler.Core.RpcManager
+	rpcManager.ResultDirectionDict.Set(taskId, cid)
+	rpcManager.StartTask(taskId, serverCid)
+	returnResult := func(fromCid string) int {
+		inIns := coreprocessing.NewCoreInstructionForMessage(
+			coreprocessing.TypeInstructionSetResult,
+			fromCid,
+			transport.NewCommandWithParams(0, "result", transport.MethodParams{Task: taskId, Json: "{\"result\": 1}"}))
+		outIns := coremethods.ProcResultReturned(handler, inIns)
+		coremethods.ProcRecordResult(handler, inIns, outIns)
+		answer, _ := outIns.GetAnswer()
+		return (*answer).Error.Code
+	}
+	if code := returnResult(otherCid); code != transport.ErrorCodeAccessDenied {
+		t.Errorf("Result from other server must be rejected: %d", code)
+	}
+	if rpcManager.TaskCount(serverCid) != 1 || rpcManager.ResultBufferDict.Exists(taskId) {
+		t.Fatal("Task must wait result from assigned server.")
+	}
+	if code := returnResult(serverCid); code != 0 {
+		t.Errorf("Result from assigned server must be accepted: %d", code)
+	}
+	if rpcManager.TaskCount(serverCid) != 0 || !rpcManager.ResultBufferDict.Exists(taskId) {
+		t.Error("Task must be finished by assigned server.")
+	}
+}
+
+func TestUpdateStatusDrain(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false}
+	stat := statistic.NewStatistic(option)
+	methodName := "test_drain"
+	cid := "27d90e5e-0000000000000014-1"
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	rpcManager := handler.Core.RpcManager
+	rpcManager.Append(cid, &[]string{methodName})
+	defer rpcManager.Remove(cid)
+	rpcManager.StartTask("a1b2c3d4-0000000000000002", cid)
+	inIns := coreprocessing.NewCoreInstructionForMessage(
+		coreprocessing.TypeInstructionStatus,
+		cid,
+		transport.NewCommand(0, cid, "statusupdate", fmt.Sprint(connectionsupport.ClientStatusDrain)))
+	outIns := coremethods.ProcUpdateStatus(handler, inIns)
+	if len(rpcManager.GetCidVariants(methodName)) > 0 {
+		t.Error("Server in drain state must be removed from variants.")
+	}
+	if events := coremethods.ProcStatusDrainEvent(handler, inIns, outIns); len(events) > 0 {
+		t.Error("Drained event before task finished.")
+	}
+	rpcManager.FinishTask("a1b2c3d4-0000000000000002", cid)
+	events := coremethods.ProcStatusDrainEvent(handler, inIns, outIns)
+	if len(events) != 1 || events[0].Cid != cid {
+		t.Fatalf("Drained event lost: %v", events)
+	}
+	if cmd, exists := events[0].GetCommand(); !exists || (*cmd).Method != "drained" {
+		t.Error("Drained event without command.")
+	}
+	if events := coremethods.ProcStatusDrainEvent(handler, inIns, outIns); len(events) > 0 {
+		t.Error("Drained event must be sent once.")
+	}
+}
+
+func TestExecuteWithoutAuth(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false}
+	stat := statistic.NewStatistic(option)
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	coremethods.Setup(handler.Core)
+	cheker := forTestConnectionStateCheck{Auth: false}
+	handler.StateCheker = &cheker
+	cid := "27d90e5e-0000000000000011-1"
+	for method, code := range map[string]int{
+		"ping":         0,
+		"statusupdate": transport.ErrorCodeAccessDenied,
+		"getresult":    transport.ErrorCodeAccessDenied,
+		"unknown":      transport.ErrorCodeAccessDenied} {
+		//
+		cmd := transport.NewCommand(1, cid, method, "")
+		inIns := coreprocessing.NewCoreInstructionForMessage(
+			handler.Core.MethodsDict.Get(method), cid, cmd)
+		result := handler.Execute(inIns)
+		if answer, exists := result[0].GetAnswer(); !exists || (*answer).Error.Code != code {
+			t.Errorf("Method '%s' must have error code %d: %v", method, code, answer)
+		}
+	}
+	// configured list
+	handler.Option.AnonymousMethods = []string{"getresult"}
+	cmd := transport.NewCommand(1, cid, "ping", "")
+	inIns := coreprocessing.NewCoreInstructionForMessage(coreprocessing.TypeInstructionPing, cid, cmd)
+	if answer, _ := handler.Execute(inIns)[0].GetAnswer(); (*answer).Error.Code != transport.ErrorCodeAccessDenied {
+		t.Error("Ping must be denied without auth.")
+	}
+}
+
+func TestNativeMethod(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false}
+	stat := statistic.NewStatistic(option)
+	cid := "27d90e5e-0000000000000015-1"
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	handler.TaskIdGenerator = helpers.NewTaskIdGenerator()
+	cheker := forTestConnectionStateCheck{Auth: true}
+	handler.StateCheker = &cheker
+	if handler.Core.SetupNativeMethod("ping", nil) {
+		t.Error("System method can't be replaced.")
+	}
+	handler.Core.SetupNativeMethod(
+		"test_native_echo",
+		func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+			if len(params.Data) == 0 {
+				return nil, errors.New("Empty data.")
+			}
+			return params.Data, nil
+		})
+	call := func(data string) string {
+		inIns := coreprocessing.NewCoreInstructionForMessage(
+			handler.Core.MethodsDict.Get("test_native_echo"),
+			cid,
+			transport.NewCommand(1, cid, "test_native_echo", data))
+		outIns := coremethods.ProcRouteRpc(handler, inIns)
+		if answer, _ := outIns.GetAnswer(); (*answer).Error.Code > 0 {
+			t.Fatalf("Native method call failed: %s", (*answer).Error)
+		}
+		result := coremethods.ProcCallServerMethod(handler, inIns, outIns)
+		if len(result) != 1 || result[0].Type != coreprocessing.TypeInstructionSetResult {
+			t.Fatalf("Result of native method expected: %v", result)
+		}
+		cmd, _ := result[0].GetCommand()
+		if (*cmd).Params.Cid != cid {
+			t.Errorf("Result sent to wrong connection: %s", (*cmd).Params.Cid)
+		}
+		return (*cmd).Params.Json
+	}
+	if data := call("hello"); data != "{\"result\":\"hello\"}" {
+		t.Errorf("Incorrect result: %s", data)
+	}
+	if data := call(""); !strings.Contains(data, "Empty data.") {
+		t.Errorf("Error of native method lost: %s", data)
+	}
+	handler.Core.SetupNativeMethod(
+		"test_native_echo",
+		func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+			panic("broken handler")
+		})
+	data := call("hello")
+	if !strings.Contains(data, "broken handler") ||
+		!strings.Contains(data, fmt.Sprintf("\"code\":%d", transport.ErrorCodeInternalProblem)) {
+		t.Errorf("Panic of native method must be error of task: %s", data)
+	}
+}
+
+func TestDirectResultForgotten(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false}
+	stat := statistic.NewStatistic(option)
+	cid := "27d90e5e-0000000000000016-1"
+	serverCid := "27d90e5e-0000000000000017-1"
+	replicaCid := "27d90e5e-0000000000000018-1"
+	taskId := "a1b2c3d4-0000000000000002"
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	handler.StateCheker = &forTestConnectionStateCheck{Auth: true, KeyName: "owner"}
+	rpcManager := handler.Core.RpcManager
+	rpcManager.AppendReplica(replicaCid)
+	rpcManager.ResultDirectionDict.Set(taskId, cid)
+	rpcManager.ResultOwnerDict.Set(taskId, "owner")
+	inIns := coreprocessing.NewCoreInstructionForMessage(
+		coreprocessing.TypeInstructionSetResult,
+		serverCid,
+		transport.NewCommandWithParams(0, "result", transport.MethodParams{Task: taskId, Json: "{\"result\": 1}"}))
+	outIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionOk)
+	outIns.SetAnswer(inIns.MakeOkAnswer(""))
+	// connection in web-socket group gets result without "getresult"
+	result := coremethods.ProcRecordResult(handler, inIns, outIns)
+	if rpcManager.ResultDirectionDict.Exists(taskId) || rpcManager.ResultOwnerDict.Exists(taskId) {
+		t.Error("Records of delivered result must be removed.")
+	}
+	deleted := false
+	for _, ins := range result {
+		if ins.Type == coreprocessing.TypeInstructionReplicate {
+			cmd, _ := ins.GetCommand()
+			deleted = (*cmd).Params.Cid == replicaCid &&
+				strings.Contains((*cmd).Params.Json, coreprocessing.ReplicaOpDelete)
+		}
+	}
+	if !deleted {
+		t.Errorf("Standby node must remove records of delivered result: %v", result)
+	}
+}
+
+func TestAclForPeerCalls(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false,
+		Node:      "testnode"}
+	stat := statistic.NewStatistic(option)
+	cid := "27d90e5e-0000000000000019-1"
+	aclDir, err := ioutil.TempDir("", "roolet-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(aclDir)
+	aclFile := path.Join(aclDir, "acl.json")
+	if err := ioutil.WriteFile(aclFile, []byte("{\"client1\": {\"call\": [\"test_*\"]}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	handler.TaskIdGenerator = helpers.NewTaskIdGenerator()
+	handler.Acl = acl.NewAccessList()
+	if err := handler.Acl.Load(aclFile); err != nil {
+		t.Fatal(err)
+	}
+	handler.Core.SetupNativeMethod(
+		"test_native_acl",
+		func(handler *coreprocessing.Handler, params transport.MethodParams) (interface{}, error) {
+			return true, nil
+		})
+	call := func(keyName string, group int) int {
+		handler.StateCheker = &forTestConnectionStateCheck{Auth: true, KeyName: keyName, Group: group}
+		inIns := coreprocessing.NewCoreInstructionForMessage(
+			handler.Core.MethodsDict.Get("test_native_acl"),
+			cid,
+			transport.NewCommand(1, cid, "test_native_acl", ""))
+		answer, _ := coremethods.ProcRouteRpc(handler, inIns).GetAnswer()
+		return (*answer).Error.Code
+	}
+	if code := call("client2", connectionsupport.GroupConnectionClient); code != transport.ErrorCodeAccessDenied {
+		t.Errorf("Key without rule must be denied: %d", code)
+	}
+	if code := call("client1", connectionsupport.GroupConnectionClient); code != 0 {
+		t.Errorf("Allowed method denied: %d", code)
+	}
+	// local connection of peer link has name of node as key
+	if code := call(option.Node, connectionsupport.GroupConnectionPeer); code != 0 {
+		t.Errorf("Call forwarded by peer node denied: %d", code)
+	}
+}
+
+func TestAuthHmacToken(t *testing.T) {
+	keyDir, _ := testsupport.NewKeyDir(t, "client1", "admin1")
+	option := testsupport.NewOption(keyDir)
+	option.Statistic = false
+	option.Secret = "secret1"
+	option.Tokens.Algorithms = []string{cryptosupport.AlgorithmHS256}
+	option.AdminKeys = []string{"admin1"}
+	stat := statistic.NewStatistic(option)
+	cid := "27d90e5e-0000000000000020-1"
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	auth := func(keyName string) *transport.Answer {
+		token, _ := cryptosupport.CreateToken(
+			[]byte(option.Secret), cryptosupport.NewClaims(keyName, option.Node, time.Minute))
+		cmd := transport.NewCommandWithParams(0, "auth", transport.MethodParams{
+			Json: fmt.Sprintf("{\"key\": \"%s\"}", keyName),
+			Data: token})
+		inIns := coreprocessing.NewCoreInstructionForMessage(coreprocessing.TypeInstructionAuth, cid, cmd)
+		answer, _ := coremethods.ProcAuth(handler, inIns).GetAnswer()
+		return answer
+	}
+	if answer := auth("client1"); (*answer).Error.Code > 0 {
+		t.Errorf("HS256 token of enrolled key must be accepted: %s", (*answer).Error)
+	}
+	if answer := auth("client2"); (*answer).Error.Code != transport.ErrorCodeMethodAuthFailed {
+		t.Errorf("HS256 token of unknown key accepted: %s", (*answer).Result)
+	}
+	if answer := auth("admin1"); (*answer).Error.Code != transport.ErrorCodeMethodAuthFailed {
+		t.Errorf("HS256 token of admin key accepted: %s", (*answer).Result)
+	}
+}
+
+func TestServerDrainUnknownCid(t *testing.T) {
+	option := options.SysOption{
+		Statistic: false,
+		AdminKeys: []string{"admin"}}
+	stat := statistic.NewStatistic(option)
+	manager := connectionsupport.NewConnectionDataManager(option)
+	admin := manager.NewConnection()
+	manager.UpdateState(admin.Cid, connectionsupport.StateChanges{
+		ChangeType: connectionsupport.StateChangesTypeAuth,
+		Auth:       true,
+		KeyName:    "admin"})
+	handler := coreprocessing.NewHandler(coreprocessing.NewCore(), 1, option, stat)
+	handler.StateCheker = manager
+	for _, cid := range []string{"a-1-0", "27d90e5e-0000000000000019-100", admin.Cid} {
+		inIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionServerDrain)
+		cmd := transport.NewCommand(0, admin.Cid, "serverdrain", "")
+		(*cmd).Params.Json = fmt.Sprintf("{\"cid\": \"%s\", \"drain\": true}", cid)
+		inIns.SetCommand(cmd)
+		outIns := coremethods.ProcServerDrain(handler, inIns)
+		if answer, _ := outIns.GetAnswer(); (*answer).Error.Code != transport.ErrorCodeUnexpectedValue {
+			t.Errorf("Drain of unknown server '%s' must be rejected: %v", cid, (*answer).Error)
+		}
+	}
+}
@@ -1,12 +1,22 @@
 package coreprocessing
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"roolet/accounting"
+	"roolet/acl"
+	"roolet/circuitbreaker"
 	"roolet/connectionsupport"
+	"roolet/cryptosupport"
 	"roolet/helpers"
+	"roolet/keyregistry"
 	"roolet/options"
+	"roolet/resultstore"
 	"roolet/rllogger"
 	"roolet/statistic"
 	"roolet/transport"
+	"time"
 )
 
 const (
@@ -17,6 +27,7 @@ const (
 	// turnoff it after
 	TypeInstructionPing      = 20
 	TypeInstructionAuth      = 30
+	TypeInstructionChallenge = 35
 	TypeInstructionPong      = 40
 	TypeInstructionStatus    = 50
 	TypeInstructionReg       = 55
@@ -24,6 +35,15 @@ const (
 	TypeInstructionExecute   = 110
 	TypeInstructionSetResult = 120
 	TypeInstructionGetResult = 130
+	// admin
+	TypeInstructionServerInfo  = 140
+	TypeInstructionServerDrain = 150
+	TypeInstructionReplicate   = 160
+	TypeInstructionUsage       = 170
+	// replication records
+	ReplicaOpRoute  = "route"
+	ReplicaOpResult = "result"
+	ReplicaOpDelete = "delete"
 )
 
 type CoreInstruction struct {
@@ -39,6 +59,13 @@ func NewExitCoreInstruction() *CoreInstruction {
 	return &result
 }
 
+// event for server in drain state, all tasks finished
+func NewDrainedCoreInstruction(cid string) *CoreInstruction {
+	result := CoreInstruction{Type: TypeInstructionStatus, Cid: cid}
+	result.cmd = transport.NewCommand(0, cid, "drained", "")
+	return &result
+}
+
 func NewCoreInstruction(insType int) *CoreInstruction {
 	result := CoreInstruction{Type: insType}
 	return &result
@@ -55,6 +82,12 @@ func (instruction *CoreInstruction) MakeErrAnswer(code int, msg string) *transpo
 	return answerPtr
 }
 
+func (instruction *CoreInstruction) MakeErrAnswerWithData(code int, msg string, data interface{}) *transport.Answer {
+	answerPtr := instruction.MakeErrAnswer(code, msg)
+	(*answerPtr).Error.Data = data
+	return answerPtr
+}
+
 func (instruction *CoreInstruction) MakeOkAnswer(result string) *transport.Answer {
 	answerPtr := instruction.cmd.CreateAnswer()
 	(*answerPtr).Result = result
@@ -122,19 +155,54 @@ func (set *CidSet) Exists(cid string) bool {
 	return false
 }
 
+// change of task results state for standby node
+type ReplicaRecord struct {
+	Op    string `json:"op"`
+	Task  string `json:"task"`
+	Owner string `json:"owner,omitempty"`
+	Data  string `json:"data,omitempty"`
+}
+
+type serverTask struct {
+	cid   string
+	start time.Time
+}
+
 // server manager
 type RpcServerManager struct {
 	helpers.AsyncSafeObject
 	// <task id>: <cid direction>
 	ResultDirectionDict *helpers.AsyncStrDict
-	// <cid direction>: <data>
-	ResultBufferDict *helpers.AsyncStrDict
+	// <task id>: <key name of client>
+	ResultOwnerDict *helpers.AsyncStrDict
+	// <task id>: <data>
+	ResultBufferDict resultstore.ResultStore
+	Breakers         *circuitbreaker.BreakerDict
 	methods          map[string]*CidSet
+	// <task id>: <server cid>
+	tasks map[string]serverTask
+	// <server cid>: drained event sent
+	drained map[string]bool
+	// connections of other nodes
+	peers map[string]bool
+	// connections of standby nodes
+	replicas map[string]bool
+}
+
+// replace result storage backend (before start only)
+func (manager *RpcServerManager) SetResultStore(store resultstore.ResultStore) {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	(*manager).ResultBufferDict = store
 }
 
 func (manager *RpcServerManager) Append(cid string, methods *[]string) {
 	manager.Lock(true)
 	defer manager.Unlock(true)
+	manager.append(cid, methods)
+}
+
+func (manager *RpcServerManager) append(cid string, methods *[]string) {
 	for _, methodName := range *methods {
 		if setPtr, exists := (*manager).methods[methodName]; exists {
 			setPtr.Add(cid)
@@ -146,12 +214,228 @@ func (manager *RpcServerManager) Append(cid string, methods *[]string) {
 	}
 }
 
+// peer node methods replaced by each announcement
+func (manager *RpcServerManager) AppendPeer(cid string, methods *[]string) {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	for _, setPtr := range (*manager).methods {
+		setPtr.Remove(cid)
+	}
+	(*manager).peers[cid] = true
+	manager.append(cid, methods)
+}
+
+func (manager *RpcServerManager) IsPeer(cid string) bool {
+	manager.Lock(false)
+	defer manager.Unlock(false)
+	return (*manager).peers[cid]
+}
+
+// methods of servers connected to this node
+func (manager *RpcServerManager) GetLocalMethods() []string {
+	manager.Lock(false)
+	defer manager.Unlock(false)
+	var result []string
+	for methodName, set := range (*manager).methods {
+		for cid, _ := range set.set {
+			if !(*manager).peers[cid] {
+				result = append(result, methodName)
+				break
+			}
+		}
+	}
+	return result
+}
+
 func (manager *RpcServerManager) Remove(cid string) {
 	manager.Lock(true)
 	defer manager.Unlock(true)
 	for _, setPtr := range (*manager).methods {
 		setPtr.Remove(cid)
 	}
+	for taskId, task := range (*manager).tasks {
+		if task.cid == cid {
+			delete((*manager).tasks, taskId)
+		}
+	}
+	delete((*manager).drained, cid)
+	delete((*manager).peers, cid)
+	delete((*manager).replicas, cid)
+	(*manager).Breakers.Remove(cid)
+}
+
+func (manager *RpcServerManager) AppendReplica(cid string) {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	(*manager).replicas[cid] = true
+}
+
+// record for each standby node, or for one if cid set
+func (manager *RpcServerManager) ReplicaInstructions(record ReplicaRecord, cid string) []*CoreInstruction {
+	var targets []string
+	if len(cid) > 0 {
+		targets = []string{cid}
+	} else {
+		manager.Lock(false)
+		for replicaCid, _ := range (*manager).replicas {
+			targets = append(targets, replicaCid)
+		}
+		manager.Unlock(false)
+	}
+	var result []*CoreInstruction
+	if len(targets) == 0 {
+		return result
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		rllogger.Outputf(rllogger.LogError, "Replica record dump problem: %s", err)
+		return result
+	}
+	for _, replicaCid := range targets {
+		ins := NewCoreInstruction(TypeInstructionReplicate)
+		ins.SetCommand(transport.NewCommandWithParams(
+			0, "replica", transport.MethodParams{Cid: replicaCid, Task: record.Task, Json: string(data)}))
+		result = append(result, ins)
+	}
+	return result
+}
+
+// records of all known tasks for new standby node
+func (manager *RpcServerManager) ReplicaSnapshot() []ReplicaRecord {
+	var result []ReplicaRecord
+	for _, taskId := range (*manager).ResultOwnerDict.Keys() {
+		if owner := (*manager).ResultOwnerDict.Get(taskId); owner != nil {
+			result = append(result, ReplicaRecord{Op: ReplicaOpRoute, Task: taskId, Owner: *owner})
+		}
+		if data := (*manager).ResultBufferDict.Get(taskId); data != nil {
+			result = append(result, ReplicaRecord{Op: ReplicaOpResult, Task: taskId, Data: *data})
+		}
+	}
+	return result
+}
+
+// standby node side
+func (manager *RpcServerManager) ApplyReplica(record ReplicaRecord) {
+	switch record.Op {
+	case ReplicaOpRoute:
+		(*manager).ResultOwnerDict.Set(record.Task, record.Owner)
+	case ReplicaOpResult:
+		(*manager).ResultBufferDict.Set(record.Task, record.Data)
+	case ReplicaOpDelete:
+		manager.DeleteResult(record.Task)
+	default:
+		rllogger.Outputf(rllogger.LogWarn, "Unknown replica record: '%s'", record.Op)
+	}
+}
+
+// result taken by client
+func (manager *RpcServerManager) DeleteResult(taskId string) {
+	(*manager).ResultBufferDict.Delete(taskId)
+	(*manager).ResultDirectionDict.Delete(taskId)
+	(*manager).ResultOwnerDict.Delete(taskId)
+}
+
+// server in drain state don't take new tasks
+func (manager *RpcServerManager) SetDrain(cid string, value bool) {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	if value {
+		if _, exists := (*manager).drained[cid]; !exists {
+			(*manager).drained[cid] = false
+		}
+	} else {
+		delete((*manager).drained, cid)
+	}
+}
+
+func (manager *RpcServerManager) IsDrain(cid string) bool {
+	manager.Lock(false)
+	defer manager.Unlock(false)
+	_, exists := (*manager).drained[cid]
+	return exists
+}
+
+// true only once when server in drain state has no tasks
+func (manager *RpcServerManager) CompleteDrain(cid string) bool {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	if notified, exists := (*manager).drained[cid]; exists && !notified {
+		for _, task := range (*manager).tasks {
+			if task.cid == cid {
+				return false
+			}
+		}
+		(*manager).drained[cid] = true
+		return true
+	}
+	return false
+}
+
+// task sent to server, wait result
+func (manager *RpcServerManager) StartTask(taskId, cid string) {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	(*manager).tasks[taskId] = serverTask{cid: cid, start: time.Now()}
+}
+
+// result returned by server cid, duration of task returned,
+// task of other server isn't finished
+func (manager *RpcServerManager) FinishTask(taskId, cid string) (time.Duration, bool, error) {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	if task, exists := (*manager).tasks[taskId]; exists {
+		if task.cid != cid {
+			return 0, false, errors.New(fmt.Sprintf("Task %s is assigned to other server.", taskId))
+		}
+		delete((*manager).tasks, taskId)
+		return time.Since(task.start), true, nil
+	}
+	return 0, false, nil
+}
+
+// remove tasks without result after timeout, server cid for each task returned
+func (manager *RpcServerManager) ExpiredTasks(timeout time.Duration) []string {
+	manager.Lock(true)
+	defer manager.Unlock(true)
+	var result []string
+	for taskId, task := range (*manager).tasks {
+		if time.Since(task.start) > timeout {
+			delete((*manager).tasks, taskId)
+			result = append(result, task.cid)
+		}
+	}
+	return result
+}
+
+func (manager *RpcServerManager) TaskTotal() int {
+	manager.Lock(false)
+	defer manager.Unlock(false)
+	return len((*manager).tasks)
+}
+
+func (manager *RpcServerManager) TaskCount(cid string) int {
+	manager.Lock(false)
+	defer manager.Unlock(false)
+	result := 0
+	for _, task := range (*manager).tasks {
+		if task.cid == cid {
+			result++
+		}
+	}
+	return result
+}
+
+// <server cid>: <methods>
+func (manager *RpcServerManager) GetServers() map[string][]string {
+	manager.Lock(false)
+	defer manager.Unlock(false)
+	result := make(map[string][]string)
+	for methodName, set := range (*manager).methods {
+		for cid, _ := range set.set {
+			result[cid] = append(result[cid], methodName)
+		}
+	}
+	return result
 }
 
 func (manager *RpcServerManager) GetCidVariants(method string) []string {
@@ -161,26 +445,30 @@ func (manager *RpcServerManager) GetCidVariants(method string) []string {
 	if set, exists := (*manager).methods[method]; exists {
 		size := set.Size()
 		if size > 0 {
-			result = make([]string, size)
-			index := 0
+			result = make([]string, 0, size)
 			for cid, _ := range set.set {
-				result[index] = cid
-				index++
+				if _, drain := (*manager).drained[cid]; !drain {
+					result = append(result, cid)
+				}
 			}
 		}
 	}
 	return result
 }
 
-var onceRpcServerManager = RpcServerManager{
-	AsyncSafeObject:     *(helpers.NewAsyncSafeObject()),
-	ResultDirectionDict: helpers.NewAsyncStrDict(),
-	ResultBufferDict:    helpers.NewAsyncStrDict(),
-	methods:             make(map[string]*CidSet)}
-
 func NewRpcServerManager() *RpcServerManager {
-	// use as singltone
-	return &onceRpcServerManager
+	manager := RpcServerManager{
+		AsyncSafeObject:     *(helpers.NewAsyncSafeObject()),
+		ResultDirectionDict: helpers.NewAsyncStrDict(),
+		ResultOwnerDict:     helpers.NewAsyncStrDict(),
+		ResultBufferDict:    resultstore.NewMemoryResultStore(),
+		Breakers:            circuitbreaker.NewBreakerDict(),
+		methods:             make(map[string]*CidSet),
+		tasks:               make(map[string]serverTask),
+		drained:             make(map[string]bool),
+		peers:               make(map[string]bool),
+		replicas:            make(map[string]bool)}
+	return &manager
 }
 
 // main instruction commnad router
@@ -189,26 +477,29 @@ type MethodInstructionDict struct {
 	content map[string]int
 }
 
-var onceMethodInstructionDict MethodInstructionDict = MethodInstructionDict{
-	AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
-	content: map[string]int{
-		"auth":         TypeInstructionAuth,
-		"registration": TypeInstructionReg,
-		"statusupdate": TypeInstructionStatus,
-		"result":       TypeInstructionSetResult,
-		"getresult":    TypeInstructionGetResult,
-		"ping":         TypeInstructionPing,
-		"quit":         TypeInstructionExit,
-		"exit":         TypeInstructionExit}}
-
 func NewMethodInstructionDict() *MethodInstructionDict {
-	// use like singleton
-	return &onceMethodInstructionDict
+	dict := MethodInstructionDict{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		content: map[string]int{
+			"auth":          TypeInstructionAuth,
+			"authchallenge": TypeInstructionChallenge,
+			"registration":  TypeInstructionReg,
+			"statusupdate":  TypeInstructionStatus,
+			"result":        TypeInstructionSetResult,
+			"getresult":     TypeInstructionGetResult,
+			"serverinfo":    TypeInstructionServerInfo,
+			"serverdrain":   TypeInstructionServerDrain,
+			"replicate":     TypeInstructionReplicate,
+			"usage":         TypeInstructionUsage,
+			"ping":          TypeInstructionPing,
+			"quit":          TypeInstructionExit,
+			"exit":          TypeInstructionExit}}
+	return &dict
 }
 
 func (dict *MethodInstructionDict) check() {
 	if len((*dict).content) <= 0 {
-		// use once instance only!
+		// zero value without system methods
 		rllogger.Output(rllogger.LogTerminate, "Use NewMethodInstructionDict()")
 	}
 }
@@ -257,18 +548,34 @@ func exitHandler(handler *Handler, inInstruction *CoreInstruction) *CoreInstruct
 type InstructionHandlerMethod func(*Handler, *CoreInstruction) *CoreInstruction
 type InstructionPostHandlerMethod func(*Handler, *CoreInstruction, *CoreInstruction) []*CoreInstruction
 
-var methods map[int]InstructionHandlerMethod = map[int]InstructionHandlerMethod{
-	// TODO: create another one (or more) module for methods
-	// TypeInstructionSkip: skipHandler
-	// ..
-	TypeInstructionExit: exitHandler}
-
-var postMethods map[int]InstructionPostHandlerMethod = map[int]InstructionPostHandlerMethod{}
-
-func SetupMethod(insType int, method InstructionHandlerMethod, postMethod InstructionPostHandlerMethod) {
-	methods[insType] = method
+// processing of one broker instance: routing state, instruction methods,
+// native methods and interceptors
+type Core struct {
+	RpcManager       *RpcServerManager
+	MethodsDict      *MethodInstructionDict
+	methods          map[int]InstructionHandlerMethod
+	postMethods      map[int]InstructionPostHandlerMethod
+	nativeMethods    map[string]NativeMethod
+	preInterceptors  []preInterceptorRecord
+	postInterceptors []postInterceptorRecord
+}
+
+func NewCore() *Core {
+	core := Core{
+		RpcManager:  NewRpcServerManager(),
+		MethodsDict: NewMethodInstructionDict(),
+		methods: map[int]InstructionHandlerMethod{
+			TypeInstructionExit: exitHandler},
+		postMethods:   make(map[int]InstructionPostHandlerMethod),
+		nativeMethods: make(map[string]NativeMethod)}
+	return &core
+}
+
+// use it before start of workers
+func (core *Core) SetupMethod(insType int, method InstructionHandlerMethod, postMethod InstructionPostHandlerMethod) {
+	(*core).methods[insType] = method
 	if postMethod != nil {
-		postMethods[insType] = postMethod
+		(*core).postMethods[insType] = postMethod
 	}
 }
 
@@ -277,8 +584,14 @@ type Handler struct {
 	Option          options.SysOption
 	Stat            statistic.StatisticUpdater
 	TaskIdGenerator *helpers.TaskIdGenerator
+	Accounting      *accounting.Accounting
+	Acl             *acl.AccessList
+	Keys            *keyregistry.Registry
+	Replay          *cryptosupport.ReplayCache
+	Sessions        *connectionsupport.ResumeDict
+	Challenges      *cryptosupport.ChallengeDict
+	Core            *Core
 	worker          int
-	methods         *map[int]InstructionHandlerMethod
 }
 
 type HandlerConfigurator interface {
@@ -286,15 +599,16 @@ type HandlerConfigurator interface {
 }
 
 func NewHandler(
+	core *Core,
 	workerIndex int,
 	option options.SysOption,
 	stat statistic.StatisticUpdater) *Handler {
 	//
 	handler := Handler{
-		Option:  option,
-		Stat:    stat,
-		worker:  workerIndex,
-		methods: &methods}
+		Option: option,
+		Stat:   stat,
+		Core:   core,
+		worker: workerIndex}
 
 	return &handler
 }
@@ -303,37 +617,45 @@ func (handler *Handler) Close() {
 	// pass
 }
 
+// command of connection without auth and not in anonymous methods
+func (handler *Handler) authRequired(ins *CoreInstruction) bool {
+	cmd, exists := ins.GetCommand()
+	if !exists || (*handler).StateCheker == nil {
+		return false
+	}
+	return !handler.Option.IsAnonymousMethod((*cmd).Method) && !handler.StateCheker.IsAuth(ins.Cid)
+}
+
 func (handler *Handler) Execute(ins *CoreInstruction) []*CoreInstruction {
-	var result []*CoreInstruction
-	if method, exists := methods[ins.Type]; exists {
-		outIns := method(handler, ins)
+	if handler.authRequired(ins) {
+		handler.Stat.AddOneMsg("rejected_anonymous")
+		outIns := NewCoreInstruction(TypeInstructionProblem)
 		(*outIns).Cid = (*ins).Cid
-		// post method
-		postMethod, exists := postMethods[ins.Type]
-		size := 1
-		var externIns []*CoreInstruction
-		if exists {
-			externIns = postMethod(handler, ins, outIns)
-			size += len(externIns)
-		}
-		result = make([]*CoreInstruction, size)
-		result[0] = outIns
-		if exists {
-			for index, insPtr := range externIns {
-				result[index+1] = insPtr
+		(*outIns).answer = ins.MakeErrAnswer(transport.ErrorCodeAccessDenied, "Access denied.")
+		return []*CoreInstruction{outIns}
+	}
+	core := (*handler).Core
+	outIns, externIns := core.runPreInterceptors(handler, ins)
+	if outIns == nil {
+		if method, exists := (*core).methods[ins.Type]; exists {
+			outIns = method(handler, ins)
+			// post method
+			if postMethod, exists := (*core).postMethods[ins.Type]; exists {
+				externIns = append(externIns, postMethod(handler, ins, outIns)...)
 			}
+		} else {
+			// send error
+			outIns = NewCoreInstruction(TypeInstructionProblem)
+			(*outIns).answer = ins.MakeErrAnswer(
+				transport.ErrorCodeInternalProblem, "Not implimented handler for this type!")
+			rllogger.Outputf(
+				rllogger.LogError, "Unknown instruction type '%d' from %s", ins.Type, ins.Cid)
 		}
-	} else {
-		// send error
-		outIns := NewCoreInstruction(TypeInstructionProblem)
-		(*outIns).Cid = (*ins).Cid
-		(*outIns).answer = ins.MakeErrAnswer(
-			transport.ErrorCodeInternalProblem, "Not implimented handler for this type!")
-		rllogger.Outputf(
-			rllogger.LogError, "Unknown instruction type '%d' from %s", ins.Type, ins.Cid)
-		result = make([]*CoreInstruction, 1)
-		result[0] = outIns
 	}
 	// copy cid always
-	return result
+	(*outIns).Cid = (*ins).Cid
+	externIns = append(externIns, core.runPostInterceptors(handler, ins, outIns)...)
+	result := make([]*CoreInstruction, 1, len(externIns)+1)
+	result[0] = outIns
+	return append(result, externIns...)
 }
@@ -2,18 +2,107 @@ package coreprocessing_test
 
 import (
 	"roolet/coreprocessing"
+	"roolet/options"
+	"roolet/transport"
 	"testing"
 )
 
-func TestSingleMethodsDict(t *testing.T) {
-	dict := coreprocessing.NewMethodInstructionDict()
+func TestInstanceMethodsDict(t *testing.T) {
+	dict := coreprocessing.NewCore().MethodsDict
 	dict.RegisterClientMethods("test1", "test2")
-	innerFunc := func() {
-		newDict := coreprocessing.NewMethodInstructionDict()
-		t.Logf("%p == %p ?", dict, newDict)
-		if !newDict.Exists("test1") || !newDict.Exists("test2") {
-			t.Error("Various instance!")
+	if !dict.Exists("test1") || !dict.Exists("test2") {
+		t.Error("Methods lost!")
+	}
+	newDict := coreprocessing.NewCore().MethodsDict
+	if newDict.Exists("test1") || !newDict.Exists("ping") {
+		t.Errorf("Instances must be independent: %p == %p ?", dict, newDict)
+	}
+}
+
+func TestPeerMethodsReplaced(t *testing.T) {
+	rpcManager := coreprocessing.NewRpcServerManager()
+	serverCid := "27d90e5e-0000000000000021-1"
+	peerCid := "27d90e5e-0000000000000022-1"
+	rpcManager.Append(serverCid, &[]string{"peer_test1"})
+	defer rpcManager.Remove(serverCid)
+	rpcManager.AppendPeer(peerCid, &[]string{"peer_test1", "peer_test2"})
+	defer rpcManager.Remove(peerCid)
+	rpcManager.AppendPeer(peerCid, &[]string{"peer_test3"})
+	if !rpcManager.IsPeer(peerCid) || rpcManager.IsPeer(serverCid) {
+		t.Error("Incorrect peer state.")
+	}
+	if len(rpcManager.GetCidVariants("peer_test2")) > 0 {
+		t.Error("Peer methods must be replaced by new announcement.")
+	}
+	for _, methodName := range rpcManager.GetLocalMethods() {
+		if methodName == "peer_test3" {
+			t.Error("Peer methods can't be local.")
+		}
+	}
+}
+
+func TestReplicaRecordsApply(t *testing.T) {
+	rpcManager := coreprocessing.NewRpcServerManager()
+	taskId := "a1b2c3d4-0000000000000031"
+	rpcManager.ApplyReplica(coreprocessing.ReplicaRecord{
+		Op: coreprocessing.ReplicaOpRoute, Task: taskId, Owner: "client"})
+	rpcManager.ApplyReplica(coreprocessing.ReplicaRecord{
+		Op: coreprocessing.ReplicaOpResult, Task: taskId, Data: "{\"result\": 1}"})
+	found := false
+	for _, record := range rpcManager.ReplicaSnapshot() {
+		if record.Task == taskId && record.Op == coreprocessing.ReplicaOpResult {
+			found = record.Data == "{\"result\": 1}"
 		}
 	}
-	innerFunc()
+	if !found {
+		t.Error("Result lost in snapshot.")
+	}
+	rpcManager.ApplyReplica(coreprocessing.ReplicaRecord{
+		Op: coreprocessing.ReplicaOpDelete, Task: taskId})
+	if rpcManager.ResultBufferDict.Exists(taskId) || rpcManager.ResultOwnerDict.Exists(taskId) {
+		t.Error("Result must be removed by delete record.")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	insType := 9901
+	cid := "27d90e5e-0000000000000041-1"
+	var calls []string
+	core := coreprocessing.NewCore()
+	core.AddPreInterceptor(
+		coreprocessing.InterceptorFilter{Methods: []string{"icp_short"}},
+		func(handler *coreprocessing.Handler, ins *coreprocessing.CoreInstruction) (*coreprocessing.CoreInstruction, []*coreprocessing.CoreInstruction) {
+			calls = append(calls, "pre")
+			outIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionOk)
+			cmd, _ := ins.GetCommand()
+			outIns.SetAnswer(cmd.CreateAnswer())
+			return outIns, []*coreprocessing.CoreInstruction{coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionSkip)}
+		})
+	for _, name := range []string{"outer", "inner"} {
+		name := name
+		core.AddPostInterceptor(
+			coreprocessing.InterceptorFilter{Types: []int{insType}},
+			func(handler *coreprocessing.Handler, inIns, outIns *coreprocessing.CoreInstruction) []*coreprocessing.CoreInstruction {
+				calls = append(calls, name)
+				return nil
+			})
+	}
+	handler := coreprocessing.NewHandler(core, 0, options.SysOption{}, nil)
+	result := handler.Execute(coreprocessing.NewCoreInstructionForMessage(
+		insType, cid, transport.NewCommand(1, cid, "icp_short", "")))
+	if len(result) != 2 || result[0].Type != coreprocessing.TypeInstructionOk || result[0].Cid != cid {
+		t.Fatalf("Short-circuit answer expected: %v", result)
+	}
+	if len(calls) != 3 || calls[0] != "pre" || calls[1] != "inner" || calls[2] != "outer" {
+		t.Errorf("Wrong order of interceptors: %v", calls)
+	}
+	calls = nil
+	result = handler.Execute(coreprocessing.NewCoreInstructionForMessage(
+		insType, cid, transport.NewCommand(2, cid, "icp_other", "")))
+	if len(result) != 1 || result[0].Type != coreprocessing.TypeInstructionProblem {
+		t.Errorf("Method must be called without short-circuit: %v", result)
+	}
+	if len(calls) != 2 {
+		t.Errorf("Post interceptors expected: %v", calls)
+	}
 }
@@ -0,0 +1,82 @@
+package coreprocessing
+
+// instructions for interceptor by type or by method name of command,
+// empty filter matches all instructions
+type InterceptorFilter struct {
+	Types   []int
+	Methods []string
+}
+
+func (filter InterceptorFilter) match(ins *CoreInstruction) bool {
+	if len(filter.Types) == 0 && len(filter.Methods) == 0 {
+		return true
+	}
+	for _, insType := range filter.Types {
+		if insType == ins.Type {
+			return true
+		}
+	}
+	if cmd, exists := ins.GetCommand(); exists {
+		for _, method := range filter.Methods {
+			if method == cmd.Method {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// called before method, instruction can be changed (type too),
+// not nil answer instruction stops chain and method is not called,
+// extra instructions are sent after answer
+type PreInterceptor func(handler *Handler, ins *CoreInstruction) (*CoreInstruction, []*CoreInstruction)
+
+// called for answer of each matched instruction (short-circuited too),
+// answer instruction can be changed, extra instructions are sent after answer
+type PostInterceptor func(handler *Handler, inIns *CoreInstruction, outIns *CoreInstruction) []*CoreInstruction
+
+type preInterceptorRecord struct {
+	filter      InterceptorFilter
+	interceptor PreInterceptor
+}
+
+type postInterceptorRecord struct {
+	filter      InterceptorFilter
+	interceptor PostInterceptor
+}
+
+// pre interceptors are called in order of adding, use it before start of workers
+func (core *Core) AddPreInterceptor(filter InterceptorFilter, interceptor PreInterceptor) {
+	(*core).preInterceptors = append((*core).preInterceptors, preInterceptorRecord{filter: filter, interceptor: interceptor})
+}
+
+// post interceptors are called in reverse order of adding (first added is outer)
+func (core *Core) AddPostInterceptor(filter InterceptorFilter, interceptor PostInterceptor) {
+	(*core).postInterceptors = append((*core).postInterceptors, postInterceptorRecord{filter: filter, interceptor: interceptor})
+}
+
+func (core *Core) runPreInterceptors(handler *Handler, ins *CoreInstruction) (*CoreInstruction, []*CoreInstruction) {
+	var extra []*CoreInstruction
+	for _, record := range (*core).preInterceptors {
+		if !record.filter.match(ins) {
+			continue
+		}
+		outIns, newIns := record.interceptor(handler, ins)
+		extra = append(extra, newIns...)
+		if outIns != nil {
+			return outIns, extra
+		}
+	}
+	return nil, extra
+}
+
+func (core *Core) runPostInterceptors(handler *Handler, inIns *CoreInstruction, outIns *CoreInstruction) []*CoreInstruction {
+	var extra []*CoreInstruction
+	for index := len((*core).postInterceptors) - 1; index >= 0; index-- {
+		record := (*core).postInterceptors[index]
+		if record.filter.match(inIns) {
+			extra = append(extra, record.interceptor(handler, inIns, outIns)...)
+		}
+	}
+	return extra
+}
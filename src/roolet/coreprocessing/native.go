@@ -0,0 +1,26 @@
+package coreprocessing
+
+import (
+	"roolet/transport"
+)
+
+// method executed by broker itself (in core worker), result is dumped to JSON
+// as result of task, error is returned to client as error of task
+type NativeMethod func(handler *Handler, params transport.MethodParams) (interface{}, error)
+
+// native method has priority over server methods with same name,
+// false for name of system method, use it before start of workers
+func (core *Core) SetupNativeMethod(name string, method NativeMethod) bool {
+	dict := (*core).MethodsDict
+	if len(name) == 0 || (dict.Exists(name) && dict.Get(name) != TypeInstructionExternal) {
+		return false
+	}
+	(*core).nativeMethods[name] = method
+	dict.RegisterClientMethods(name)
+	return true
+}
+
+func (core *Core) GetNativeMethod(name string) (NativeMethod, bool) {
+	method, exists := (*core).nativeMethods[name]
+	return method, exists
+}
@@ -1,19 +1,34 @@
 package coresupport
 
 import (
+	"roolet/accounting"
+	"roolet/acl"
 	"roolet/connectionsupport"
 	"roolet/coreprocessing"
+	"roolet/cryptosupport"
 	"roolet/helpers"
+	"roolet/keyregistry"
 	"roolet/options"
+	"roolet/ratelimit"
 	"roolet/rllogger"
 	"roolet/statistic"
 	"roolet/transport"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	taskTimeoutCheckPeriod = time.Second
+	shutdownCheckPeriod    = 100 * time.Millisecond
+	// instructions kept for parked session
+	parkedQueueSize = 1024
 )
 
 func worker(
 	index int,
 	instructionsChannel *chan coreprocessing.CoreInstruction,
 	stopSignalChannel *chan bool,
+	optionChannel chan options.SysOption,
 	outGroups *[]*outChannelGroup,
 	handler *coreprocessing.Handler) {
 	//
@@ -27,12 +42,17 @@ func worker(
 			{
 				active = false
 			}
+		case option := <-optionChannel:
+			{
+				(*handler).Option = option
+			}
 		case instruction := <-*instructionsChannel:
 			{
 				for _, newInstruction := range handler.Execute(&instruction) {
 					cid := (*newInstruction).Cid
 					if resIndex, id, err := connectionsupport.ExtractConnectionDataIndexAndId(cid); err == nil {
-						if !(*outGroups)[resIndex].Send(id, newInstruction) {
+						group := getOutChannelGroup(*outGroups, resIndex)
+						if group == nil || !group.Send(id, newInstruction) {
 							rllogger.Outputf(
 								rllogger.LogError,
 								"Can't send back instruction for %s worker: %d", cid, index)
@@ -50,16 +70,69 @@ func worker(
 	rllogger.Outputf(rllogger.LogDebug, "Worker %d completed...", index)
 }
 
+// tasks without result after timeout are failures of server
+func (mng *CoreWorkerManager) taskTimeoutProcessing() {
+	stat := (*mng).statistic
+	rpcManager := (*mng).core.RpcManager
+	ticker := time.NewTicker(taskTimeoutCheckPeriod)
+	defer ticker.Stop()
+	active := true
+	for active {
+		select {
+		case <-(*mng).timeoutStopChannel:
+			{
+				active = false
+			}
+		case <-ticker.C:
+			{
+				timeout := time.Duration(atomic.LoadInt64(&(mng.taskTimeout)))
+				for _, cid := range rpcManager.ExpiredTasks(timeout) {
+					stat.AddOneMsg("breaker_task_timeout")
+					if rpcManager.Breakers.Failure(cid) {
+						stat.AddOneMsg("breaker_open")
+						rllogger.Outputf(rllogger.LogWarn, "Circuit breaker opened for %s (timeout)", cid)
+					}
+					if rpcManager.CompleteDrain(cid) {
+						stat.AddOneMsg("server_drained")
+						rllogger.Outputf(rllogger.LogInfo, "Server %s drained.", cid)
+						mng.SendToConnection(cid, coreprocessing.NewDrainedCoreInstruction(cid))
+					}
+				}
+			}
+		}
+	}
+}
+
 type outChannelGroup struct {
 	helpers.AsyncSafeObject
 	channels map[int64]*chan coreprocessing.CoreInstruction
+	// instructions for sessions without connection, sent after resumption
+	parked map[int64][]coreprocessing.CoreInstruction
+}
+
+// groups of all resource indexes, created before connections
+func newOutChannelGroups() []*outChannelGroup {
+	groups := make([]*outChannelGroup, connectionsupport.GroupCount+1)
+	for index := 1; index < len(groups); index++ {
+		groups[index] = newOutChannelGroup()
+	}
+	return groups
+}
+
+// nil for index out of range (cid from message)
+func getOutChannelGroup(groups []*outChannelGroup, index int) *outChannelGroup {
+	if index < 1 || index >= len(groups) {
+		return nil
+	}
+	return groups[index]
 }
 
 func newOutChannelGroup() *outChannelGroup {
 	objPtr := helpers.NewAsyncSafeObject()
 	group := outChannelGroup{
 		AsyncSafeObject: *objPtr,
-		channels:        make(map[int64]*chan coreprocessing.CoreInstruction)}
+		channels:        make(map[int64]*chan coreprocessing.CoreInstruction),
+		parked:          make(map[int64][]coreprocessing.CoreInstruction)}
 	return &group
 }
 
@@ -78,14 +151,79 @@ func (group *outChannelGroup) put(id int64, channelPtr *chan coreprocessing.Core
 
 func (group *outChannelGroup) Send(id int64, instruction *coreprocessing.CoreInstruction) bool {
 	group.Lock(false)
-	defer group.Unlock(false)
 	channelPtr, exists := (*group).channels[id]
 	if exists {
 		(*channelPtr) <- (*instruction)
 	}
+	group.Unlock(false)
+	if !exists {
+		exists = group.queue(id, instruction)
+	}
+	return exists
+}
+
+// false if channel is full or connection is parked
+func (group *outChannelGroup) TrySend(id int64, instruction *coreprocessing.CoreInstruction) bool {
+	group.Lock(false)
+	defer group.Unlock(false)
+	if channelPtr, exists := (*group).channels[id]; exists {
+		select {
+		case (*channelPtr) <- (*instruction):
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+func (group *outChannelGroup) queue(id int64, instruction *coreprocessing.CoreInstruction) bool {
+	group.Lock(true)
+	channelPtr, resumed := (*group).channels[id]
+	queue, exists := (*group).parked[id]
+	if !resumed && exists {
+		if len(queue) < parkedQueueSize {
+			(*group).parked[id] = append(queue, *instruction)
+		} else {
+			rllogger.Outputf(rllogger.LogWarn, "Queue of parked session %d is full.", id)
+		}
+	}
+	group.Unlock(true)
+	if resumed {
+		// resumed already, writer can be slow
+		(*channelPtr) <- (*instruction)
+		return true
+	}
 	return exists
 }
 
+// instructions queued until resume
+func (group *outChannelGroup) Park(id int64) {
+	group.Lock(true)
+	defer group.Unlock(true)
+	delete((*group).channels, id)
+	(*group).parked[id] = nil
+}
+
+// new channel of parked session gets queued instructions,
+// they are sent without lock, session is parked until queue is empty
+func (group *outChannelGroup) Resume(id int64, channelPtr *chan coreprocessing.CoreInstruction) {
+	for {
+		group.Lock(true)
+		queue := (*group).parked[id]
+		if len(queue) == 0 {
+			delete((*group).parked, id)
+			(*group).channels[id] = channelPtr
+			group.Unlock(true)
+			return
+		}
+		(*group).parked[id] = nil
+		group.Unlock(true)
+		for _, instruction := range queue {
+			(*channelPtr) <- instruction
+		}
+	}
+}
+
 func (group *outChannelGroup) Append(id int64, channelPtr *chan coreprocessing.CoreInstruction) {
 	if !group.exists(id) {
 		group.put(id, channelPtr)
@@ -93,11 +231,21 @@ func (group *outChannelGroup) Append(id int64, channelPtr *chan coreprocessing.C
 }
 
 func (group *outChannelGroup) Remove(id int64) {
-	if group.exists(id) {
-		group.Lock(true)
-		defer group.Unlock(true)
-		delete((*group).channels, id)
+	group.Lock(true)
+	defer group.Unlock(true)
+	delete((*group).channels, id)
+	delete((*group).parked, id)
+}
+
+// instructions waiting for writers of connections
+func (group *outChannelGroup) pending() int {
+	group.Lock(false)
+	defer group.Unlock(false)
+	count := 0
+	for _, channelPtr := range (*group).channels {
+		count += len(*channelPtr)
 	}
+	return count
 }
 
 func (group *outChannelGroup) SendExit() {
@@ -113,24 +261,63 @@ type CoreWorkerManager struct {
 	options                 options.SysOption
 	OutSignalChannel        chan bool
 	workerStopSignalChannel chan bool
+	timeoutStopChannel      chan bool
+	doneChannel             chan struct{}
 	instructionsChannel     chan coreprocessing.CoreInstruction
+	optionChannels          []chan options.SysOption
 	outChannels             []*outChannelGroup
-	// onсe instance everywhere
-	methodsDict *coreprocessing.MethodInstructionDict
-	statistic   statistic.StatisticUpdater
+	// processing of broker instance
+	core       *coreprocessing.Core
+	statistic  statistic.StatisticUpdater
+	limiter    *ratelimit.Limiter
+	accounting *accounting.Accounting
+	acl        *acl.AccessList
+	keys       *keyregistry.Registry
+	replay     *cryptosupport.ReplayCache
+	challenges *cryptosupport.ChallengeDict
+	// atomic values
+	taskTimeout  int64
+	shuttingDown int32
+	stopped      int32
 }
 
-func NewCoreWorkerManager(option options.SysOption, stat *statistic.Statistic) *CoreWorkerManager {
+func NewCoreWorkerManager(
+	core *coreprocessing.Core,
+	option options.SysOption,
+	stat *statistic.Statistic,
+	acc *accounting.Accounting,
+	accessList *acl.AccessList,
+	keys *keyregistry.Registry) *CoreWorkerManager {
+	//
 	// setup statistic items
 	stat.AddItem("processed", "Processed messages count")
 	stat.AddItem("skip_cmd", "Command with skip instruction count")
+	stat.AddItem("breaker_open", "Circuit breaker open count")
+	stat.AddItem("breaker_task_timeout", "Task without result (timeout) count")
+	stat.AddItem("breaker_error_result", "Task with error result count")
+	stat.AddItem("server_drained", "Servers drained count")
+	stat.AddItem("rejected_shutdown", "Calls rejected while shutting down count")
+	stat.AddItem("rate_limited", "Commands rejected by rate limit count")
+	stat.AddItem("rejected_anonymous", "Commands rejected without auth count")
+	core.RpcManager.Breakers.Setup(
+		option.BreakerThreshold, option.GetBreakerOpenTime())
 	manager := CoreWorkerManager{
 		OutSignalChannel:        make(chan bool, 1),
 		workerStopSignalChannel: make(chan bool, option.Workers),
+		timeoutStopChannel:      make(chan bool, 1),
+		doneChannel:             make(chan struct{}),
 		instructionsChannel:     make(chan coreprocessing.CoreInstruction, option.BufferSize),
-		outChannels:             make([]*outChannelGroup, connectionsupport.GroupCount),
-		methodsDict:             coreprocessing.NewMethodInstructionDict(),
+		optionChannels:          make([]chan options.SysOption, option.Workers),
+		outChannels:             newOutChannelGroups(),
+		core:                    core,
 		statistic:               stat,
+		limiter:                 ratelimit.NewLimiter(option.RateLimits),
+		accounting:              acc,
+		acl:                     accessList,
+		keys:                    keys,
+		replay:                  cryptosupport.NewReplayCache(),
+		challenges:              cryptosupport.NewChallengeDict(),
+		taskTimeout:             int64(option.GetTaskTimeout()),
 		options:                 option}
 	return &manager
 }
@@ -140,26 +327,105 @@ func (mng *CoreWorkerManager) Start(handlerSetuper coreprocessing.HandlerConfigu
 	count := manager.options.Workers
 	taskIdGenerator := helpers.NewTaskIdGenerator()
 	for index := 0; index < count; index++ {
-		handler := coreprocessing.NewHandler(index, manager.options, manager.statistic)
+		handler := coreprocessing.NewHandler(manager.core, index, manager.options, manager.statistic)
 		handler.TaskIdGenerator = taskIdGenerator
+		handler.Accounting = manager.accounting
+		handler.Acl = manager.acl
+		handler.Keys = manager.keys
+		handler.Replay = manager.replay
+		handler.Challenges = manager.challenges
 		handlerSetuper.WorkerHandlerConfigure(handler)
+		manager.optionChannels[index] = make(chan options.SysOption, 1)
 		go worker(
 			index+1,
 			&(manager.instructionsChannel),
 			&(manager.workerStopSignalChannel),
+			manager.optionChannels[index],
 			&(manager.outChannels),
 			handler)
 	}
+	go mng.taskTimeoutProcessing()
+}
+
+// apply changed options to workers, count of workers can't be changed
+func (mng *CoreWorkerManager) Reload(option options.SysOption) {
+	if atomic.LoadInt32(&(mng.stopped)) > 0 {
+		return
+	}
+	(*mng).core.RpcManager.Breakers.Setup(
+		option.BreakerThreshold, option.GetBreakerOpenTime())
+	atomic.StoreInt64(&(mng.taskTimeout), int64(option.GetTaskTimeout()))
+	(*mng).limiter.Setup(option.RateLimits)
+	(*mng).accounting.Setup(option.Quotas)
+	if err := (*mng).acl.Load(option.GetAclFile()); err != nil {
+		rllogger.Outputf(rllogger.LogWarn, "ACL not reloaded: %s", err)
+	}
+	(*mng).keys.Reload(option)
+	for _, optionChannel := range (*mng).optionChannels {
+		if optionChannel != nil {
+			// busy worker takes last option only
+			select {
+			case <-optionChannel:
+			default:
+			}
+			select {
+			case optionChannel <- option:
+			default:
+			}
+		}
+	}
+}
+
+// reject new calls and wait for tasks in progress and their delivery,
+// not taken results are kept by result store
+func (mng *CoreWorkerManager) Shutdown(timeout time.Duration) bool {
+	atomic.StoreInt32(&(mng.shuttingDown), 1)
+	rpcManager := (*mng).core.RpcManager
+	deadline := time.Now().Add(timeout)
+	tasks := rpcManager.TaskTotal()
+	pending := mng.pending()
+	for (tasks > 0 || pending > 0) && time.Now().Before(deadline) {
+		time.Sleep(shutdownCheckPeriod)
+		tasks = rpcManager.TaskTotal()
+		pending = mng.pending()
+	}
+	if tasks > 0 || pending > 0 {
+		rllogger.Outputf(
+			rllogger.LogWarn, "Shutdown timeout, lost tasks: %d not delivered: %d", tasks, pending)
+		return false
+	}
+	return true
+}
+
+// instructions for workers and for connections
+func (mng *CoreWorkerManager) pending() int {
+	count := len((*mng).instructionsChannel)
+	for _, groupPtr := range (*mng).outChannels {
+		if groupPtr != nil {
+			count += groupPtr.pending()
+		}
+	}
+	return count
+}
+
+func (mng *CoreWorkerManager) Core() *coreprocessing.Core {
+	return (*mng).core
+}
+
+func (mng *CoreWorkerManager) IsShuttingDown() bool {
+	return atomic.LoadInt32(&(mng.shuttingDown)) > 0
 }
 
 func (mng *CoreWorkerManager) Stop() {
+	atomic.StoreInt32(&(mng.stopped), 1)
+	close((*mng).doneChannel)
 	manager := *mng
 	count := manager.options.Workers
 	for index := 0; index < count; index++ {
 		manager.workerStopSignalChannel <- true
 	}
+	manager.timeoutStopChannel <- true
 	rllogger.Output(rllogger.LogInfo, "Stoping workers..")
-	close(manager.instructionsChannel)
 	close(manager.workerStopSignalChannel)
 	for _, groupPtr := range manager.outChannels {
 		if groupPtr != nil {
@@ -181,18 +447,52 @@ func (mng *CoreWorkerManager) AppendBackChannel(
 	connData *connectionsupport.ConnectionData,
 	backChannel *chan coreprocessing.CoreInstruction) {
 	//
-	index := connData.GetResourceIndex()
-	if mng.outChannels[index] == nil {
-		mng.outChannels[index] = newOutChannelGroup()
+	if group := getOutChannelGroup(mng.outChannels, connData.GetResourceIndex()); group != nil {
+		group.Append(connData.GetId(), backChannel)
 	}
-	mng.outChannels[index].Append(connData.GetId(), backChannel)
 }
 
 func (mng *CoreWorkerManager) RemoveBackChannel(connData *connectionsupport.ConnectionData) {
-	index := connData.GetResourceIndex()
-	if mng.outChannels[index] != nil {
-		mng.outChannels[index].Remove(connData.GetId())
+	if group := getOutChannelGroup(mng.outChannels, connData.GetResourceIndex()); group != nil {
+		group.Remove(connData.GetId())
+	}
+}
+
+// connection of session closed, instructions for it wait resumption
+func (mng *CoreWorkerManager) ParkBackChannel(connData *connectionsupport.ConnectionData) {
+	if group := getOutChannelGroup(mng.outChannels, connData.GetResourceIndex()); group != nil {
+		group.Park(connData.GetId())
+	}
+}
+
+// parked session continued with new connection
+func (mng *CoreWorkerManager) ResumeBackChannel(
+	connData *connectionsupport.ConnectionData,
+	backChannel *chan coreprocessing.CoreInstruction) {
+	//
+	if group := getOutChannelGroup(mng.outChannels, connData.GetResourceIndex()); group != nil {
+		group.Resume(connData.GetId(), backChannel)
+	}
+}
+
+// send instruction to connection back channel directly
+func (mng *CoreWorkerManager) SendToConnection(cid string, instruction *coreprocessing.CoreInstruction) bool {
+	if index, id, err := connectionsupport.ExtractConnectionDataIndexAndId(cid); err == nil {
+		if groupPtr := getOutChannelGroup(mng.outChannels, index); groupPtr != nil {
+			return groupPtr.Send(id, instruction)
+		}
+	}
+	return false
+}
+
+// send without wait, writer of connection can be stuck
+func (mng *CoreWorkerManager) TrySendToConnection(cid string, instruction *coreprocessing.CoreInstruction) bool {
+	if index, id, err := connectionsupport.ExtractConnectionDataIndexAndId(cid); err == nil {
+		if groupPtr := getOutChannelGroup(mng.outChannels, index); groupPtr != nil {
+			return groupPtr.TrySend(id, instruction)
+		}
 	}
+	return false
 }
 
 func (mng *CoreWorkerManager) Processing(
@@ -201,10 +501,43 @@ func (mng *CoreWorkerManager) Processing(
 	connData *connectionsupport.ConnectionData) {
 	// select instraction type by method of command
 	instruction := coreprocessing.NewCoreInstructionForMessage(
-		mng.methodsDict.Get((*cmd).Method), (*connData).Cid, cmd)
+		mng.core.MethodsDict.Get((*cmd).Method), (*connData).Cid, cmd)
 
+	if atomic.LoadInt32(&(mng.stopped)) > 0 {
+		// workers don't wait anymore
+		return
+	}
 	if instruction.Type == coreprocessing.TypeInstructionSkip {
 		mng.statistic.SendMsg("skip_cmd", 1)
 	}
-	mng.instructionsChannel <- (*instruction)
+	if instruction.Type == coreprocessing.TypeInstructionExternal && mng.IsShuttingDown() {
+		mng.statistic.AddOneMsg("rejected_shutdown")
+		mng.reject(instruction, instruction.MakeErrAnswer(
+			transport.ErrorCodeShuttingDown, "Service is shutting down."))
+		return
+	}
+	cid := (*connData).Cid
+	if allow, wait := mng.limiter.Allow(
+		connDataManager.GetKeyName(cid), connDataManager.GetGroup(cid), (*cmd).Method); !allow {
+		//
+		mng.statistic.AddOneMsg("rate_limited")
+		mng.reject(instruction, instruction.MakeErrAnswerWithData(
+			transport.ErrorCodeRateLimited,
+			"Rate limit exceeded.",
+			map[string]float64{"retry_after": wait.Seconds()}))
+		return
+	}
+	// workers don't wait after stop, buffer can be full
+	select {
+	case mng.instructionsChannel <- (*instruction):
+	case <-mng.doneChannel:
+	}
+}
+
+// answer without workers
+func (mng *CoreWorkerManager) reject(instruction *coreprocessing.CoreInstruction, answer *transport.Answer) {
+	outIns := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionProblem)
+	outIns.Cid = instruction.Cid
+	outIns.SetAnswer(answer)
+	mng.SendToConnection(instruction.Cid, outIns)
 }
@@ -0,0 +1,79 @@
+package coresupport_test
+
+import (
+	"roolet/connectionsupport"
+	"roolet/coreprocessing"
+	"roolet/coresupport"
+	"roolet/options"
+	"roolet/statistic"
+	"roolet/transport"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestManager() *coresupport.CoreWorkerManager {
+	option := options.SysOption{Statistic: false, Workers: 1, BufferSize: 1}
+	return coresupport.NewCoreWorkerManager(
+		coreprocessing.NewCore(), option, statistic.NewStatistic(option), nil, nil, nil)
+}
+
+func TestTrySendToFullChannel(t *testing.T) {
+	manager := newTestManager()
+	connData := connectionsupport.NewConnectionDataManager(options.SysOption{}).NewConnection()
+	backChannel := make(chan coreprocessing.CoreInstruction, 1)
+	manager.AppendBackChannel(connData, &backChannel)
+	ping := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionPing)
+	ping.SetCommand(transport.NewCommand(0, connData.Cid, "ping", ""))
+	if !manager.TrySendToConnection(connData.Cid, ping) {
+		t.Fatal("Ping must be sent to empty channel.")
+	}
+	done := make(chan bool)
+	go func() { done <- manager.TrySendToConnection(connData.Cid, ping) }()
+	select {
+	case sent := <-done:
+		if sent {
+			t.Error("Ping can't be sent to full channel.")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send to full channel blocked.")
+	}
+	manager.ParkBackChannel(connData)
+	<-backChannel
+	if manager.TrySendToConnection(connData.Cid, ping) {
+		t.Error("Ping can't be sent to parked connection.")
+	}
+}
+
+func TestConcurrentBackChannels(t *testing.T) {
+	manager := newTestManager()
+	dataManager := connectionsupport.NewConnectionDataManager(options.SysOption{})
+	// connections of several resource indexes
+	count := connectionsupport.ResourcesGroupSize * 3
+	connections := make([]*connectionsupport.ConnectionData, count)
+	channels := make([]chan coreprocessing.CoreInstruction, count)
+	for index := range connections {
+		connections[index] = dataManager.NewConnection()
+		channels[index] = make(chan coreprocessing.CoreInstruction, 1)
+	}
+	var wait sync.WaitGroup
+	for index := range connections {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			manager.AppendBackChannel(connections[index], &channels[index])
+		}(index)
+	}
+	wait.Wait()
+	ping := coreprocessing.NewCoreInstruction(coreprocessing.TypeInstructionPing)
+	for _, connData := range connections {
+		if !manager.SendToConnection(connData.Cid, ping) {
+			t.Fatalf("Back channel of %s lost.", connData.Cid)
+		}
+	}
+	for _, cid := range []string{"a-1-0", "a-1--5", "a-1-100000"} {
+		if manager.SendToConnection(cid, ping) || manager.TrySendToConnection(cid, ping) {
+			t.Errorf("Instruction sent to unknown connection %s.", cid)
+		}
+	}
+}
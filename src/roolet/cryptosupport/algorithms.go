@@ -0,0 +1,105 @@
+package cryptosupport
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// "alg" values of token header
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmHS256 = "HS256"
+)
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// Ed25519 signatures (jwt-go hasn't it)
+type signingMethodEdDSA struct{}
+
+var signingMethodEd25519 = &signingMethodEdDSA{}
+
+func (method *signingMethodEdDSA) Alg() string {
+	return AlgorithmEdDSA
+}
+
+func (method *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := decodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (method *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	sig := ed25519.Sign(privateKey, []byte(signingString))
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func getSigningMethod(alg string) (jwt.SigningMethod, bool) {
+	switch alg {
+	case AlgorithmRS256:
+		return jwt.SigningMethodRS256, true
+	case AlgorithmES256:
+		return jwt.SigningMethodES256, true
+	case AlgorithmEdDSA:
+		return signingMethodEd25519, true
+	case AlgorithmHS256:
+		return jwt.SigningMethodHS256, true
+	}
+	return nil, false
+}
+
+// method by type of private or public key, []byte is secret for HMAC
+func methodOfKey(key interface{}) (jwt.SigningMethod, error) {
+	var alg string
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		alg = AlgorithmRS256
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+		alg = AlgorithmES256
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		alg = AlgorithmEdDSA
+	case []byte:
+		alg = AlgorithmHS256
+	default:
+		return nil, errors.New(fmt.Sprintf("Key type %T not supported.", key))
+	}
+	method, _ := getSigningMethod(alg)
+	return method, nil
+}
+
+// "alg" from token header, empty if header isn't JSON
+func TokenAlgorithm(token string) string {
+	parts := strings.Split(token, ".")
+	header := tokenHeader{}
+	if data, err := decodeSegment(parts[0]); err == nil {
+		if err := json.Unmarshal(data, &header); err == nil {
+			return header.Alg
+		}
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package cryptosupport_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"roolet/cryptosupport"
+	"roolet/options"
+	"testing"
+	"time"
+)
+
+func TestTokenAlgorithms(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	option := options.SysOption{Node: "node1"}
+	ecToken, _ := cryptosupport.CreateToken(ecKey, cryptosupport.NewClaims("client1", "node1", time.Minute))
+	if alg := cryptosupport.TokenAlgorithm(ecToken); alg != cryptosupport.AlgorithmES256 {
+		t.Errorf("Wrong algorithm of token: %s", alg)
+	}
+	if err := cryptosupport.CheckToken(&(ecKey.PublicKey), ecToken, "client1", option, nil); err != nil {
+		t.Errorf("ES256 token must be accepted: %s", err)
+	}
+	edToken, _ := cryptosupport.CreateToken(edPrivate, cryptosupport.NewClaims("client1", "node1", time.Minute))
+	if err := cryptosupport.CheckToken(edPublic, edToken, "client1", option, nil); err != nil {
+		t.Errorf("EdDSA token must be accepted: %s", err)
+	}
+	// key of other type
+	checkReason(t, cryptosupport.CheckToken(edPublic, ecToken, "client1", option, nil), cryptosupport.ReasonSignature)
+
+	option.Tokens.Algorithms = []string{"RS256"}
+	checkReason(t, cryptosupport.CheckToken(edPublic, edToken, "client1", option, nil), cryptosupport.ReasonAlgorithm)
+
+	// HMAC mode
+	option.Secret = "secret1"
+	hsToken, _ := cryptosupport.CreateToken([]byte(option.Secret), cryptosupport.NewClaims("client1", "node1", time.Minute))
+	checkReason(t, cryptosupport.CheckToken(nil, hsToken, "client1", option, nil), cryptosupport.ReasonAlgorithm)
+	option.Tokens.Algorithms = []string{"HS256"}
+	if err := cryptosupport.CheckToken(nil, hsToken, "client1", option, nil); err != nil {
+		t.Errorf("HS256 token must be accepted: %s", err)
+	}
+	option.Secret = "secret2"
+	checkReason(t, cryptosupport.CheckToken(nil, hsToken, "client1", option, nil), cryptosupport.ReasonSignature)
+
+	der, _ := x509.MarshalPKIXPublicKey(edPublic)
+	key, err := options.ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if _, ok := key.(ed25519.PublicKey); err != nil || !ok {
+		t.Errorf("Ed25519 public key must be loaded: %s", err)
+	}
+}
@@ -0,0 +1,92 @@
+package cryptosupport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"roolet/helpers"
+	"time"
+)
+
+const (
+	// auth modes
+	AuthModeToken = "token"
+	AuthModeHmac  = "hmac"
+	// nonce must be used before it
+	challengeLifetime = time.Minute
+	challengeSize     = 24
+)
+
+type challenge struct {
+	nonce  string
+	expire time.Time
+}
+
+// server nonce of connection for challenge auth, used once
+type ChallengeDict struct {
+	helpers.AsyncSafeObject
+	challenges map[string]challenge
+	newCount   int
+}
+
+func NewChallengeDict() *ChallengeDict {
+	dict := ChallengeDict{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		challenges:      make(map[string]challenge)}
+	return &dict
+}
+
+// new nonce of connection, previous one isn't valid after it
+func (dict *ChallengeDict) Issue(cid string) (string, error) {
+	buf := make([]byte, challengeSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(buf)
+	now := time.Now()
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	(*dict).challenges[cid] = challenge{nonce: nonce, expire: now.Add(challengeLifetime)}
+	(*dict).newCount++
+	// nonces of closed connections
+	if (*dict).newCount >= replayCleanupCount {
+		(*dict).newCount = 0
+		for name, item := range (*dict).challenges {
+			if !now.Before(item.expire) {
+				delete((*dict).challenges, name)
+			}
+		}
+	}
+	return nonce, nil
+}
+
+// nonce of connection if it isn't expired, removed anyway
+func (dict *ChallengeDict) Take(cid string) (string, bool) {
+	dict.Lock(true)
+	defer dict.Unlock(true)
+	item, exists := (*dict).challenges[cid]
+	if !exists {
+		return "", false
+	}
+	delete((*dict).challenges, cid)
+	return item.nonce, time.Now().Before(item.expire)
+}
+
+// hex of HMAC-SHA256 over nonce
+func ChallengeResponse(secret []byte, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func CheckChallenge(secret []byte, nonce, response string) error {
+	if len(secret) == 0 {
+		return newAuthError(ReasonKey, "Secret of key is empty.")
+	}
+	expected := ChallengeResponse(secret, nonce)
+	if !hmac.Equal([]byte(expected), []byte(response)) {
+		return newAuthError(ReasonSignature, "Challenge response is wrong.")
+	}
+	return nil
+}
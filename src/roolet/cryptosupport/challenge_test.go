@@ -0,0 +1,34 @@
+package cryptosupport_test
+
+import (
+	"roolet/cryptosupport"
+	"testing"
+)
+
+func TestChallengeAuth(t *testing.T) {
+	dict := cryptosupport.NewChallengeDict()
+	cid := "abcd-0000000000000001-1"
+	secret := []byte("secret1")
+	first, err := dict.Issue(cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, _ := dict.Issue(cid)
+	if first == nonce {
+		t.Error("Each challenge must have new nonce.")
+	}
+	taken, ok := dict.Take(cid)
+	if !ok || taken != nonce {
+		t.Fatalf("Last nonce expected: %s", taken)
+	}
+	if _, ok := dict.Take(cid); ok {
+		t.Error("Nonce must be used once.")
+	}
+	response := cryptosupport.ChallengeResponse(secret, nonce)
+	if err := cryptosupport.CheckChallenge(secret, nonce, response); err != nil {
+		t.Errorf("Response must be accepted: %s", err)
+	}
+	checkReason(t, cryptosupport.CheckChallenge([]byte("secret2"), nonce, response), cryptosupport.ReasonSignature)
+	checkReason(t, cryptosupport.CheckChallenge(secret, first, response), cryptosupport.ReasonSignature)
+	checkReason(t, cryptosupport.CheckChallenge(nil, nonce, response), cryptosupport.ReasonKey)
+}
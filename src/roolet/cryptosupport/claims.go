@@ -0,0 +1,217 @@
+package cryptosupport
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"roolet/helpers"
+	"roolet/options"
+	"strings"
+	"time"
+)
+
+const (
+	// reasons of auth failure
+	ReasonKey         = "key"
+	ReasonMalformed   = "malformed"
+	ReasonSignature   = "signature"
+	ReasonAlgorithm   = "algorithm"
+	ReasonExpired     = "expired"
+	ReasonNotYetValid = "not_yet_valid"
+	ReasonIssuedAt    = "issued_at"
+	ReasonLifetime    = "lifetime"
+	ReasonAudience    = "audience"
+	ReasonIssuer      = "issuer"
+	ReasonNoJti       = "jti_missing"
+	ReasonReplay      = "replay"
+	ReasonChallenge   = "challenge"
+	// cleanup of replay cache after count of new tokens
+	replayCleanupCount = 1024
+)
+
+// failure with reason for answer data
+type AuthError struct {
+	Reason  string
+	Message string
+}
+
+func (authErr *AuthError) Error() string {
+	return authErr.Message
+}
+
+func newAuthError(reason, format string, args ...interface{}) *AuthError {
+	result := AuthError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+	return &result
+}
+
+// "aud" as string or list of strings
+type Audience []string
+
+func (aud *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*aud = Audience(list)
+	return nil
+}
+
+func (aud Audience) Contains(name string) bool {
+	for _, value := range aud {
+		if value == name {
+			return true
+		}
+	}
+	return false
+}
+
+// registered claims of auth token, times in unix seconds
+type Claims struct {
+	Iss string   `json:"iss"`
+	Aud Audience `json:"aud"`
+	Exp int64    `json:"exp"`
+	Nbf int64    `json:"nbf,omitempty"`
+	Iat int64    `json:"iat"`
+	Jti string   `json:"jti"`
+}
+
+// claims of new token from issuer (key name) to node
+func NewClaims(issuer, audience string, lifetime time.Duration) Claims {
+	now := time.Now()
+	return Claims{
+		Iss: issuer,
+		Aud: Audience{audience},
+		Iat: now.Unix(),
+		Exp: now.Add(lifetime).Unix(),
+		Jti: helpers.NewSystemRandom().CreatePassword(32)}
+}
+
+// padding is optional
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// claims from payload of token, signature isn't checked
+func ParseClaims(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, newAuthError(ReasonMalformed, "Token must have 3 parts.")
+	}
+	data, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, newAuthError(ReasonMalformed, "Payload decode problem: %s", err)
+	}
+	claims := Claims{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, newAuthError(ReasonMalformed, "Payload isn't claims object: %s", err)
+	}
+	return &claims, nil
+}
+
+// standard claims of token from key for this node
+func CheckClaims(claims *Claims, keyName string, option options.SysOption, now time.Time) error {
+	maxAge := option.GetTokenMaxAge()
+	leeway := option.GetTokenLeeway()
+	unixNow := now.Unix()
+	if claims.Exp == 0 || claims.Iat == 0 {
+		return newAuthError(ReasonMalformed, "Claims 'exp' and 'iat' required.")
+	}
+	if unixNow >= claims.Exp+int64(leeway.Seconds()) {
+		return newAuthError(ReasonExpired, "Token expired.")
+	}
+	if claims.Nbf > 0 && unixNow < claims.Nbf-int64(leeway.Seconds()) {
+		return newAuthError(ReasonNotYetValid, "Token not valid yet.")
+	}
+	if claims.Iat > unixNow+int64(leeway.Seconds()) || unixNow-claims.Iat > int64(maxAge.Seconds()) {
+		return newAuthError(ReasonIssuedAt, "Token issued at wrong time.")
+	}
+	if claims.Exp-claims.Iat > int64(maxAge.Seconds()) {
+		return newAuthError(ReasonLifetime, "Token lifetime more than %s.", maxAge)
+	}
+	if !claims.Aud.Contains(option.Node) {
+		return newAuthError(ReasonAudience, "Token audience isn't '%s'.", option.Node)
+	}
+	if !option.IsTokenIssuer(claims.Iss, keyName) {
+		return newAuthError(ReasonIssuer, "Token issuer '%s' not accepted.", claims.Iss)
+	}
+	if len(claims.Jti) == 0 {
+		return newAuthError(ReasonNoJti, "Claim 'jti' required.")
+	}
+	return nil
+}
+
+// used token ids until expiration
+type ReplayCache struct {
+	helpers.AsyncSafeObject
+	tokens   map[string]time.Time
+	newCount int
+}
+
+func NewReplayCache() *ReplayCache {
+	cache := ReplayCache{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		tokens:          make(map[string]time.Time)}
+	return &cache
+}
+
+// false if token id of key used already
+func (cache *ReplayCache) Use(keyName, jti string, expire time.Time) bool {
+	cache.Lock(true)
+	defer cache.Unlock(true)
+	now := time.Now()
+	name := keyName + "/" + jti
+	if tokenExpire, exists := (*cache).tokens[name]; exists && now.Before(tokenExpire) {
+		return false
+	}
+	(*cache).tokens[name] = expire
+	(*cache).newCount++
+	if (*cache).newCount >= replayCleanupCount {
+		(*cache).newCount = 0
+		for name, tokenExpire := range (*cache).tokens {
+			if !now.Before(tokenExpire) {
+				delete((*cache).tokens, name)
+			}
+		}
+	}
+	return true
+}
+
+func (cache *ReplayCache) Size() int {
+	cache.Lock(false)
+	defer cache.Unlock(false)
+	return len((*cache).tokens)
+}
+
+// signature, claims and replay of token from key,
+// tokens without claims accepted only in legacy mode
+func CheckToken(
+	key crypto.PublicKey,
+	token, keyName string,
+	option options.SysOption,
+	replay *ReplayCache) error {
+	//
+	if err := Check(key, token, option); err != nil {
+		return err
+	}
+	claims, err := ParseClaims(token)
+	if err != nil {
+		if option.Tokens.Legacy {
+			return nil
+		}
+		return err
+	}
+	if err := CheckClaims(claims, keyName, option, time.Now()); err != nil {
+		return err
+	}
+	expire := time.Unix(claims.Exp, 0).Add(option.GetTokenLeeway())
+	if replay != nil && !replay.Use(keyName, claims.Jti, expire) {
+		return newAuthError(ReasonReplay, "Token used already.")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package cryptosupport_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"roolet/cryptosupport"
+	"roolet/options"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func checkReason(t *testing.T, err error, reason string) {
+	if authErr, ok := err.(*cryptosupport.AuthError); !ok || authErr.Reason != reason {
+		t.Errorf("Expected reason '%s', error: %v", reason, err)
+	}
+}
+
+func TestTokenClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	option := options.SysOption{Node: "node1"}
+	replay := cryptosupport.NewReplayCache()
+	token, err := cryptosupport.CreateToken(key, cryptosupport.NewClaims("client1", "node1", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cryptosupport.CheckToken(&(key.PublicKey), token, "client1", option, replay); err != nil {
+		t.Fatalf("Token must be accepted: %s", err)
+	}
+	checkReason(t, cryptosupport.CheckToken(&(key.PublicKey), token, "client1", option, replay), cryptosupport.ReasonReplay)
+	checkReason(t, cryptosupport.CheckToken(&(key.PublicKey), token, "client2", option, nil), cryptosupport.ReasonIssuer)
+	otherNode := options.SysOption{Node: "node2"}
+	checkReason(t, cryptosupport.CheckToken(&(key.PublicKey), token, "client1", otherNode, nil), cryptosupport.ReasonAudience)
+
+	claims := cryptosupport.NewClaims("client1", "node1", time.Minute)
+	claims.Exp = time.Now().Add(-time.Hour).Unix()
+	claims.Iat = claims.Exp - 10
+	token, _ = cryptosupport.CreateToken(key, claims)
+	checkReason(t, cryptosupport.CheckToken(&(key.PublicKey), token, "client1", option, nil), cryptosupport.ReasonExpired)
+
+	claims = cryptosupport.NewClaims("client1", "node1", time.Hour)
+	token, _ = cryptosupport.CreateToken(key, claims)
+	checkReason(t, cryptosupport.CheckToken(&(key.PublicKey), token, "client1", option, nil), cryptosupport.ReasonLifetime)
+
+	claims = cryptosupport.NewClaims("client1", "node1", time.Minute)
+	claims.Jti = ""
+	token, _ = cryptosupport.CreateToken(key, claims)
+	checkReason(t, cryptosupport.CheckToken(&(key.PublicKey), token, "client1", option, nil), cryptosupport.ReasonNoJti)
+}
+
+func TestLegacyToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// random parts without claims, as old clients
+	mainPart := "cmFuZG9tMQ==.cmFuZG9tMg=="
+	sig, err := jwt.SigningMethodRS256.Sign(mainPart, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := len(sig) % 4; size > 0 {
+		sig += strings.Repeat("=", 4-size)
+	}
+	token := mainPart + "." + sig
+	option := options.SysOption{Node: "node1"}
+	checkReason(t, cryptosupport.CheckToken(&(key.PublicKey), token, "client1", option, nil), cryptosupport.ReasonMalformed)
+	option.Tokens.Legacy = true
+	if err := cryptosupport.CheckToken(&(key.PublicKey), token, "client1", option, nil); err != nil {
+		t.Errorf("Token without claims must be accepted in legacy mode: %s", err)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	checkReason(t, cryptosupport.CheckToken(&(other.PublicKey), token, "client1", option, nil), cryptosupport.ReasonSignature)
+}
@@ -1,50 +1,129 @@
 package cryptosupport
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"encoding/base64"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"log"
 	"roolet/helpers"
 	"roolet/options"
 	"strings"
-
-	"github.com/dgrijalva/jwt-go"
+	"time"
 )
 
-// Howto create key? Use openssl :)
+const nodeTokenLifetime = time.Minute
+
+// Howto create key? Use keygen tool (-tool keygen -data rsa|ec|ed25519)
+// or openssl :)
 // $openssl genpkey -outform PEM -algorithm RSA -out key.priv -pkeyopt rsa_keygen_bits:1024
 // and public key extract from it
 // $openssl rsa -in key.priv -out key.pub -pubout
+// ECDSA (ES256) and Ed25519 (EdDSA) keys:
+// $openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -out key.priv
+// $openssl genpkey -algorithm ED25519 -out key.priv
+// $openssl pkey -in key.priv -out key.pub -pubout
 
-// simple ckeck token
-func Check(key *rsa.PublicKey, token string) error {
+// signature of token by algorithm from header (see SysOption.IsTokenAlgorithm),
+// key is public key of client or nil for HS256 (secret of node used)
+func Check(key crypto.PublicKey, token string, option options.SysOption) error {
 	parts := strings.Split(token, ".")
-	if len(parts) == 3 {
-		if _, err := base64.URLEncoding.DecodeString(parts[2]); err == nil {
-			if err := jwt.SigningMethodRS256.Verify(strings.Join(parts[0:2], "."), parts[2], key); err != nil {
-				return err
-			}
-		} else {
-			return errors.New(fmt.Sprintf("Base64 decode problem: %s with: '%s'.", err, parts[2]))
+	if len(parts) != 3 {
+		return newAuthError(ReasonMalformed, "Write a full token as tools data (3 parts).")
+	}
+	if _, err := decodeSegment(parts[2]); err != nil {
+		return newAuthError(ReasonMalformed, "Base64 decode problem: %s with: '%s'.", err, parts[2])
+	}
+	alg := TokenAlgorithm(token)
+	if len(alg) == 0 {
+		if !option.Tokens.Legacy {
+			return newAuthError(ReasonMalformed, "Token header without algorithm.")
 		}
-	} else {
-		return errors.New("Write a full token as tools data (3 parts).")
+		// old clients
+		alg = AlgorithmRS256
+	}
+	if !option.IsTokenAlgorithm(alg) {
+		return newAuthError(ReasonAlgorithm, "Algorithm '%s' not accepted.", alg)
+	}
+	method, exists := getSigningMethod(alg)
+	if !exists {
+		return newAuthError(ReasonAlgorithm, "Algorithm '%s' not supported.", alg)
+	}
+	if alg == AlgorithmHS256 {
+		if len(option.Secret) == 0 {
+			return newAuthError(ReasonAlgorithm, "Secret for HMAC tokens isn't set.")
+		}
+		key = []byte(option.Secret)
+	}
+	if err := method.Verify(strings.Join(parts[0:2], "."), parts[2], key); err != nil {
+		return newAuthError(ReasonSignature, "Signature check failed: %s", err)
 	}
 	return nil
 }
 
+// token with claims for auth by private key (RSA, ECDSA, Ed25519)
+// or by secret as []byte
+func CreateToken(key crypto.PrivateKey, claims Claims) (string, error) {
+	method, err := methodOfKey(key)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(tokenHeader{Alg: method.Alg(), Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	mainPart := fmt.Sprintf(
+		"%s.%s",
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(payload))
+	sig, err := method.Sign(mainPart, key)
+	if err != nil {
+		return "", err
+	}
+	// signature with padding for nodes with old check
+	sig = strings.TrimRight(sig, "=")
+	if size := len(sig) % 4; size > 0 {
+		sig += strings.Repeat("=", 4-size)
+	}
+	return fmt.Sprintf("%s.%s", mainPart, sig), nil
+}
+
+// key of node for own tokens, secret if node has no private key
+// and HS256 is accepted
+func GetSigningKey(option options.SysOption) (crypto.PrivateKey, error) {
+	key, err := option.GetPrivKey()
+	if err != nil && len(option.Secret) > 0 && option.IsTokenAlgorithm(AlgorithmHS256) {
+		return []byte(option.Secret), nil
+	}
+	return key, err
+}
+
+func getVerifyKey(option options.SysOption) (crypto.PublicKey, error) {
+	key, err := option.GetPubKey()
+	if err != nil && len(option.Secret) > 0 && option.IsTokenAlgorithm(AlgorithmHS256) {
+		return []byte(option.Secret), nil
+	}
+	return key, err
+}
+
 // Test create token from command line.
 func JwtCreate(data string, option *options.SysOption) {
-	if key, err := option.GetPrivKey(); err == nil {
+	if key, err := GetSigningKey(*option); err == nil {
 		parts := strings.Split(data, ".")
 		if len(parts) == 2 {
 			data := []string{
 				base64.StdEncoding.EncodeToString([]byte(parts[0])),
 				base64.StdEncoding.EncodeToString([]byte(parts[1]))}
 
-			sig, err := jwt.SigningMethodRS256.Sign(strings.Join(data, "."), key)
+			method, err := methodOfKey(key)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sig, err := method.Sign(strings.Join(data, "."), key)
 			if err == nil {
 				log.Printf(
 					"\nSignature: %s\n\nToken: %s\n",
@@ -63,12 +142,16 @@ func JwtCreate(data string, option *options.SysOption) {
 
 // Test check token from command line.
 func JwtCheck(data string, option *options.SysOption) {
-	if key, err := option.GetPubKey(); err == nil {
+	if key, err := getVerifyKey(*option); err == nil {
 		parts := strings.Split(data, ".")
 		if len(parts) == 3 {
 			if sigDta, err := base64.StdEncoding.DecodeString(parts[2]); err == nil {
 				sig := string(sigDta)
-				err := jwt.SigningMethodRS256.Verify(strings.Join(parts[0:2], "."), sig, key)
+				method, err := methodOfKey(key)
+				if err != nil {
+					log.Fatal(err)
+				}
+				err = method.Verify(strings.Join(parts[0:2], "."), sig, key)
 				if err == nil {
 					log.Printf("\nCheck passed!\nSignature: %s\n", sig)
 				} else {
@@ -90,14 +173,18 @@ func KeysSimpleCheck(data string, option *options.SysOption) {
 	if privKey, err := option.GetPrivKey(); err == nil {
 		if pubKey, err := option.GetPubKey(); err == nil {
 			rand := helpers.NewSystemRandom()
-			mainPart := fmt.Sprint(
+			mainPart := fmt.Sprintf(
 				"%s.%s",
 				base64.StdEncoding.EncodeToString([]byte(rand.CreatePassword(64))),
 				base64.StdEncoding.EncodeToString([]byte(rand.CreatePassword(96))))
 
-			sig, err := jwt.SigningMethodRS256.Sign(mainPart, privKey)
+			method, err := methodOfKey(privKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sig, err := method.Sign(mainPart, privKey)
 			if err == nil {
-				err := jwt.SigningMethodRS256.Verify(mainPart, sig, pubKey)
+				err := method.Verify(mainPart, sig, pubKey)
 				if err == nil {
 					log.Printf("Keys from '%s' is correct\n", option.KeyDir)
 				}
@@ -111,3 +198,12 @@ func KeysSimpleCheck(data string, option *options.SysOption) {
 		log.Fatalf("Can't open private key! Error: %s\n", err)
 	}
 }
+
+// token of this node for other node (peer or active node of replication)
+func CreateNodeToken(option options.SysOption, audience string) (string, error) {
+	key, err := GetSigningKey(option)
+	if err != nil {
+		return "", err
+	}
+	return CreateToken(key, NewClaims(option.GetPeerKey(), audience, nodeTokenLifetime))
+}
@@ -0,0 +1,134 @@
+package cryptosupport
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"roolet/options"
+	"strings"
+)
+
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeEC      = "ec"
+	KeyTypeEd25519 = "ed25519"
+
+	rsaKeyBits = 2048
+	// private keys are readable by owner only
+	privKeyMode os.FileMode = 0600
+	pubKeyMode  os.FileMode = 0644
+	privDirMode os.FileMode = 0700
+	pubDirMode  os.FileMode = 0755
+	privKeyExt              = ".priv"
+)
+
+// new private key for RS256, ES256 (P-256) or EdDSA tokens
+func GenerateKey(keyType string) (crypto.PrivateKey, error) {
+	switch strings.ToLower(keyType) {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case KeyTypeEC:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, errors.New(fmt.Sprintf(
+			"Unknown key type '%s', use %s, %s or %s.", keyType, KeyTypeRSA, KeyTypeEC, KeyTypeEd25519))
+	}
+}
+
+// private key in PKCS8 and public key in PKIX format (PEM)
+func EncodeKeyPair(key crypto.PrivateKey) ([]byte, []byte, error) {
+	privData, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New(fmt.Sprintf("Key %T hasn't public part.", key))
+	}
+	pubData, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privData}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubData}),
+		nil
+}
+
+// existing key is never replaced
+func writeKeyFile(filePath string, content []byte, mode, dirMode os.FileMode) error {
+	if err := os.MkdirAll(path.Dir(filePath), dirMode); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.New(fmt.Sprintf("Key file '%s' exists, remove it before.", filePath))
+		}
+		return err
+	}
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return err
+	}
+	return file.Close()
+}
+
+// key.priv and key.pub of node in KeyDir
+func WriteNodeKey(option options.SysOption, key crypto.PrivateKey) error {
+	privData, pubData, err := EncodeKeyPair(key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(option.GetPrivKeyPath(), privData, privKeyMode, privDirMode); err != nil {
+		return err
+	}
+	return writeKeyFile(option.GetPubKeyPath(), pubData, pubKeyMode, privDirMode)
+}
+
+func ClientPrivKeyPath(option options.SysOption, keyName string) string {
+	return path.Join(option.GetClientPrivKeyDir(), keyName+privKeyExt)
+}
+
+// private key of client in KeyDir/client, public key is enrolled
+func WriteClientKey(option options.SysOption, keyName string, key crypto.PrivateKey) error {
+	if !options.IsKeyName(keyName) {
+		return errors.New(fmt.Sprintf("Key name '%s' is wrong.", keyName))
+	}
+	privData, pubData, err := EncodeKeyPair(key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(ClientPrivKeyPath(option, keyName), privData, privKeyMode, privDirMode); err != nil {
+		return err
+	}
+	return EnrollKey(option, keyName, pubData)
+}
+
+// public key of client (PEM) to KeyDir/pub, auth by key name
+func EnrollKey(option options.SysOption, keyName string, content []byte) error {
+	if !options.IsKeyName(keyName) {
+		return errors.New(fmt.Sprintf("Key name '%s' is wrong.", keyName))
+	}
+	if _, err := options.ParsePublicKey(content); err != nil {
+		return errors.New(fmt.Sprintf("Public key problem: %s", err))
+	}
+	return writeKeyFile(path.Join(option.GetClientPubKeyDir(), keyName), content, pubKeyMode, pubDirMode)
+}
+
+// auth token of client key for this node, lifetime is max age of tokens
+func CreateClientToken(option options.SysOption, keyName string, key crypto.PrivateKey) (string, error) {
+	return CreateToken(key, NewClaims(keyName, option.Node, option.GetTokenMaxAge()))
+}
@@ -0,0 +1,57 @@
+package cryptosupport_test
+
+import (
+	"io/ioutil"
+	"os"
+	"roolet/cryptosupport"
+	"roolet/options"
+	"testing"
+)
+
+func TestKeyTools(t *testing.T) {
+	keyDir, _ := ioutil.TempDir("", "roolet-keys")
+	defer os.RemoveAll(keyDir)
+	option := options.SysOption{Node: "node1", KeyDir: keyDir}
+	if _, err := cryptosupport.GenerateKey("dsa"); err == nil {
+		t.Error("Unknown key type accepted.")
+	}
+	for _, keyType := range []string{cryptosupport.KeyTypeRSA, cryptosupport.KeyTypeEC, cryptosupport.KeyTypeEd25519} {
+		key, err := cryptosupport.GenerateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cryptosupport.WriteClientKey(option, keyType, key); err != nil {
+			t.Fatalf("Write %s key failed: %s", keyType, err)
+		}
+		if info, err := os.Stat(cryptosupport.ClientPrivKeyPath(option, keyType)); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Private key %s isn't protected: %v %s", keyType, info, err)
+		}
+		pubKey, err := option.GetClientPubKey(keyType)
+		if err != nil {
+			t.Fatalf("Enrolled %s key not found: %s", keyType, err)
+		}
+		token, err := cryptosupport.CreateClientToken(option, keyType, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cryptosupport.CheckToken(pubKey, token, keyType, option, nil); err != nil {
+			t.Errorf("Token of %s key rejected: %s", keyType, err)
+		}
+		if err := cryptosupport.WriteClientKey(option, keyType, key); err == nil {
+			t.Errorf("Key %s replaced.", keyType)
+		}
+	}
+	if err := cryptosupport.EnrollKey(option, "other", []byte("not a key")); err == nil {
+		t.Error("Wrong public key enrolled.")
+	}
+	if err := cryptosupport.EnrollKey(option, "../other", nil); err == nil {
+		t.Error("Wrong key name accepted.")
+	}
+	key, _ := cryptosupport.GenerateKey(cryptosupport.KeyTypeEd25519)
+	if err := cryptosupport.WriteNodeKey(option, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := option.GetPrivKey(); err != nil {
+		t.Errorf("Node key not loaded: %s", err)
+	}
+}
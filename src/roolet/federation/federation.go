@@ -0,0 +1,402 @@
+package federation
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"roolet/connectionsupport"
+	"roolet/coreprocessing"
+	"roolet/cryptosupport"
+	"roolet/helpers"
+	"roolet/options"
+	"roolet/rllogger"
+	"roolet/statistic"
+	"roolet/transport"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reconnectDelay = 5 * time.Second
+	dialTimeout    = 10 * time.Second
+)
+
+// access to processing of this node for calls from peer
+type LocalConnector interface {
+	OpenLocalConnection(backChannel *chan coreprocessing.CoreInstruction) *connectionsupport.ConnectionData
+	SendLocalCommand(connectionData *connectionsupport.ConnectionData, cmd *transport.Command)
+	CloseLocalConnection(connectionData *connectionsupport.ConnectionData)
+}
+
+// command or answer from peer
+type peerMessage struct {
+	Id     int                         `json:"id"`
+	Method string                      `json:"method"`
+	Params transport.MethodParams      `json:"params"`
+	Result string                      `json:"result"`
+	Error  *transport.ErrorDescription `json:"error"`
+}
+
+type routeData struct {
+	Task string `json:"task"`
+}
+
+// link to one peer node:
+// announces methods of local servers and executes calls forwarded by peer
+type peerLink struct {
+	helpers.AsyncSafeObject
+	addr       string
+	option     options.SysOption
+	stat       statistic.StatisticUpdater
+	connector  LocalConnector
+	rpcManager *coreprocessing.RpcServerManager
+	connection net.Conn
+	writeLock  sync.Mutex
+	// <local command id>: <peer task id>
+	calls map[int]string
+	// <local task id>: <peer task id>
+	tasks      map[string]string
+	cmdIndex   int
+	announced  string
+	registered bool
+	stopped    int32
+}
+
+func newPeerLink(
+	addr string,
+	option options.SysOption,
+	stat statistic.StatisticUpdater,
+	connector LocalConnector,
+	rpcManager *coreprocessing.RpcServerManager) *peerLink {
+	//
+	link := peerLink{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		addr:            addr,
+		option:          option,
+		stat:            stat,
+		connector:       connector,
+		rpcManager:      rpcManager}
+	return &link
+}
+
+func (link *peerLink) isActive() bool {
+	return atomic.LoadInt32(&(link.stopped)) == 0
+}
+
+func (link *peerLink) nextId() int {
+	link.Lock(true)
+	defer link.Unlock(true)
+	(*link).cmdIndex++
+	return (*link).cmdIndex
+}
+
+func (link *peerLink) send(cmd *transport.Command) error {
+	data := cmd.DataDump()
+	if data == nil {
+		return errors.New("Command dump problem.")
+	}
+	link.writeLock.Lock()
+	defer link.writeLock.Unlock()
+	_, err := (*link).connection.Write(append(*data, byte('\n')))
+	return err
+}
+
+func readMessage(reader *bufio.Reader) (*peerMessage, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	msg := peerMessage{}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// name of peer node for token audience
+func (link *peerLink) peerNode(reader *bufio.Reader) (string, error) {
+	if err := link.send(transport.NewCommand(link.nextId(), "", "ping", "")); err != nil {
+		return "", err
+	}
+	msg, err := readMessage(reader)
+	if err != nil {
+		return "", err
+	}
+	ping := transport.PingResult{}
+	if err := json.Unmarshal([]byte(msg.Result), &ping); err != nil {
+		return "", err
+	}
+	return ping.Node, nil
+}
+
+func (link *peerLink) auth(reader *bufio.Reader) error {
+	node, err := link.peerNode(reader)
+	if err != nil {
+		return err
+	}
+	token, err := cryptosupport.CreateNodeToken(link.option, node)
+	if err != nil {
+		return err
+	}
+	cmd := transport.NewCommandWithParams(
+		link.nextId(), "auth", transport.MethodParams{
+			Json: fmt.Sprintf("{\"key\": \"%s\"}", link.option.GetPeerKey()),
+			Data: token})
+	if err := link.send(cmd); err != nil {
+		return err
+	}
+	msg, err := readMessage(reader)
+	if err != nil {
+		return err
+	}
+	if msg.Error != nil && msg.Error.Code > 0 {
+		return errors.New(fmt.Sprintf("Auth failed: %s", msg.Error))
+	}
+	return nil
+}
+
+// send registration if methods of local servers changed
+func (link *peerLink) announce() error {
+	methods := (*link).rpcManager.GetLocalMethods()
+	sort.Strings(methods)
+	announced := strings.Join(methods, ",")
+	// empty list is sent once too
+	if announced == (*link).announced && (*link).registered {
+		return nil
+	}
+	data, err := json.Marshal(struct {
+		Group   int      `json:"group"`
+		Methods []string `json:"methods"`
+	}{Group: connectionsupport.GroupConnectionPeer, Methods: methods})
+	if err != nil {
+		return err
+	}
+	cmd := transport.NewCommandWithParams(
+		link.nextId(), "registration", transport.MethodParams{Json: string(data)})
+	if err := link.send(cmd); err != nil {
+		return err
+	}
+	(*link).announced = announced
+	(*link).registered = true
+	rllogger.Outputf(rllogger.LogDebug, "Methods announced to peer %s: %s", (*link).addr, announced)
+	return nil
+}
+
+func (link *peerLink) sendResult(taskId, data string) error {
+	cmd := transport.NewCommandWithParams(
+		link.nextId(), "result", transport.MethodParams{Task: taskId, Json: data})
+	return link.send(cmd)
+}
+
+// forwarded call goes to local processing as from client
+func (link *peerLink) call(connectionData *connectionsupport.ConnectionData, msg *peerMessage) {
+	if len(msg.Params.Task) == 0 {
+		rllogger.Outputf(rllogger.LogWarn, "Peer %s call '%s' without task.", (*link).addr, msg.Method)
+		return
+	}
+	link.stat.AddOneMsg("peer_calls")
+	id := link.nextId()
+	link.Lock(true)
+	(*link).calls[id] = msg.Params.Task
+	link.Unlock(true)
+	cmd := transport.NewCommandWithParams(
+		id, msg.Method, transport.MethodParams{Data: msg.Params.Data, Json: msg.Params.Json})
+	link.connector.SendLocalCommand(connectionData, cmd)
+}
+
+// answers and results of local processing go back to peer
+func (link *peerLink) localProcessing(backChannel *chan coreprocessing.CoreInstruction, done chan bool) {
+	defer close(done)
+	for {
+		instruction := <-*backChannel
+		if instruction.IsEmpty() {
+			return
+		}
+		if instruction.NeedExit() {
+			// node stopping
+			(*link).connection.Close()
+			continue
+		}
+		if answer, exists := instruction.GetAnswer(); exists {
+			link.Lock(true)
+			peerTask, exists := (*link).calls[answer.Id]
+			delete((*link).calls, answer.Id)
+			link.Unlock(true)
+			if exists {
+				if answer.Error.Code > 0 {
+					errData, _ := json.Marshal(struct {
+						Error transport.ErrorDescription `json:"error"`
+					}{Error: answer.Error})
+					if err := link.sendResult(peerTask, string(errData)); err != nil {
+						rllogger.Outputf(rllogger.LogWarn, "Peer %s result problem: %s", (*link).addr, err)
+					}
+				} else {
+					route := routeData{}
+					if err := json.Unmarshal([]byte(answer.Result), &route); err == nil {
+						link.Lock(true)
+						(*link).tasks[route.Task] = peerTask
+						link.Unlock(true)
+					} else {
+						rllogger.Outputf(rllogger.LogError, "Route answer format problem: %s", err)
+					}
+				}
+			}
+		}
+		if cmd, exists := instruction.GetCommand(); exists && cmd.Method == "result" {
+			link.Lock(true)
+			peerTask, exists := (*link).tasks[cmd.Params.Task]
+			delete((*link).tasks, cmd.Params.Task)
+			link.Unlock(true)
+			if exists {
+				if err := link.sendResult(peerTask, cmd.Params.Json); err != nil {
+					rllogger.Outputf(rllogger.LogWarn, "Peer %s result problem: %s", (*link).addr, err)
+				}
+			}
+		}
+	}
+}
+
+func (link *peerLink) announceProcessing(stop chan bool) {
+	ticker := time.NewTicker(link.option.GetStatusCheckPeriod())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := link.announce(); err != nil {
+				rllogger.Outputf(rllogger.LogWarn, "Peer %s announce problem: %s", (*link).addr, err)
+			}
+		}
+	}
+}
+
+// one connection to peer, returns on disconnect
+func (link *peerLink) session() error {
+	connection, err := net.DialTimeout("tcp", (*link).addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	link.Lock(true)
+	(*link).connection = connection
+	(*link).calls = make(map[int]string)
+	(*link).tasks = make(map[string]string)
+	(*link).announced = ""
+	(*link).registered = false
+	link.Unlock(true)
+	defer connection.Close()
+	if !link.isActive() {
+		return nil
+	}
+	reader := bufio.NewReader(connection)
+	if err := link.auth(reader); err != nil {
+		return err
+	}
+	backChannel := make(chan coreprocessing.CoreInstruction, link.option.BufferSize)
+	localDone := make(chan bool)
+	connectionData := link.connector.OpenLocalConnection(&backChannel)
+	go link.localProcessing(&backChannel, localDone)
+	defer func() {
+		link.connector.CloseLocalConnection(connectionData)
+		select {
+		case backChannel <- coreprocessing.CoreInstruction{}:
+		case <-localDone:
+		}
+	}()
+	if err := link.announce(); err != nil {
+		return err
+	}
+	announceStop := make(chan bool)
+	defer close(announceStop)
+	go link.announceProcessing(announceStop)
+	rllogger.Outputf(rllogger.LogInfo, "Peer %s connected.", (*link).addr)
+	for link.isActive() {
+		msg, err := readMessage(reader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(msg.Method) == 0:
+			{
+				if msg.Error != nil && msg.Error.Code > 0 {
+					rllogger.Outputf(rllogger.LogWarn, "Peer %s answer: %s", (*link).addr, msg.Error)
+				}
+			}
+		case msg.Method == "ping":
+			{
+				// heartbeat, any command is an answer
+				if err := link.send(transport.NewCommand(link.nextId(), "", "ping", "")); err != nil {
+					return err
+				}
+			}
+		default:
+			link.call(connectionData, msg)
+		}
+	}
+	return nil
+}
+
+func (link *peerLink) run(wait *sync.WaitGroup) {
+	defer wait.Done()
+	for link.isActive() {
+		if err := link.session(); err != nil && link.isActive() {
+			rllogger.Outputf(rllogger.LogWarn, "Peer %s connection problem: %s", (*link).addr, err)
+		}
+		if link.isActive() {
+			link.stat.AddOneMsg("peer_reconnect")
+			// wait before new connection, stop checked each second
+			for index := 0; index < int(reconnectDelay/time.Second) && link.isActive(); index++ {
+				time.Sleep(time.Second)
+			}
+		}
+	}
+}
+
+func (link *peerLink) stop() {
+	atomic.StoreInt32(&(link.stopped), 1)
+	link.Lock(false)
+	defer link.Unlock(false)
+	if (*link).connection != nil {
+		(*link).connection.Close()
+	}
+}
+
+// links to all peer nodes from options
+type PeerManager struct {
+	links []*peerLink
+	wait  sync.WaitGroup
+}
+
+func NewPeerManager(
+	option options.SysOption,
+	stat *statistic.Statistic,
+	connector LocalConnector,
+	rpcManager *coreprocessing.RpcServerManager) *PeerManager {
+	//
+	stat.AddItem("peer_calls", "Calls forwarded from peers count")
+	stat.AddItem("peer_reconnect", "Peer reconnect count")
+	manager := PeerManager{links: make([]*peerLink, 0, len(option.Peers))}
+	for _, addr := range option.Peers {
+		manager.links = append(manager.links, newPeerLink(addr, option, stat, connector, rpcManager))
+	}
+	return &manager
+}
+
+func (manager *PeerManager) Start() {
+	for _, link := range (*manager).links {
+		(*manager).wait.Add(1)
+		go link.run(&((*manager).wait))
+	}
+}
+
+func (manager *PeerManager) Stop() {
+	for _, link := range (*manager).links {
+		link.stop()
+	}
+	(*manager).wait.Wait()
+}
@@ -0,0 +1,134 @@
+package federation_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"roolet/client"
+	"roolet/testsupport"
+	"roolet/transport"
+	"roolet/worker"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wait until check is true or timeout
+func waitFor(timeout time.Duration, check func() bool) bool {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(50 * time.Millisecond) {
+		if check() {
+			return true
+		}
+	}
+	return check()
+}
+
+func TestForwardCallToPeer(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "svc", "cli")
+	testsupport.NewNodeKey(t, keyDir, "nodea", "nodeb")
+	optionA := testsupport.NewOption(keyDir)
+	optionA.Node = "nodea"
+	optionA.PeerKeys = []string{"nodeb"}
+	nodeA := testsupport.StartBroker(t, optionA, nil)
+	// node B is linked to node A and announces methods of own servers
+	optionB := testsupport.NewOption(keyDir)
+	optionB.Node = "nodeb"
+	optionB.Peers = []string{nodeA.Addr()}
+	optionB.StatusCheckPeriod = 1
+	nodeB := testsupport.StartBroker(t, optionB, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rlWorker := worker.NewWorker(client.Option{Addr: nodeB.Addr(), Key: "svc", PrivateKey: keys["svc"]}, 1)
+	rlWorker.HandleFunc("test_remote", func(ctx context.Context, params struct {
+		Value int `json:"value"`
+	}) (int, error) {
+		return params.Value * 2, nil
+	})
+	served := make(chan error, 1)
+	go func() { served <- rlWorker.Serve(ctx) }()
+	defer func() {
+		cancel()
+		<-served
+	}()
+	rpcManager := nodeA.Core().RpcManager
+	if !waitFor(10*time.Second, func() bool { return len(rpcManager.GetCidVariants("test_remote")) > 0 }) {
+		t.Fatal("Methods of peer must be announced.")
+	}
+	rlClient, err := client.Dial(ctx, client.Option{Addr: nodeA.Addr(), Key: "cli", PrivateKey: keys["cli"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rlClient.Close()
+	result, err := rlClient.CallWait(ctx, "test_remote", transport.MethodParams{Json: "{\"value\": 21}"})
+	if err != nil || result != "{\"result\":42}" {
+		t.Fatalf("Unexpected result of forwarded call: %s %v", result, err)
+	}
+	// routes to peer removed with link
+	nodeB.Stop()
+	if !waitFor(10*time.Second, func() bool { return len(rpcManager.GetCidVariants("test_remote")) == 0 }) {
+		t.Error("Methods of lost peer must be removed.")
+	}
+}
+
+// node without servers registers empty method list once
+func TestAnnounceEmptyMethods(t *testing.T) {
+	keyDir, _ := testsupport.NewKeyDir(t)
+	testsupport.NewNodeKey(t, keyDir, "nodeb")
+	// peer node answers to ping and auth, registrations are collected
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	registrations := make(chan string, 10)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		reader := bufio.NewReader(connection)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			cmd := transport.Command{}
+			json.Unmarshal(line, &cmd)
+			result := "{\"ok\": true}"
+			switch cmd.Method {
+			case "ping":
+				data, _ := json.Marshal(transport.PingResult{Node: "nodea"})
+				result = string(data)
+			case "registration":
+				registrations <- cmd.Params.Json
+			}
+			data, _ := json.Marshal(struct {
+				Id     int    `json:"id"`
+				Result string `json:"result"`
+			}{Id: cmd.Id, Result: result})
+			connection.Write(append(data, byte('\n')))
+		}
+	}()
+	option := testsupport.NewOption(keyDir)
+	option.Node = "nodeb"
+	option.Peers = []string{listener.Addr().String()}
+	option.StatusCheckPeriod = 1
+	testsupport.StartBroker(t, option, nil)
+	select {
+	case data := <-registrations:
+		if !strings.Contains(data, "\"methods\":[]") && !strings.Contains(data, "\"methods\":null") {
+			t.Errorf("Unexpected registration: %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Empty method list must be registered.")
+	}
+	// not changed list isn't sent on next checks
+	select {
+	case data := <-registrations:
+		t.Errorf("Registration without changes: %s", data)
+	case <-time.After(3 * time.Second):
+	}
+}
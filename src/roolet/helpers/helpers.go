@@ -420,6 +420,16 @@ func (part *asyncStrDictPart) clear() {
 	}
 }
 
+func (part *asyncStrDictPart) keys() []string {
+	part.Lock(false)
+	defer part.Unlock(false)
+	result := make([]string, 0, len((*part).content))
+	for key, _ := range (*part).content {
+		result = append(result, key)
+	}
+	return result
+}
+
 func (part *asyncStrDictPart) size() int {
 	part.Lock(false)
 	defer part.Unlock(false)
@@ -516,6 +526,14 @@ func (dict *AsyncStrDict) Clear() {
 	}
 }
 
+func (dict *AsyncStrDict) Keys() []string {
+	var result []string
+	for i := 0; i < asyncDictCountParts; i++ {
+		result = append(result, dict.pool[i].keys()...)
+	}
+	return result
+}
+
 func (dict *AsyncStrDict) Size() int {
 	var result int
 	for i := 0; i < asyncDictCountParts; i++ {
@@ -0,0 +1,224 @@
+package keyregistry
+
+import (
+	"bufio"
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"roolet/helpers"
+	"roolet/options"
+	"roolet/rllogger"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RevokeHandler func(keyName string)
+
+type cachedKey struct {
+	key     crypto.PublicKey
+	modTime time.Time
+	size    int64
+}
+
+// cache of client public keys from KeyDir/pub, checked by period,
+// keys from revocation list and removed keys are not accepted
+type Registry struct {
+	helpers.AsyncSafeObject
+	option      options.SysOption
+	keys        map[string]cachedKey
+	revoked     map[string]bool
+	stopChannel chan bool
+	wait        sync.WaitGroup
+}
+
+func NewRegistry(option options.SysOption) *Registry {
+	registry := Registry{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		option:          option,
+		keys:            make(map[string]cachedKey),
+		revoked:         make(map[string]bool),
+		stopChannel:     make(chan bool, 1)}
+	registry.Scan()
+	return &registry
+}
+
+func (registry *Registry) getOption() options.SysOption {
+	registry.Lock(false)
+	defer registry.Unlock(false)
+	return (*registry).option
+}
+
+// key names one per line, "#" for comments
+func readRevoked(filePath string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			result[line] = true
+		}
+	}
+	return result, scanner.Err()
+}
+
+func loadKey(filePath string, info os.FileInfo) (cachedKey, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return cachedKey{}, err
+	}
+	key, err := options.ParsePublicKey(content)
+	if err != nil {
+		return cachedKey{}, err
+	}
+	return cachedKey{key: key, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// read changes of directory and revocation list,
+// names of keys revoked or removed after previous scan returned
+func (registry *Registry) Scan() []string {
+	option := registry.getOption()
+	keyDir := option.GetClientPubKeyDir()
+	registry.Lock(false)
+	oldKeys := (*registry).keys
+	oldRevoked := (*registry).revoked
+	registry.Unlock(false)
+
+	keys := make(map[string]cachedKey)
+	if files, err := ioutil.ReadDir(keyDir); err == nil {
+		for _, info := range files {
+			if info.IsDir() {
+				continue
+			}
+			name := info.Name()
+			if cached, exists := oldKeys[name]; exists && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+				keys[name] = cached
+			} else if cached, err := loadKey(filepath.Join(keyDir, name), info); err == nil {
+				keys[name] = cached
+			} else {
+				rllogger.Outputf(rllogger.LogWarn, "Public key '%s' not loaded: %s", name, err)
+			}
+		}
+	} else {
+		rllogger.Outputf(rllogger.LogWarn, "Public key directory %s not available: %s", keyDir, err)
+	}
+	revoked, err := readRevoked(option.GetRevokedKeysFile())
+	if err != nil {
+		rllogger.Outputf(rllogger.LogWarn, "Revocation list not loaded: %s", err)
+		revoked = oldRevoked
+	}
+
+	var result []string
+	for name := range oldKeys {
+		if _, exists := keys[name]; !exists && !revoked[name] {
+			rllogger.Outputf(rllogger.LogInfo, "Public key '%s' removed.", name)
+			result = append(result, name)
+		}
+	}
+	for name := range revoked {
+		if !oldRevoked[name] {
+			rllogger.Outputf(rllogger.LogInfo, "Public key '%s' revoked.", name)
+			result = append(result, name)
+		}
+	}
+	registry.Lock(true)
+	(*registry).keys = keys
+	(*registry).revoked = revoked
+	registry.Unlock(true)
+	return result
+}
+
+func (registry *Registry) IsRevoked(keyName string) bool {
+	registry.Lock(false)
+	defer registry.Unlock(false)
+	return (*registry).revoked[keyName]
+}
+
+// public key for auth, new file is read without waiting for scan
+func (registry *Registry) GetKey(keyName string) (crypto.PublicKey, error) {
+	if registry.IsRevoked(keyName) {
+		return nil, errors.New(fmt.Sprintf("Key '%s' revoked.", keyName))
+	}
+	registry.Lock(false)
+	cached, exists := (*registry).keys[keyName]
+	option := (*registry).option
+	registry.Unlock(false)
+	if exists {
+		return cached.key, nil
+	}
+	if !options.IsKeyName(keyName) {
+		return nil, errors.New(fmt.Sprintf("Key name '%s' is wrong.", keyName))
+	}
+	filePath := filepath.Join(option.GetClientPubKeyDir(), keyName)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	cached, err = loadKey(filePath, info)
+	if err != nil {
+		return nil, err
+	}
+	registry.Lock(true)
+	(*registry).keys[keyName] = cached
+	registry.Unlock(true)
+	return cached.key, nil
+}
+
+// shared secret of key for challenge auth
+func (registry *Registry) GetSecret(keyName string) ([]byte, error) {
+	if registry.IsRevoked(keyName) {
+		return nil, errors.New(fmt.Sprintf("Key '%s' revoked.", keyName))
+	}
+	return registry.getOption().GetClientSecret(keyName)
+}
+
+func (registry *Registry) processing(onRevoked RevokeHandler) {
+	defer registry.wait.Done()
+	period := registry.getOption().GetKeyCheckPeriod()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-(*registry).stopChannel:
+			return
+		case <-ticker.C:
+			{
+				for _, name := range registry.Scan() {
+					onRevoked(name)
+				}
+				if newPeriod := registry.getOption().GetKeyCheckPeriod(); newPeriod != period {
+					period = newPeriod
+					ticker.Reset(period)
+				}
+			}
+		}
+	}
+}
+
+func (registry *Registry) Start(onRevoked RevokeHandler) {
+	registry.wait.Add(1)
+	go registry.processing(onRevoked)
+}
+
+// new key dir and period used from next scan
+func (registry *Registry) Reload(option options.SysOption) {
+	registry.Lock(true)
+	defer registry.Unlock(true)
+	(*registry).option = option
+}
+
+func (registry *Registry) Stop() {
+	(*registry).stopChannel <- true
+	registry.wait.Wait()
+}
@@ -0,0 +1,69 @@
+package keyregistry_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"roolet/keyregistry"
+	"roolet/options"
+	"testing"
+)
+
+func writePubKey(t *testing.T, filePath string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&(key.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevokeAndRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(path.Join(dir, "pub"), 0700)
+	writePubKey(t, path.Join(dir, "pub", "client1"))
+	writePubKey(t, path.Join(dir, "pub", "client2"))
+
+	registry := keyregistry.NewRegistry(options.SysOption{KeyDir: dir})
+	if key, err := registry.GetKey("client1"); err != nil || key == nil {
+		t.Fatalf("Key must be loaded: %s", err)
+	}
+	if _, err := registry.GetKey("../key.priv"); err == nil {
+		t.Error("Key name with path must be error.")
+	}
+	// new key without scan
+	writePubKey(t, path.Join(dir, "pub", "client3"))
+	if _, err := registry.GetKey("client3"); err != nil {
+		t.Errorf("New key must be loaded: %s", err)
+	}
+
+	ioutil.WriteFile(path.Join(dir, "revoked"), []byte("# old keys\nclient1\n"), 0600)
+	os.Remove(path.Join(dir, "pub", "client2"))
+	changes := registry.Scan()
+	if len(changes) != 2 {
+		t.Errorf("Revoked and removed keys expected: %v", changes)
+	}
+	if _, err := registry.GetKey("client1"); err == nil {
+		t.Error("Revoked key must be error.")
+	}
+	if _, err := registry.GetKey("client2"); err == nil {
+		t.Error("Removed key must be error.")
+	}
+	if changes := registry.Scan(); len(changes) > 0 {
+		t.Errorf("Changes must be reported once: %v", changes)
+	}
+}
@@ -1,40 +1,148 @@
 package options
 
 import (
-	"crypto/rsa"
+	"bytes"
+	"crypto"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
-	"path"
 	"io/ioutil"
+	"path"
+	"reflect"
 	"roolet/helpers"
 	"roolet/rllogger"
-
-	"github.com/dgrijalva/jwt-go"
+	"strings"
+	"time"
 )
 
 const (
-	pubKeyFileName  = "key.pub"
-	privKeyFileName = "key.priv"
-	publicKeySubDir = "pub"
+	pubKeyFileName      = "key.pub"
+	privKeyFileName     = "key.priv"
+	publicKeySubDir     = "pub"
+	secretKeySubDir     = "secret"
+	clientPrivKeySubDir = "client"
+	aclFileName         = "acl.json"
+	revokedFileName     = "revoked"
+	// defaults
+	defaultTaskTimeout       = 60
+	defaultBreakerOpenTime   = 30
+	defaultStatusCheckPeriod = 10
+	defaultHealthMisses      = 3
+	defaultHealthCloseMisses = 10
+	defaultShutdownTimeout   = 30
+	defaultKeyCheckPeriod    = 5
+	defaultTokenMaxAge       = 300
+	defaultTokenLeeway       = 30
+	// routing strategy
+	RoutingRandom     = "random"
+	RoutingLeastTasks = "least_tasks"
 )
 
+// commands allowed before auth by default
+var defaultAnonymousMethods = []string{"ping", "quit", "exit"}
+
+// token algorithms with public keys accepted by default
+var defaultTokenAlgorithms = []string{"RS256", "ES256", "EdDSA"}
+
+// options can't be changed by reload
+var restartRequiredOptions = map[string]bool{
+	"port":             true,
+	"addr":             true,
+	"ws_port":          true,
+	"ws_addr":          true,
+	"buffer_size":      true,
+	"node":             true,
+	"workers":          true,
+	"result_store":     true,
+	"result_store_dir": true,
+	"peers":            true,
+	"peer_key":         true,
+	"replica_of":       true,
+	"accounting_dir":   true}
+
+// options with hidden values in log
+var secretOptions = map[string]bool{
+	"secret": true}
+
+// token bucket: rate per second and max burst
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// limits by key name ("*" for any key), group name and method
+type RateLimitOptions struct {
+	Keys    map[string]RateLimit `json:"keys"`
+	Groups  map[string]RateLimit `json:"groups"`
+	Methods map[string]RateLimit `json:"methods"`
+}
+
+// daily limits of key ("*" for any key), zero value is without limit
+type Quota struct {
+	Calls         int64   `json:"calls"`
+	Bytes         int64   `json:"bytes"`
+	WorkerSeconds float64 `json:"worker_seconds"`
+}
+
+// checks of auth token claims, times in seconds
+type TokenOptions struct {
+	// tokens without claims accepted (old clients)
+	Legacy bool `json:"legacy"`
+	// max age of "iat" and max lifetime
+	MaxAge int `json:"max_age"`
+	// allowed difference of clocks
+	Leeway int `json:"leeway"`
+	// accepted "iss" values, key name by default
+	Issuers []string `json:"issuers"`
+	// accepted "alg" values of token header, HS256 uses Secret
+	Algorithms []string `json:"algorithms"`
+}
+
 type SysOption struct {
-	Port               int    `json:"port"`
-	Addr               string `json:"addr"`
-	WsPort             int    `json:"ws_port"`
-	WsAddr             string `json:"ws_addr"`
-	BufferSize         int    `json:"buffer_size"`
-	Node               string `json:"node"`
-	Workers            int    `json:"workers"`
-	Statistic          bool   `json:"statistic"`
-	StatisticFile      string `json:"statistic_file"`
-	StatisticCheckTime int    `json:"statistic_check_time"`
-	CountWorkerTime    bool   `json:"count_worker_time"`
-	KeySize            int    `json:"key_size"`
-	Secret             string `json:"secret"`
-	StatusCheckPeriod  int    `json:"status_check_period"`
-	KeyDir             string `json:"key_dir"`
+	Port               int              `json:"port"`
+	Addr               string           `json:"addr"`
+	WsPort             int              `json:"ws_port"`
+	WsAddr             string           `json:"ws_addr"`
+	BufferSize         int              `json:"buffer_size"`
+	Node               string           `json:"node"`
+	Workers            int              `json:"workers"`
+	Statistic          bool             `json:"statistic"`
+	StatisticFile      string           `json:"statistic_file"`
+	StatisticCheckTime int              `json:"statistic_check_time"`
+	CountWorkerTime    bool             `json:"count_worker_time"`
+	KeySize            int              `json:"key_size"`
+	Secret             string           `json:"secret"`
+	StatusCheckPeriod  int              `json:"status_check_period"`
+	KeyDir             string           `json:"key_dir"`
+	ResultStore        string           `json:"result_store"`
+	ResultStoreDir     string           `json:"result_store_dir"`
+	TaskTimeout        int              `json:"task_timeout"`
+	BreakerThreshold   int              `json:"breaker_threshold"`
+	BreakerOpenTime    int              `json:"breaker_open_time"`
+	AdminKeys          []string         `json:"admin_keys"`
+	HealthMisses       int              `json:"health_misses"`
+	HealthCloseMisses  int              `json:"health_close_misses"`
+	IdleTimeout        int              `json:"idle_timeout"`
+	ReadTimeout        int              `json:"read_timeout"`
+	AuthTimeout        int              `json:"auth_timeout"`
+	HeartbeatPeriod    int              `json:"heartbeat_period"`
+	ShutdownTimeout    int              `json:"shutdown_timeout"`
+	LogLevel           string           `json:"log_level"`
+	RoutingStrategy    string           `json:"routing_strategy"`
+	Peers              []string         `json:"peers"`
+	PeerKey            string           `json:"peer_key"`
+	PeerKeys           []string         `json:"peer_keys"`
+	ReplicaOf          string           `json:"replica_of"`
+	RateLimits         RateLimitOptions `json:"rate_limits"`
+	AccountingDir      string           `json:"accounting_dir"`
+	Quotas             map[string]Quota `json:"quotas"`
+	AclFile            string           `json:"acl_file"`
+	AnonymousMethods   []string         `json:"anonymous_methods"`
+	KeyCheckPeriod     int              `json:"key_check_period"`
+	Tokens             TokenOptions     `json:"tokens"`
+	ResumeTimeout      int              `json:"resume_timeout"`
 }
 
 func (option SysOption) Socket() string {
@@ -60,6 +168,198 @@ func (option SysOption) GetCidConstructorData() (int, string) {
 	return option.KeySize, option.Node
 }
 
+func (option SysOption) GetTaskTimeout() time.Duration {
+	timeout := option.TaskTimeout
+	if timeout <= 0 {
+		timeout = defaultTaskTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+func (option SysOption) GetBreakerOpenTime() time.Duration {
+	openTime := option.BreakerOpenTime
+	if openTime <= 0 {
+		openTime = defaultBreakerOpenTime
+	}
+	return time.Duration(openTime) * time.Second
+}
+
+func (option SysOption) GetStatusCheckPeriod() time.Duration {
+	period := option.StatusCheckPeriod
+	if period <= 0 {
+		period = defaultStatusCheckPeriod
+	}
+	return time.Duration(period) * time.Second
+}
+
+// missed pings count before server marked unhealthy and before close
+func (option SysOption) GetHealthMisses() (int, int) {
+	misses := option.HealthMisses
+	if misses <= 0 {
+		misses = defaultHealthMisses
+	}
+	closeMisses := option.HealthCloseMisses
+	if closeMisses <= misses {
+		closeMisses = defaultHealthCloseMisses
+		if closeMisses <= misses {
+			closeMisses = misses + 1
+		}
+	}
+	return misses, closeMisses
+}
+
+// connection timeouts in seconds, zero value turns off
+func (option SysOption) GetIdleTimeout() time.Duration {
+	return time.Duration(option.IdleTimeout) * time.Second
+}
+
+func (option SysOption) GetReadTimeout() time.Duration {
+	return time.Duration(option.ReadTimeout) * time.Second
+}
+
+func (option SysOption) GetAuthTimeout() time.Duration {
+	return time.Duration(option.AuthTimeout) * time.Second
+}
+
+func (option SysOption) GetHeartbeatPeriod() time.Duration {
+	return time.Duration(option.HeartbeatPeriod) * time.Second
+}
+
+// grace period for resumption of closed session, zero is disabled
+func (option SysOption) GetResumeTimeout() time.Duration {
+	return time.Duration(option.ResumeTimeout) * time.Second
+}
+
+func (option SysOption) HasConnectionTimeouts() bool {
+	return (option.IdleTimeout > 0 || option.ReadTimeout > 0 ||
+		option.AuthTimeout > 0 || option.HeartbeatPeriod > 0)
+}
+
+// wait for tasks before stop
+func (option SysOption) GetShutdownTimeout() time.Duration {
+	timeout := option.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// changes of public keys and revocation list checked with period
+func (option SysOption) GetKeyCheckPeriod() time.Duration {
+	period := option.KeyCheckPeriod
+	if period <= 0 {
+		period = defaultKeyCheckPeriod
+	}
+	return time.Duration(period) * time.Second
+}
+
+func (option SysOption) GetTokenMaxAge() time.Duration {
+	maxAge := option.Tokens.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultTokenMaxAge
+	}
+	return time.Duration(maxAge) * time.Second
+}
+
+func (option SysOption) GetTokenLeeway() time.Duration {
+	leeway := option.Tokens.Leeway
+	if leeway <= 0 {
+		leeway = defaultTokenLeeway
+	}
+	return time.Duration(leeway) * time.Second
+}
+
+func (option SysOption) IsTokenIssuer(issuer, keyName string) bool {
+	if len(option.Tokens.Issuers) == 0 {
+		return len(issuer) > 0 && issuer == keyName
+	}
+	for _, accepted := range option.Tokens.Issuers {
+		if accepted == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+func (option SysOption) IsTokenAlgorithm(alg string) bool {
+	algorithms := option.Tokens.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultTokenAlgorithms
+	}
+	for _, accepted := range algorithms {
+		if accepted == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (option SysOption) IsAdminKey(keyName string) bool {
+	if len(keyName) > 0 {
+		for _, adminKey := range option.AdminKeys {
+			if adminKey == keyName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keys of other nodes allowed to register as peer: admin keys,
+// peer key of this node and keys from peer_keys
+func (option SysOption) IsPeerKey(keyName string) bool {
+	if len(keyName) == 0 {
+		return false
+	}
+	if option.IsAdminKey(keyName) || keyName == option.GetPeerKey() {
+		return true
+	}
+	for _, peerKey := range option.PeerKeys {
+		if peerKey == keyName {
+			return true
+		}
+	}
+	return false
+}
+
+// key name for auth on peer nodes, node name by default
+func (option SysOption) GetPeerKey() string {
+	if len(option.PeerKey) > 0 {
+		return option.PeerKey
+	}
+	return option.Node
+}
+
+// changes between options as lines "name: old -> new",
+// error if some changes can be applied after restart only
+func (option SysOption) Diff(newOption SysOption) ([]string, error) {
+	var lines []string
+	var restart []string
+	oldValue := reflect.ValueOf(option)
+	newValue := reflect.ValueOf(newOption)
+	optionType := oldValue.Type()
+	for index := 0; index < optionType.NumField(); index++ {
+		name := strings.Split(optionType.Field(index).Tag.Get("json"), ",")[0]
+		oldField := oldValue.Field(index).Interface()
+		newField := newValue.Field(index).Interface()
+		if !reflect.DeepEqual(oldField, newField) {
+			if secretOptions[name] {
+				lines = append(lines, fmt.Sprintf("%s: *** -> ***", name))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s: %v -> %v", name, oldField, newField))
+			}
+			if restartRequiredOptions[name] {
+				restart = append(restart, name)
+			}
+		}
+	}
+	if len(restart) > 0 {
+		return lines, errors.New(
+			fmt.Sprintf("Restart required for changes: %s.", strings.Join(restart, ", ")))
+	}
+	return lines, nil
+}
+
 type OptionLoder interface {
 	Load(useLog bool) (*SysOption, error)
 }
@@ -68,32 +368,129 @@ type JsonOptionSrc struct {
 	FilePath string
 }
 
-func (option SysOption) GetClientPubKey(keyName string) (*rsa.PublicKey, error) {
+func (option SysOption) GetClientPubKeyDir() string {
+	return helpers.GetFullFilePath(option.KeyDir, publicKeySubDir)
+}
+
+// shared secrets of keys for challenge auth, one file per key
+func (option SysOption) GetClientSecretDir() string {
+	return helpers.GetFullFilePath(option.KeyDir, secretKeySubDir)
+}
+
+// private keys of clients created by keygen tool, file per key
+func (option SysOption) GetClientPrivKeyDir() string {
+	return helpers.GetFullFilePath(option.KeyDir, clientPrivKeySubDir)
+}
+
+func (option SysOption) GetPubKeyPath() string {
+	return helpers.GetFullFilePath(option.KeyDir, pubKeyFileName)
+}
+
+func (option SysOption) GetPrivKeyPath() string {
+	return helpers.GetFullFilePath(option.KeyDir, privKeyFileName)
+}
+
+// revoked key names, one per line
+func (option SysOption) GetRevokedKeysFile() string {
+	return helpers.GetFullFilePath(option.KeyDir, revokedFileName)
+}
+
+// RSA, ECDSA or Ed25519 public key in PKIX format (or certificate)
+func ParsePublicKey(content []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("Key must be PEM encoded.")
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	} else if cert, certErr := x509.ParseCertificate(block.Bytes); certErr == nil {
+		return cert.PublicKey, nil
+	} else {
+		return nil, err
+	}
+}
+
+// RSA, ECDSA or Ed25519 private key in PKCS1, SEC1 or PKCS8 format
+func ParsePrivateKey(content []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("Key must be PEM encoded.")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func (option SysOption) GetClientPubKey(keyName string) (crypto.PublicKey, error) {
 	keyDir := path.Join(option.KeyDir, publicKeySubDir)
 	filePath := helpers.GetFullFilePath(keyDir, keyName)
 	if key, err := ioutil.ReadFile(filePath); err != nil {
 		return nil, err
 	} else {
-		return jwt.ParseRSAPublicKeyFromPEM(key)
+		return ParsePublicKey(key)
 	}
 }
 
-func (option SysOption) GetPubKey() (*rsa.PublicKey, error) {
-	filePath := helpers.GetFullFilePath(option.KeyDir, pubKeyFileName)
-	if key, err := ioutil.ReadFile(filePath); err != nil {
+// key name is file name in key directories
+func IsKeyName(keyName string) bool {
+	return len(keyName) > 0 && path.Base(keyName) == keyName && !strings.HasPrefix(keyName, ".")
+}
+
+func (option SysOption) GetClientSecret(keyName string) ([]byte, error) {
+	if !IsKeyName(keyName) {
+		return nil, errors.New(fmt.Sprintf("Key name '%s' is wrong.", keyName))
+	}
+	filePath := helpers.GetFullFilePath(option.GetClientSecretDir(), keyName)
+	if secret, err := ioutil.ReadFile(filePath); err != nil {
 		return nil, err
 	} else {
-		return jwt.ParseRSAPublicKeyFromPEM(key)
+		return bytes.TrimSpace(secret), nil
 	}
 }
 
-func (option SysOption) GetPrivKey() (*rsa.PrivateKey, error) {
-	filePath := helpers.GetFullFilePath(option.KeyDir, privKeyFileName)
-	if key, err := ioutil.ReadFile(filePath); err != nil {
+func (option SysOption) GetPubKey() (crypto.PublicKey, error) {
+	if key, err := ioutil.ReadFile(option.GetPubKeyPath()); err != nil {
+		return nil, err
+	} else {
+		return ParsePublicKey(key)
+	}
+}
+
+func (option SysOption) GetPrivKey() (crypto.PrivateKey, error) {
+	if key, err := ioutil.ReadFile(option.GetPrivKeyPath()); err != nil {
 		return nil, err
 	} else {
-		return jwt.ParseRSAPrivateKeyFromPEM(key)
+		return ParsePrivateKey(key)
+	}
+}
+
+// auth is allowed always, other methods from options or defaults
+func (option SysOption) IsAnonymousMethod(method string) bool {
+	if method == "auth" || method == "authchallenge" {
+		return true
+	}
+	anonymousMethods := option.AnonymousMethods
+	if anonymousMethods == nil {
+		anonymousMethods = defaultAnonymousMethods
+	}
+	for _, anonymousMethod := range anonymousMethods {
+		if anonymousMethod == method {
+			return true
+		}
+	}
+	return false
+}
+
+// access lists of keys, "acl.json" in KeyDir by default
+func (option SysOption) GetAclFile() string {
+	if len(option.AclFile) > 0 {
+		return option.AclFile
 	}
+	return helpers.GetFullFilePath(option.KeyDir, aclFileName)
 }
 
 func (src JsonOptionSrc) Load(useLog bool) (*SysOption, error) {
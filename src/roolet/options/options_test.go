@@ -0,0 +1,37 @@
+package options_test
+
+import (
+	"roolet/options"
+	"testing"
+)
+
+func TestDiffChangeable(t *testing.T) {
+	option := options.SysOption{Port: 7551, LogLevel: "info", StatisticCheckTime: 10}
+	newOption := option
+	newOption.LogLevel = "debug"
+	newOption.StatisticCheckTime = 30
+	lines, err := option.Diff(newOption)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(lines) != 2 {
+		t.Errorf("Incorrect changes: %v", lines)
+	}
+	if lines, err := option.Diff(option); err != nil || len(lines) > 0 {
+		t.Errorf("Same options must be without changes: %v %v", lines, err)
+	}
+}
+
+func TestDiffRestartRequired(t *testing.T) {
+	option := options.SysOption{Port: 7551, Secret: "one"}
+	newOption := option
+	newOption.Port = 7552
+	newOption.Secret = "two"
+	lines, err := option.Diff(newOption)
+	if err == nil {
+		t.Error("Port change must require restart.")
+	}
+	if len(lines) != 2 || lines[1] != "secret: *** -> ***" {
+		t.Errorf("Incorrect changes: %v", lines)
+	}
+}
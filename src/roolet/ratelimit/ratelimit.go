@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"math"
+	"roolet/connectionsupport"
+	"roolet/helpers"
+	"roolet/options"
+	"time"
+)
+
+const anyKeyName = "*"
+
+// servers and nodes answer to calls, limit is for callers only
+var freeGroups = map[int]bool{
+	connectionsupport.GroupConnectionServer:  true,
+	connectionsupport.GroupConnectionPeer:    true,
+	connectionsupport.GroupConnectionReplica: true}
+
+// service methods of connection, worker shares key with clients
+var freeMethods = map[string]bool{
+	"auth":          true,
+	"authchallenge": true,
+	"ping":          true,
+	"result":        true,
+	"statusupdate":  true}
+
+type bucket struct {
+	limit  options.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit options.RateLimit, now time.Time) *bucket {
+	result := bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+	return &result
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// time to wait one token
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// token buckets by key name, connection group and method,
+// each bucket is common for all connections,
+// connections without key have no key bucket
+type Limiter struct {
+	helpers.AsyncSafeObject
+	limits  options.RateLimitOptions
+	buckets map[string]*bucket
+}
+
+func NewLimiter(limits options.RateLimitOptions) *Limiter {
+	limiter := Limiter{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		limits:          limits,
+		buckets:         make(map[string]*bucket)}
+	return &limiter
+}
+
+// new limits, buckets with changed limits start again
+func (limiter *Limiter) Setup(limits options.RateLimitOptions) {
+	limiter.Lock(true)
+	defer limiter.Unlock(true)
+	(*limiter).limits = limits
+	for name, b := range (*limiter).buckets {
+		if limit, exists := limiter.findLimit(name); !exists || limit != b.limit {
+			delete((*limiter).buckets, name)
+		}
+	}
+}
+
+func isActive(limit options.RateLimit) bool {
+	return limit.Rate > 0 && limit.Burst > 0
+}
+
+// bucket name as "<kind>:<name>"
+func (limiter *Limiter) findLimit(bucketName string) (options.RateLimit, bool) {
+	var limit options.RateLimit
+	var exists bool
+	kind, name := bucketName[:1], bucketName[2:]
+	switch kind {
+	case "k":
+		if limit, exists = (*limiter).limits.Keys[name]; !exists {
+			limit, exists = (*limiter).limits.Keys[anyKeyName]
+		}
+	case "g":
+		limit, exists = (*limiter).limits.Groups[name]
+	case "m":
+		limit, exists = (*limiter).limits.Methods[name]
+	}
+	return limit, exists && isActive(limit)
+}
+
+// token taken from all buckets or wait time returned
+func (limiter *Limiter) Allow(keyName string, group int, method string) (bool, time.Duration) {
+	if freeGroups[group] || freeMethods[method] {
+		return true, 0
+	}
+	limiter.Lock(true)
+	defer limiter.Unlock(true)
+	names := []string{"m:" + method}
+	if len(keyName) > 0 {
+		names = append(names, "k:"+keyName)
+	}
+	if groupName, exists := connectionsupport.GetGroupName(group); exists {
+		names = append(names, "g:"+groupName)
+	}
+	now := time.Now()
+	buckets := make([]*bucket, 0, len(names))
+	var wait time.Duration
+	for _, name := range names {
+		if limit, exists := limiter.findLimit(name); exists {
+			b, exists := (*limiter).buckets[name]
+			if !exists {
+				b = newBucket(limit, now)
+				(*limiter).buckets[name] = b
+			}
+			b.refill(now)
+			if bucketWait := b.wait(); bucketWait > wait {
+				wait = bucketWait
+			}
+			buckets = append(buckets, b)
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
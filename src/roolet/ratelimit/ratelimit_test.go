@@ -0,0 +1,70 @@
+package ratelimit_test
+
+import (
+	"roolet/connectionsupport"
+	"roolet/options"
+	"roolet/ratelimit"
+	"testing"
+	"time"
+)
+
+func TestKeyBurst(t *testing.T) {
+	limiter := ratelimit.NewLimiter(options.RateLimitOptions{
+		Keys: map[string]options.RateLimit{"*": options.RateLimit{Rate: 1, Burst: 3}}})
+	for index := 0; index < 3; index++ {
+		if allow, _ := limiter.Allow("client1", connectionsupport.GroupConnectionClient, "test"); !allow {
+			t.Fatalf("Call %d must be allowed.", index)
+		}
+	}
+	allow, wait := limiter.Allow("client1", connectionsupport.GroupConnectionClient, "test")
+	if allow || wait <= 0 || wait > time.Second {
+		t.Errorf("Call over burst must wait: %t %s", allow, wait)
+	}
+	// other key has own bucket
+	if allow, _ := limiter.Allow("client2", connectionsupport.GroupConnectionClient, "test"); !allow {
+		t.Error("Other key must be allowed.")
+	}
+}
+
+func TestMethodAndGroup(t *testing.T) {
+	limiter := ratelimit.NewLimiter(options.RateLimitOptions{
+		Groups:  map[string]options.RateLimit{"web": options.RateLimit{Rate: 100, Burst: 2}},
+		Methods: map[string]options.RateLimit{"slow": options.RateLimit{Rate: 0.1, Burst: 1}}})
+	if allow, _ := limiter.Allow("a", connectionsupport.GroupConnectionClient, "slow"); !allow {
+		t.Error("First call must be allowed.")
+	}
+	if allow, wait := limiter.Allow("b", connectionsupport.GroupConnectionClient, "slow"); allow || wait < 9*time.Second {
+		t.Errorf("Method limit is common for all keys: %t %s", allow, wait)
+	}
+	limiter.Allow("a", connectionsupport.GroupConnectionWsClient, "fast")
+	limiter.Allow("b", connectionsupport.GroupConnectionWsClient, "fast")
+	if allow, _ := limiter.Allow("c", connectionsupport.GroupConnectionWsClient, "fast"); allow {
+		t.Error("Group limit must be exceeded.")
+	}
+	// without limits after reload
+	limiter.Setup(options.RateLimitOptions{})
+	if allow, _ := limiter.Allow("c", connectionsupport.GroupConnectionWsClient, "slow"); !allow {
+		t.Error("Call without limits must be allowed.")
+	}
+}
+
+func TestFreeCalls(t *testing.T) {
+	limiter := ratelimit.NewLimiter(options.RateLimitOptions{
+		Keys: map[string]options.RateLimit{"*": options.RateLimit{Rate: 0.1, Burst: 1}}})
+	limiter.Allow("svc", connectionsupport.GroupConnectionClient, "test")
+	if allow, _ := limiter.Allow("svc", connectionsupport.GroupConnectionClient, "test"); allow {
+		t.Fatal("Key limit must be exceeded.")
+	}
+	if allow, _ := limiter.Allow("svc", connectionsupport.GroupConnectionClient, "result"); !allow {
+		t.Error("Result of server must be allowed.")
+	}
+	if allow, _ := limiter.Allow("svc", connectionsupport.GroupConnectionServer, "test"); !allow {
+		t.Error("Server connection must be allowed.")
+	}
+	// anonymous connections don't share "*" bucket
+	for index := 0; index < 3; index++ {
+		if allow, _ := limiter.Allow("", connectionsupport.GroupConnectionClient, "test"); !allow {
+			t.Fatalf("Call %d without key must be allowed.", index)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"roolet/coreprocessing"
+	"roolet/cryptosupport"
+	"roolet/options"
+	"roolet/rllogger"
+	"roolet/statistic"
+	"roolet/transport"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reconnectDelay = 5 * time.Second
+	dialTimeout    = 10 * time.Second
+)
+
+// command or answer from active node
+type activeMessage struct {
+	Id     int                         `json:"id"`
+	Method string                      `json:"method"`
+	Params transport.MethodParams      `json:"params"`
+	Result string                      `json:"result"`
+	Error  *transport.ErrorDescription `json:"error"`
+}
+
+// standby side of replication, copies routes and results of active node
+type StandbyLink struct {
+	option     options.SysOption
+	stat       statistic.StatisticUpdater
+	rpcManager *coreprocessing.RpcServerManager
+	connection net.Conn
+	lock       sync.Mutex
+	cmdIndex   int
+	stopped    int32
+	wait       sync.WaitGroup
+}
+
+func NewStandbyLink(
+	option options.SysOption,
+	stat *statistic.Statistic,
+	rpcManager *coreprocessing.RpcServerManager) *StandbyLink {
+	//
+	stat.AddItem("replica_records", "Replicated records count")
+	stat.AddItem("replica_lost", "Active node lost count")
+	link := StandbyLink{option: option, stat: stat, rpcManager: rpcManager}
+	return &link
+}
+
+func (link *StandbyLink) isActive() bool {
+	return atomic.LoadInt32(&(link.stopped)) == 0
+}
+
+func (link *StandbyLink) send(method string, params transport.MethodParams) error {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+	(*link).cmdIndex++
+	data := transport.NewCommandWithParams((*link).cmdIndex, method, params).DataDump()
+	if data == nil {
+		return errors.New("Command dump problem.")
+	}
+	_, err := (*link).connection.Write(append(*data, byte('\n')))
+	return err
+}
+
+func readMessage(reader *bufio.Reader) (*activeMessage, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	msg := activeMessage{}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// send command and wait answer without error
+func (link *StandbyLink) request(
+	reader *bufio.Reader, method string, params transport.MethodParams) (*activeMessage, error) {
+	//
+	if err := link.send(method, params); err != nil {
+		return nil, err
+	}
+	msg, err := readMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Error != nil && msg.Error.Code > 0 {
+		return nil, errors.New(fmt.Sprintf("Method '%s' failed: %s", method, msg.Error))
+	}
+	return msg, nil
+}
+
+func (link *StandbyLink) session() error {
+	connection, err := net.DialTimeout("tcp", link.option.ReplicaOf, dialTimeout)
+	if err != nil {
+		return err
+	}
+	link.lock.Lock()
+	(*link).connection = connection
+	link.lock.Unlock()
+	defer connection.Close()
+	if !link.isActive() {
+		return nil
+	}
+	reader := bufio.NewReader(connection)
+	// name of active node for token audience
+	msg, err := link.request(reader, "ping", transport.MethodParams{})
+	if err != nil {
+		return err
+	}
+	ping := transport.PingResult{}
+	if err := json.Unmarshal([]byte(msg.Result), &ping); err != nil {
+		return err
+	}
+	token, err := cryptosupport.CreateNodeToken(link.option, ping.Node)
+	if err != nil {
+		return err
+	}
+	authParams := transport.MethodParams{
+		Json: fmt.Sprintf("{\"key\": \"%s\"}", link.option.GetPeerKey()),
+		Data: token}
+	if _, err := link.request(reader, "auth", authParams); err != nil {
+		return err
+	}
+	if _, err := link.request(reader, "replicate", transport.MethodParams{}); err != nil {
+		return err
+	}
+	rllogger.Outputf(rllogger.LogInfo, "Replication from %s started.", link.option.ReplicaOf)
+	rpcManager := link.rpcManager
+	for link.isActive() {
+		msg, err := readMessage(reader)
+		if err != nil {
+			return err
+		}
+		switch msg.Method {
+		case "replica":
+			{
+				record := coreprocessing.ReplicaRecord{}
+				if err := json.Unmarshal([]byte(msg.Params.Json), &record); err == nil {
+					rpcManager.ApplyReplica(record)
+					link.stat.AddOneMsg("replica_records")
+				} else {
+					rllogger.Outputf(rllogger.LogWarn, "Replica record format problem: %s", err)
+				}
+			}
+		case "ping":
+			{
+				// heartbeat, any command is an answer
+				if err := link.send("ping", transport.MethodParams{}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (link *StandbyLink) run() {
+	defer link.wait.Done()
+	for link.isActive() {
+		err := link.session()
+		if link.isActive() {
+			// results already copied can be taken from this node
+			link.stat.AddOneMsg("replica_lost")
+			rllogger.Outputf(
+				rllogger.LogWarn, "Active node %s lost (%s), serving replicated results.",
+				link.option.ReplicaOf, err)
+			for index := 0; index < int(reconnectDelay/time.Second) && link.isActive(); index++ {
+				time.Sleep(time.Second)
+			}
+		}
+	}
+}
+
+func (link *StandbyLink) Start() {
+	link.wait.Add(1)
+	go link.run()
+}
+
+func (link *StandbyLink) Stop() {
+	atomic.StoreInt32(&(link.stopped), 1)
+	link.lock.Lock()
+	if (*link).connection != nil {
+		(*link).connection.Close()
+	}
+	link.lock.Unlock()
+	link.wait.Wait()
+}
@@ -0,0 +1,95 @@
+package replication_test
+
+import (
+	"context"
+	"roolet/client"
+	"roolet/testsupport"
+	"roolet/transport"
+	"roolet/worker"
+	"testing"
+	"time"
+)
+
+// wait until check is true or timeout
+func waitFor(timeout time.Duration, check func() bool) bool {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(50 * time.Millisecond) {
+		if check() {
+			return true
+		}
+	}
+	return check()
+}
+
+func TestResultAfterFailover(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "svc", "cli")
+	testsupport.NewNodeKey(t, keyDir, "primary", "standby")
+	primaryOption := testsupport.NewOption(keyDir)
+	primaryOption.Node = "primary"
+	primaryOption.AdminKeys = []string{"standby"}
+	primary := testsupport.StartBroker(t, primaryOption, nil)
+	standbyOption := testsupport.NewOption(keyDir)
+	standbyOption.Node = "standby"
+	standbyOption.ReplicaOf = primary.Addr()
+	standby := testsupport.StartBroker(t, standbyOption, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rlWorker := worker.NewWorker(client.Option{Addr: primary.Addr(), Key: "svc", PrivateKey: keys["svc"]}, 2)
+	rlWorker.HandleFunc("test_double", func(ctx context.Context, params struct {
+		Value int `json:"value"`
+	}) (int, error) {
+		return params.Value * 2, nil
+	})
+	served := make(chan error, 1)
+	go func() { served <- rlWorker.Serve(ctx) }()
+	defer func() {
+		cancel()
+		<-served
+	}()
+	time.Sleep(500 * time.Millisecond)
+	cliOption := client.Option{Key: "cli", PrivateKey: keys["cli"]}
+	cliOption.Addr = primary.Addr()
+	rlClient, err := client.Dial(ctx, cliOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rlClient.Close()
+	replicated := func(taskId string) func() bool {
+		return func() bool { return standby.Core().RpcManager.ResultBufferDict.Exists(taskId) }
+	}
+	keptTask, err := rlClient.Call(ctx, "test_double", transport.MethodParams{Json: "{\"value\": 21}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	takenTask, err := rlClient.Call(ctx, "test_double", transport.MethodParams{Json: "{\"value\": 1}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(10*time.Second, replicated(keptTask)) || !waitFor(10*time.Second, replicated(takenTask)) {
+		t.Fatal("Results must be copied to standby node.")
+	}
+	// result taken on primary is removed on standby
+	if _, err := rlClient.Result(ctx, takenTask); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(10*time.Second, func() bool { return !replicated(takenTask)() }) {
+		t.Error("Taken result must be removed on standby node.")
+	}
+	rlClient.Close()
+	primary.Stop()
+
+	cliOption.Addr = standby.Addr()
+	standbyClient, err := client.Dial(ctx, cliOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standbyClient.Close()
+	result, err := standbyClient.Request(ctx, "getresult", transport.MethodParams{Task: keptTask})
+	if err != nil || result != "{\"result\":42}" {
+		t.Errorf("Result must be taken from standby node: %s %v", result, err)
+	}
+	_, err = standbyClient.Request(ctx, "getresult", transport.MethodParams{Task: takenTask})
+	if client.ErrorCode(err) != transport.ErrorCodeUnexpectedValue {
+		t.Errorf("Removed result can't be taken from standby node: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package resultstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"roolet/helpers"
+	"roolet/options"
+	"roolet/rllogger"
+)
+
+const (
+	StoreTypeMemory = "memory"
+	StoreTypeDisk   = "disk"
+	// disk store
+	diskStoreFileName = "results.data"
+	diskRecordSet     = byte(1)
+	diskRecordDelete  = byte(2)
+	diskHeaderSize    = 9
+	// rewrite the file when the dead records are more than that
+	diskCompactLimit = 1024
+)
+
+// storage for task results waiting for client
+type ResultStore interface {
+	Set(key, value string)
+	Get(key string) *string
+	Exists(key string) bool
+	Delete(key string)
+	Keys() []string
+	Size() int
+	Close() error
+}
+
+func NewResultStore(option options.SysOption) (ResultStore, error) {
+	switch option.ResultStore {
+	case "", StoreTypeMemory:
+		return NewMemoryResultStore(), nil
+	case StoreTypeDisk:
+		return NewDiskResultStore(option.ResultStoreDir)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown result store type: '%s'.", option.ResultStore))
+	}
+}
+
+// in-memory implementation
+type MemoryResultStore struct {
+	*helpers.AsyncStrDict
+}
+
+func NewMemoryResultStore() *MemoryResultStore {
+	store := MemoryResultStore{AsyncStrDict: helpers.NewAsyncStrDict()}
+	return &store
+}
+
+func (store *MemoryResultStore) Close() error {
+	store.Clear()
+	return nil
+}
+
+// embedded on-disk implementation
+// all records appended to one file, index of positions kept in memory
+type diskRecordPosition struct {
+	offset int64
+	size   int
+}
+
+type DiskResultStore struct {
+	helpers.AsyncSafeObject
+	filePath string
+	file     *os.File
+	index    map[string]diskRecordPosition
+	end      int64
+	dead     int
+}
+
+func NewDiskResultStore(dir string) (*DiskResultStore, error) {
+	if len(dir) == 0 {
+		return nil, errors.New("Directory for disk result store is not set.")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	store := DiskResultStore{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		filePath:        helpers.GetFullFilePath(dir, diskStoreFileName),
+		index:           make(map[string]diskRecordPosition)}
+	if err := store.open(); err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
+func encodeDiskRecord(op byte, key, value string) []byte {
+	data := make([]byte, diskHeaderSize+len(key)+len(value))
+	data[0] = op
+	binary.BigEndian.PutUint32(data[1:5], uint32(len(key)))
+	binary.BigEndian.PutUint32(data[5:diskHeaderSize], uint32(len(value)))
+	copy(data[diskHeaderSize:], key)
+	copy(data[diskHeaderSize+len(key):], value)
+	return data
+}
+
+// read file and build index
+func (store *DiskResultStore) open() error {
+	file, err := os.OpenFile((*store).filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	header := make([]byte, diskHeaderSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				file.Close()
+				return err
+			}
+			break
+		}
+		keySize := int(binary.BigEndian.Uint32(header[1:5]))
+		valueSize := int(binary.BigEndian.Uint32(header[5:diskHeaderSize]))
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			break
+		}
+		if _, err := reader.Discard(valueSize); err != nil {
+			break
+		}
+		if _, exists := (*store).index[string(key)]; exists {
+			(*store).dead++
+		}
+		switch header[0] {
+		case diskRecordSet:
+			(*store).index[string(key)] = diskRecordPosition{
+				offset: offset + int64(diskHeaderSize+keySize),
+				size:   valueSize}
+		case diskRecordDelete:
+			delete((*store).index, string(key))
+			(*store).dead++
+		}
+		offset += int64(diskHeaderSize + keySize + valueSize)
+	}
+	// cut broken tail after crash
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return err
+	}
+	(*store).file = file
+	(*store).end = offset
+	return nil
+}
+
+func (store *DiskResultStore) write(op byte, key, value string) error {
+	data := encodeDiskRecord(op, key, value)
+	if _, err := (*store).file.WriteAt(data, (*store).end); err != nil {
+		return err
+	}
+	if _, exists := (*store).index[key]; exists {
+		(*store).dead++
+	}
+	if op == diskRecordSet {
+		(*store).index[key] = diskRecordPosition{
+			offset: (*store).end + int64(diskHeaderSize+len(key)),
+			size:   len(value)}
+	} else {
+		delete((*store).index, key)
+		(*store).dead++
+	}
+	(*store).end += int64(len(data))
+	return nil
+}
+
+func (store *DiskResultStore) read(key string) (*string, error) {
+	if pos, exists := (*store).index[key]; exists {
+		data := make([]byte, pos.size)
+		if _, err := (*store).file.ReadAt(data, pos.offset); err != nil {
+			return nil, err
+		}
+		result := string(data)
+		return &result, nil
+	}
+	return nil, nil
+}
+
+// rewrite file with live records only
+func (store *DiskResultStore) compact() error {
+	tmpPath := fmt.Sprintf("%s.tmp", (*store).filePath)
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	newIndex := make(map[string]diskRecordPosition, len((*store).index))
+	var offset int64
+	for key, _ := range (*store).index {
+		value, err := store.read(key)
+		if err == nil {
+			data := encodeDiskRecord(diskRecordSet, key, *value)
+			_, err = tmpFile.WriteAt(data, offset)
+			newIndex[key] = diskRecordPosition{
+				offset: offset + int64(diskHeaderSize+len(key)),
+				size:   len(*value)}
+			offset += int64(len(data))
+		}
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, (*store).filePath); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	(*store).file.Close()
+	(*store).file = tmpFile
+	(*store).index = newIndex
+	(*store).end = offset
+	(*store).dead = 0
+	return nil
+}
+
+func (store *DiskResultStore) checkCompact() {
+	if (*store).dead > diskCompactLimit && (*store).dead > len((*store).index) {
+		if err := store.compact(); err != nil {
+			rllogger.Outputf(rllogger.LogError, "Result store compact problem: %s", err)
+		}
+	}
+}
+
+func (store *DiskResultStore) Set(key, value string) {
+	store.Lock(true)
+	defer store.Unlock(true)
+	if err := store.write(diskRecordSet, key, value); err != nil {
+		rllogger.Outputf(rllogger.LogError, "Result store can't save %s: %s", key, err)
+	} else {
+		store.checkCompact()
+	}
+}
+
+func (store *DiskResultStore) Get(key string) *string {
+	store.Lock(false)
+	defer store.Unlock(false)
+	result, err := store.read(key)
+	if err != nil {
+		rllogger.Outputf(rllogger.LogError, "Result store can't read %s: %s", key, err)
+	}
+	return result
+}
+
+func (store *DiskResultStore) Exists(key string) bool {
+	store.Lock(false)
+	defer store.Unlock(false)
+	_, exists := (*store).index[key]
+	return exists
+}
+
+func (store *DiskResultStore) Delete(key string) {
+	store.Lock(true)
+	defer store.Unlock(true)
+	if _, exists := (*store).index[key]; exists {
+		if err := store.write(diskRecordDelete, key, ""); err != nil {
+			rllogger.Outputf(rllogger.LogError, "Result store can't delete %s: %s", key, err)
+		} else {
+			store.checkCompact()
+		}
+	}
+}
+
+func (store *DiskResultStore) Keys() []string {
+	store.Lock(false)
+	defer store.Unlock(false)
+	result := make([]string, 0, len((*store).index))
+	for key, _ := range (*store).index {
+		result = append(result, key)
+	}
+	return result
+}
+
+func (store *DiskResultStore) Size() int {
+	store.Lock(false)
+	defer store.Unlock(false)
+	return len((*store).index)
+}
+
+func (store *DiskResultStore) Close() error {
+	store.Lock(true)
+	defer store.Unlock(true)
+	return (*store).file.Close()
+}
@@ -0,0 +1,106 @@
+package resultstore_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"roolet/options"
+	"roolet/resultstore"
+	"testing"
+)
+
+func checkStoreSimple(t *testing.T, store resultstore.ResultStore) {
+	store.Set("task1", "{\"result\": 1}")
+	store.Set("task2", "{\"result\": 2}")
+	store.Set("task1", "{\"result\": 3}")
+	if value := store.Get("task1"); value == nil || *value != "{\"result\": 3}" {
+		t.Errorf("Incorrect value of task1: %v", value)
+	}
+	if store.Size() != 2 {
+		t.Errorf("Incorrect size: %d", store.Size())
+	}
+	store.Delete("task2")
+	if store.Exists("task2") || store.Get("task2") != nil {
+		t.Error("Value of task2 must be removed.")
+	}
+}
+
+func TestMemoryStoreSimple(t *testing.T) {
+	store, err := resultstore.NewResultStore(options.SysOption{})
+	if err != nil {
+		t.Fatalf("Can't create store: %s", err)
+	}
+	defer store.Close()
+	checkStoreSimple(t, store)
+}
+
+func TestUnknownStoreType(t *testing.T) {
+	if _, err := resultstore.NewResultStore(options.SysOption{ResultStore: "redis"}); err == nil {
+		t.Error("Unknown store type must be an error.")
+	}
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roolet-results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	option := options.SysOption{ResultStore: resultstore.StoreTypeDisk, ResultStoreDir: dir}
+	store, err := resultstore.NewResultStore(option)
+	if err != nil {
+		t.Fatalf("Can't create store: %s", err)
+	}
+	checkStoreSimple(t, store)
+	store.Close()
+	// index must be restored from file
+	store, err = resultstore.NewResultStore(option)
+	if err != nil {
+		t.Fatalf("Can't open store: %s", err)
+	}
+	defer store.Close()
+	if value := store.Get("task1"); value == nil || *value != "{\"result\": 3}" {
+		t.Errorf("Lost value of task1 after reopen: %v", value)
+	}
+	if store.Exists("task2") || store.Size() != 1 {
+		t.Errorf("Incorrect state after reopen, size: %d", store.Size())
+	}
+}
+
+func TestDiskStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roolet-results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := resultstore.NewDiskResultStore(dir)
+	if err != nil {
+		t.Fatalf("Can't create store: %s", err)
+	}
+	defer store.Close()
+	count := 5000
+	for index := 0; index < count; index++ {
+		key := fmt.Sprintf("task%d", index)
+		store.Set(key, fmt.Sprintf("{\"result\": %d}", index))
+		if index%10 != 0 {
+			store.Delete(key)
+		}
+	}
+	if store.Size() != count/10 {
+		t.Errorf("Incorrect size: %d", store.Size())
+	}
+	for index := 0; index < count; index += 10 {
+		value := store.Get(fmt.Sprintf("task%d", index))
+		if value == nil || *value != fmt.Sprintf("{\"result\": %d}", index) {
+			t.Fatalf("Incorrect value of task%d: %v", index, value)
+		}
+	}
+	if info, err := os.Stat(fmt.Sprintf("%s/results.data", dir)); err == nil {
+		t.Logf("File size: %d", info.Size())
+		if info.Size() > int64(count*40) {
+			t.Error("File was not compacted.")
+		}
+	} else {
+		t.Error(err)
+	}
+}
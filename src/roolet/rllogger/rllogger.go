@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -18,8 +20,32 @@ const (
 
 var silentLog bool = false
 
+// minimal level of output, debug messages also enabled by environment
+var minLevel int32 = LogInfo
+
 func UseLogDebug() bool {
-	return (os.Getenv("RLLOG") == "DEBUG")
+	return (os.Getenv("RLLOG") == "DEBUG" || atomic.LoadInt32(&minLevel) == LogDebug)
+}
+
+func SetLevel(level int) {
+	if level > LogError {
+		level = LogError
+	}
+	atomic.StoreInt32(&minLevel, int32(level))
+}
+
+func GetLevelByName(name string) (int, bool) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LogDebug, true
+	case "info", "":
+		return LogInfo, true
+	case "warn", "warning":
+		return LogWarn, true
+	case "error":
+		return LogError, true
+	}
+	return LogInfo, false
 }
 
 func IsSilent() bool {
@@ -43,6 +69,9 @@ func Output(level int, msg string) {
 	if IsSilent() {
 		return
 	}
+	if level > LogDebug && level < LogTerminate && int32(level) < atomic.LoadInt32(&minLevel) {
+		return
+	}
 	switch level {
 	case LogDebug:
 		{
@@ -10,13 +10,18 @@ import (
 	"roolet/rllogger"
 )
 
-var toolType, toolData string
+var toolType, toolData, toolMethodName, toolKey, toolKeyFile string
+var toolTimeout int
 
 type toolMethod func(string, *options.SysOption)
 
 func init() {
 	flag.StringVar(&toolType, "tool", "", "Tools command")
 	flag.StringVar(&toolData, "data", "", "Data for tools command")
+	flag.StringVar(&toolMethodName, "method", "", "Method for call tool")
+	flag.StringVar(&toolKey, "key", "", "Key name for call (peer key by default), keygen, enroll and token tools")
+	flag.StringVar(&toolKeyFile, "keyfile", "", "Private key of -key for call tool (from KeyDir/client by default)")
+	flag.IntVar(&toolTimeout, "timeout", 30, "Timeout of call tool in seconds")
 }
 
 func main() {
@@ -31,6 +36,10 @@ func main() {
 			toolMethods["jwtcreate"] = cryptosupport.JwtCreate
 			toolMethods["jwtcheck"] = cryptosupport.JwtCheck
 			toolMethods["keyscheck"] = cryptosupport.KeysSimpleCheck
+			toolMethods["call"] = callTool
+			toolMethods["keygen"] = keygenTool
+			toolMethods["enroll"] = enrollTool
+			toolMethods["token"] = tokenTool
 
 			if method, exists := toolMethods[toolType]; exists {
 				method(toolData, option)
@@ -39,7 +48,7 @@ func main() {
 			}
 		} else {
 			// run as service
-			corelauncher.Launch(option)
+			corelauncher.Launch(option, optionSrc)
 		}
 	} else {
 		rllogger.Outputf(rllogger.LogTerminate, "Option load failed: %s", err)
@@ -72,7 +72,9 @@ type StatisticUpdater interface {
 
 type Statistic struct {
 	closeChan        chan bool
+	doneChan         chan bool
 	messages         chan StatMsg
+	reloadChan       chan options.SysOption
 	calcHandlers     []AutoCalcHandler
 	outHandlers      []StatisticOutHandler
 	items            map[string]StatValueType
@@ -80,6 +82,7 @@ type Statistic struct {
 	silent           bool
 	active           bool
 	iterTime         int
+	filePath         string
 	msgCount         int64
 	lastSendTime     time.Time
 	activeChangeLock *sync.RWMutex
@@ -90,8 +93,17 @@ func statProcessing(stat *Statistic) {
 	out := func() {
 		rllogger.Output(rllogger.LogInfo, "Statistic closing...")
 		timer.Stop()
+		// flush last messages
+		for len((*stat).messages) > 0 {
+			msg := <-(*stat).messages
+			stat.add(&msg)
+		}
+		(*stat).lastSendTime = time.Now()
+		stat.calc()
+		stat.SendResult()
 		close((*stat).closeChan)
 		close((*stat).messages)
+		close((*stat).doneChan)
 	}
 	defer out()
 	for (*stat).active {
@@ -104,6 +116,14 @@ func statProcessing(stat *Statistic) {
 			{
 				stat.stop()
 			}
+		case option := <-(*stat).reloadChan:
+			{
+				if option.StatisticCheckTime > 0 && option.StatisticCheckTime != (*stat).iterTime {
+					(*stat).iterTime = option.StatisticCheckTime
+					timer.Reset(time.Duration((*stat).iterTime) * time.Second)
+				}
+				(*stat).filePath = option.StatisticFile
+			}
 		case now := <-timer.C:
 			{
 				(*stat).lastSendTime = now
@@ -119,8 +139,11 @@ func NewStatistic(option options.SysOption) *Statistic {
 		active:           true,
 		activeChangeLock: new(sync.RWMutex),
 		messages:         make(chan StatMsg, StatBufferSize),
+		reloadChan:       make(chan options.SysOption, 1),
 		closeChan:        make(chan bool, 1),
+		doneChan:         make(chan bool),
 		iterTime:         option.StatisticCheckTime,
+		filePath:         option.StatisticFile,
 		calcHandlers:     make([]AutoCalcHandler, HandlerCountLimit),
 		items:            make(map[string]StatValueType),
 		labels:           make(map[string]string),
@@ -131,34 +154,41 @@ func NewStatistic(option options.SysOption) *Statistic {
 	}
 
 	go statProcessing(&stat)
-	// save to file support
-	if len(option.StatisticFile) > 0 {
-		statFilePath := option.StatisticFile
-		logFileSaveHandler := func(now time.Time, lines *[]string) {
-			// copy file
-			newFilePath := fmt.Sprintf("%s.%d.tmp", statFilePath, now.Unix())
-			hasCopy := helpers.CopyFile(newFilePath, statFilePath) == nil
-			if hasCopy {
-				os.Remove(statFilePath)
-			}
-			if newFile, err := os.Create(statFilePath); err == nil {
-				defer newFile.Close()
-				writer := bufio.NewWriter(newFile)
-				for _, line := range *lines {
-					writer.WriteString(line)
-					writer.WriteRune('\n')
-					writer.Flush()
-				}
-			} else {
-				rllogger.Outputf(rllogger.LogWarn, "Statistic file %s not avalible!", statFilePath)
-			}
-			if hasCopy {
-				os.Remove(newFilePath)
-			}
+	return &stat
+}
+
+// save to file support
+func (stat *Statistic) saveToFile(now time.Time, lines *[]string) {
+	statFilePath := (*stat).filePath
+	// copy file
+	newFilePath := fmt.Sprintf("%s.%d.tmp", statFilePath, now.Unix())
+	hasCopy := helpers.CopyFile(newFilePath, statFilePath) == nil
+	if hasCopy {
+		os.Remove(statFilePath)
+	}
+	if newFile, err := os.Create(statFilePath); err == nil {
+		defer newFile.Close()
+		writer := bufio.NewWriter(newFile)
+		for _, line := range *lines {
+			writer.WriteString(line)
+			writer.WriteRune('\n')
+			writer.Flush()
 		}
-		stat.AddStatisticOutHandler(logFileSaveHandler)
+	} else {
+		rllogger.Outputf(rllogger.LogWarn, "Statistic file %s not avalible!", statFilePath)
+	}
+	if hasCopy {
+		os.Remove(newFilePath)
+	}
+}
+
+// apply new period and file
+func (stat *Statistic) Reload(option options.SysOption) {
+	(*stat).activeChangeLock.RLock()
+	defer (*stat).activeChangeLock.RUnlock()
+	if (*stat).active {
+		(*stat).reloadChan <- option
 	}
-	return &stat
 }
 
 func (stat *Statistic) SendMsg(code string, value interface{}) {
@@ -178,9 +208,11 @@ func (stat *Statistic) DelOneMsg(code string) {
 	stat.SendMsg(code, -1)
 }
 
+// last result sent before return
 func (stat *Statistic) Close() {
 	if (*stat).active {
 		(*stat).closeChan <- true
+		<-(*stat).doneChan
 	}
 }
 
@@ -205,6 +237,9 @@ func (stat *Statistic) SendResult() {
 		allLines[1+index] = ln
 	}
 	rllogger.OutputLines(rllogger.LogInfo, "statistic", &allLines)
+	if len((*stat).filePath) > 0 {
+		stat.saveToFile((*stat).lastSendTime, &allLines)
+	}
 	if len((*stat).outHandlers) > 0 {
 		for _, outHandler := range (*stat).outHandlers {
 			outHandler((*stat).lastSendTime, &allLines)
@@ -258,9 +293,22 @@ func (stat *Statistic) calc() {
 }
 
 func (stat *Statistic) stop() {
-	(*stat).activeChangeLock.Lock()
-	defer (*stat).activeChangeLock.Unlock()
-	(*stat).active = false
+	locked := make(chan bool)
+	go func() {
+		(*stat).activeChangeLock.Lock()
+		(*stat).active = false
+		(*stat).activeChangeLock.Unlock()
+		close(locked)
+	}()
+	// senders wait on full channel with read lock
+	for {
+		select {
+		case msg := <-(*stat).messages:
+			stat.add(&msg)
+		case <-locked:
+			return
+		}
+	}
 }
 
 // testing only (not use it)
@@ -0,0 +1,92 @@
+package testsupport
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"roolet/broker"
+	"roolet/options"
+	"testing"
+)
+
+// key directory with Ed25519 public keys of clients (removed after test)
+func NewKeyDir(t *testing.T, names ...string) (string, map[string]ed25519.PrivateKey) {
+	keyDir, err := ioutil.TempDir("", "roolet-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(keyDir) })
+	if err := os.Mkdir(path.Join(keyDir, "pub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]ed25519.PrivateKey)
+	for _, name := range names {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := x509.MarshalPKIXPublicKey(public)
+		content := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: data})
+		if err := ioutil.WriteFile(path.Join(keyDir, "pub", name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = private
+	}
+	return keyDir, keys
+}
+
+// signing key of node in key directory, public key is added for each node name
+// (nodes of one test use same key directory)
+func NewNodeKey(t *testing.T, keyDir string, nodes ...string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privData, _ := x509.MarshalPKCS8PrivateKey(private)
+	pubData, _ := x509.MarshalPKIXPublicKey(public)
+	files := map[string][]byte{
+		"key.priv": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privData}),
+		"key.pub":  pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubData})}
+	for _, node := range nodes {
+		files[path.Join("pub", node)] = files["key.pub"]
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(keyDir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// options of node on free port
+func NewOption(keyDir string) options.SysOption {
+	return options.SysOption{
+		Port:            0,
+		Addr:            "127.0.0.1",
+		BufferSize:      64,
+		Workers:         2,
+		Node:            "testnode",
+		KeyDir:          keyDir,
+		LogLevel:        "error",
+		ShutdownTimeout: 1}
+}
+
+// started node, setup is called before start, node stopped after test
+func StartBroker(t *testing.T, option options.SysOption, setup func(node *broker.Broker)) *broker.Broker {
+	node, err := broker.NewBroker(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(node)
+	}
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Stop)
+	return node
+}
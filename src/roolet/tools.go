@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"roolet/client"
+	"roolet/cryptosupport"
+	"roolet/options"
+	"roolet/transport"
+	"strings"
+	"time"
+)
+
+// exit code if result of method has error
+const callToolMethodErrorExit = 2
+
+// call method on running node with private key of -key (node key by default),
+// params as JSON from data or stdin
+func callTool(data string, option *options.SysOption) {
+	if len(toolMethodName) == 0 {
+		log.Fatalln("Write method name with -method")
+	}
+	if len(data) == 0 {
+		data = strings.TrimSpace(string(readStdin()))
+	}
+	if len(data) > 0 && !json.Valid([]byte(data)) {
+		log.Fatalf("Params must be JSON: '%s'\n", data)
+	}
+	var key crypto.PrivateKey
+	keyName := toolKey
+	if len(keyName) == 0 {
+		// node key as peer
+		var err error
+		keyName = option.GetPeerKey()
+		if key, err = cryptosupport.GetSigningKey(*option); err != nil {
+			log.Fatalf("Open key problem: %s\n", err)
+		}
+	} else {
+		key = readClientKey(option, toolKeyFile)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(toolTimeout)*time.Second)
+	defer cancel()
+	rlClient, err := client.Dial(
+		ctx, client.Option{Addr: option.Socket(), Key: keyName, PrivateKey: key})
+	if err != nil {
+		log.Fatalf("Connection problem: %s\n", err)
+	}
+	result, err := rlClient.CallWait(ctx, toolMethodName, transport.MethodParams{Json: data})
+	rlClient.Close()
+	if err != nil {
+		log.Fatalf("Call problem: %s\n", err)
+	}
+	fmt.Println(result)
+	answer := struct {
+		Error *transport.ErrorDescription `json:"error"`
+	}{}
+	if json.Unmarshal([]byte(result), &answer) == nil && answer.Error != nil {
+		os.Exit(callToolMethodErrorExit)
+	}
+}
+
+// tools data from stdin
+func readStdin() []byte {
+	content, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Read data problem: %s\n", err)
+	}
+	return content
+}
+
+// key pair of node or of client with -key (public key is enrolled), data is key type
+func keygenTool(data string, option *options.SysOption) {
+	key, err := cryptosupport.GenerateKey(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(toolKey) == 0 {
+		if err := cryptosupport.WriteNodeKey(*option, key); err != nil {
+			log.Fatalf("Write key problem: %s\n", err)
+		}
+		log.Printf("Node key created: %s, %s\n", option.GetPrivKeyPath(), option.GetPubKeyPath())
+	} else {
+		if err := cryptosupport.WriteClientKey(*option, toolKey, key); err != nil {
+			log.Fatalf("Write key problem: %s\n", err)
+		}
+		log.Printf("Client key '%s' created: %s\n", toolKey, cryptosupport.ClientPrivKeyPath(*option, toolKey))
+	}
+}
+
+// public key of client from file (data) or stdin to KeyDir/pub
+func enrollTool(data string, option *options.SysOption) {
+	if len(toolKey) == 0 {
+		log.Fatalln("Write key name with -key")
+	}
+	var content []byte
+	if len(data) > 0 {
+		var err error
+		if content, err = ioutil.ReadFile(data); err != nil {
+			log.Fatalf("Read key problem: %s\n", err)
+		}
+	} else {
+		content = readStdin()
+	}
+	if err := cryptosupport.EnrollKey(*option, toolKey, content); err != nil {
+		log.Fatalf("Enroll problem: %s\n", err)
+	}
+	log.Printf("Key '%s' enrolled in %s\n", toolKey, option.GetClientPubKeyDir())
+}
+
+// private key of -key from file or from KeyDir/client
+func readClientKey(option *options.SysOption, filePath string) crypto.PrivateKey {
+	if len(filePath) == 0 {
+		filePath = cryptosupport.ClientPrivKeyPath(*option, toolKey)
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		log.Fatalf("Read key problem: %s\n", err)
+	}
+	key, err := options.ParsePrivateKey(content)
+	if err != nil {
+		log.Fatalf("Private key problem: %s\n", err)
+	}
+	return key
+}
+
+// auth token of client key for node, private key from file (data)
+// or from KeyDir/client
+func tokenTool(data string, option *options.SysOption) {
+	if len(toolKey) == 0 {
+		log.Fatalln("Write key name with -key")
+	}
+	token, err := cryptosupport.CreateClientToken(*option, toolKey, readClientKey(option, data))
+	if err != nil {
+		log.Fatalf("Token problem: %s\n", err)
+	}
+	fmt.Println(token)
+}
@@ -16,6 +16,10 @@ const (
 	ErrorCodeUnexpectedValue         = 6
 	ErrorCodeRemouteMethodNotExists  = 7
 	ErrorCodeAllServerBusy           = 8
+	ErrorCodeResultNotReady          = 9
+	ErrorCodeShuttingDown            = 10
+	ErrorCodeRateLimited             = 11
+	ErrorCodeQuotaExceeded           = 12
 )
 
 // helper
@@ -58,6 +62,8 @@ type Command struct {
 type ErrorDescription struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	// additional information, as retry time
+	Data interface{} `json:"data,omitempty"`
 }
 
 func (errorDes ErrorDescription) String() string {
@@ -75,6 +81,13 @@ type Answer struct {
 	Error ErrorDescription `json:"error"`
 }
 
+// result of ping, node name is audience of auth token
+type PingResult struct {
+	Data   int    `json:"data"`
+	Exists bool   `json:"exists"`
+	Node   string `json:"node"`
+}
+
 func (ans *Answer) Dump() (*string, error) {
 	(*ans).Jsonrpc = JSONRpcVersion
 	var resultErr error
@@ -0,0 +1,286 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"roolet/client"
+	"roolet/connectionsupport"
+	"roolet/helpers"
+	"roolet/rllogger"
+	"roolet/transport"
+	"sync"
+	"time"
+)
+
+const (
+	// result is sent after reconnect too
+	resultTimeout = 30 * time.Second
+	// event from node in drain state
+	methodDrained = "drained"
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// result is dumped to JSON as {"result": ...}, error as {"error": ...}
+type Method func(ctx context.Context, params transport.MethodParams) (interface{}, error)
+
+// server of methods: registration, status of pool and results
+type Worker struct {
+	helpers.AsyncSafeObject
+	option  client.Option
+	methods map[string]Method
+	// pool of executors
+	slots    chan struct{}
+	running  int
+	busy     bool
+	draining bool
+	stopped  bool
+	drained  chan struct{}
+	client   *client.Client
+	wait     sync.WaitGroup
+}
+
+// size of pool is count of concurrent tasks, 1 by default
+func NewWorker(option client.Option, size int) *Worker {
+	if size <= 0 {
+		size = 1
+	}
+	worker := Worker{
+		AsyncSafeObject: *(helpers.NewAsyncSafeObject()),
+		option:          option,
+		methods:         make(map[string]Method),
+		slots:           make(chan struct{}, size),
+		drained:         make(chan struct{})}
+	return &worker
+}
+
+// use it before Serve()
+func (worker *Worker) Handle(name string, method Method) {
+	(*worker).methods[name] = method
+}
+
+// typed method func(context.Context, T) (R, error), T is loaded from params.Json
+func (worker *Worker) HandleFunc(name string, fn interface{}) error {
+	value := reflect.ValueOf(fn)
+	fnType := value.Type()
+	if fnType.Kind() != reflect.Func ||
+		fnType.NumIn() != 2 || fnType.In(0) != contextType ||
+		fnType.NumOut() != 2 || fnType.Out(1) != errorType {
+		//
+		return errors.New(fmt.Sprintf("Method '%s' must be func(context.Context, T) (R, error).", name))
+	}
+	argType := fnType.In(1)
+	worker.Handle(name, func(ctx context.Context, params transport.MethodParams) (interface{}, error) {
+		arg := reflect.New(argType)
+		if len(params.Json) > 0 {
+			if err := json.Unmarshal([]byte(params.Json), arg.Interface()); err != nil {
+				return nil, paramsError{err}
+			}
+		}
+		out := value.Call([]reflect.Value{reflect.ValueOf(ctx), arg.Elem()})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return nil, err
+		}
+		return out[0].Interface(), nil
+	})
+	return nil
+}
+
+type paramsError struct {
+	err error
+}
+
+func (err paramsError) Error() string {
+	return fmt.Sprintf("Params format error: %s", err.err)
+}
+
+func (worker *Worker) names() []string {
+	result := make([]string, 0, len((*worker).methods))
+	for name := range (*worker).methods {
+		result = append(result, name)
+	}
+	return result
+}
+
+// connection works until end of context, tasks in progress are
+// finished before return (use Drain() before it),
+// context of tasks isn't canceled by end of this context
+func (worker *Worker) Serve(ctx context.Context) error {
+	if len((*worker).methods) == 0 {
+		return errors.New("Worker without methods.")
+	}
+	taskCtx, cancelTasks := context.WithCancel(context.Background())
+	defer cancelTasks()
+	option := (*worker).option
+	option.Methods = worker.names()
+	option.OnCommand = func(method string, params transport.MethodParams) {
+		worker.command(taskCtx, method, params)
+	}
+	option.OnConnect = worker.restoreStatus
+	rlClient, err := client.Dial(ctx, option)
+	if err != nil {
+		return err
+	}
+	worker.Lock(true)
+	(*worker).client = rlClient
+	worker.Unlock(true)
+	<-ctx.Done()
+	worker.Lock(true)
+	(*worker).stopped = true
+	worker.Unlock(true)
+	worker.wait.Wait()
+	rlClient.Close()
+	return nil
+}
+
+func (worker *Worker) command(ctx context.Context, method string, params transport.MethodParams) {
+	worker.Lock(true)
+	defer worker.Unlock(true)
+	if method == methodDrained {
+		// drain can be forced by admin of node
+		select {
+		case <-(*worker).drained:
+		default:
+			close((*worker).drained)
+		}
+		(*worker).draining = true
+		return
+	}
+	if len(params.Task) == 0 || (*worker).stopped {
+		rllogger.Outputf(rllogger.LogWarn, "Command '%s' rejected, task: '%s'.", method, params.Task)
+		return
+	}
+	worker.wait.Add(1)
+	go worker.execute(ctx, method, params)
+}
+
+// status update, drain state is kept until end
+func (worker *Worker) setStatus(status int) {
+	worker.Lock(false)
+	rlClient := (*worker).client
+	skip := (*worker).draining || rlClient == nil
+	worker.Unlock(false)
+	if skip {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resultTimeout)
+	defer cancel()
+	if _, err := rlClient.Request(ctx, "statusupdate", transport.MethodParams{Data: fmt.Sprint(status)}); err != nil {
+		rllogger.Outputf(rllogger.LogWarn, "Status update problem: %s", err)
+	}
+}
+
+// new connection has active status
+func (worker *Worker) restoreStatus(rlClient *client.Client) {
+	worker.Lock(false)
+	busy := (*worker).busy
+	draining := (*worker).draining
+	worker.Unlock(false)
+	ctx, cancel := context.WithTimeout(context.Background(), resultTimeout)
+	defer cancel()
+	var err error
+	if draining {
+		_, err = rlClient.Request(
+			ctx, "statusupdate", transport.MethodParams{Data: fmt.Sprint(connectionsupport.ClientStatusDrain)})
+	} else if busy {
+		_, err = rlClient.Request(
+			ctx, "statusupdate", transport.MethodParams{Data: fmt.Sprint(connectionsupport.ClientStatusBusy)})
+	}
+	if err != nil {
+		rllogger.Outputf(rllogger.LogWarn, "Status update problem: %s", err)
+	}
+}
+
+func (worker *Worker) execute(ctx context.Context, method string, params transport.MethodParams) {
+	defer worker.wait.Done()
+	worker.slots <- struct{}{}
+	worker.Lock(true)
+	(*worker).running++
+	busy := !(*worker).busy && (*worker).running == cap((*worker).slots)
+	if busy {
+		(*worker).busy = true
+	}
+	worker.Unlock(true)
+	if busy {
+		worker.setStatus(connectionsupport.ClientStatusBusy)
+	}
+	data := call(ctx, (*worker).methods[method], method, params)
+	worker.Lock(true)
+	(*worker).running--
+	// node sets active status by result
+	(*worker).busy = false
+	rlClient := (*worker).client
+	worker.Unlock(true)
+	<-worker.slots
+	resultCtx, cancel := context.WithTimeout(context.Background(), resultTimeout)
+	defer cancel()
+	if _, err := rlClient.Request(resultCtx, "result", transport.MethodParams{Task: params.Task, Json: data}); err != nil {
+		rllogger.Outputf(rllogger.LogError, "Result of task %s lost: %s", params.Task, err)
+	}
+}
+
+// panic of method is error of task, other tasks continue
+func safeCall(ctx context.Context, method Method, params transport.MethodParams) (value interface{}, err error) {
+	defer func() {
+		if problem := recover(); problem != nil {
+			rllogger.Outputf(rllogger.LogError, "Method of task %s panic: %v", params.Task, problem)
+			value = nil
+			err = errors.New(fmt.Sprintf("Method problem: %v", problem))
+		}
+	}()
+	return method(ctx, params)
+}
+
+// result of method in format of server result
+func call(ctx context.Context, method Method, name string, params transport.MethodParams) string {
+	data := make(map[string]interface{})
+	if method == nil {
+		data["error"] = transport.ErrorDescription{
+			Code:    transport.ErrorCodeRemouteMethodNotExists,
+			Message: fmt.Sprintf("Method '%s' not found.", name)}
+	} else if value, err := safeCall(ctx, method, params); err == nil {
+		data["result"] = value
+	} else {
+		code := transport.ErrorCodeInternalProblem
+		if _, isParams := err.(paramsError); isParams {
+			code = transport.ErrorCodeMethodParamsFormatWrong
+		}
+		data["error"] = transport.ErrorDescription{Code: code, Message: err.Error()}
+	}
+	result, err := json.Marshal(data)
+	if err != nil {
+		result, _ = json.Marshal(map[string]interface{}{
+			"error": transport.ErrorDescription{
+				Code:    transport.ErrorCodeInternalProblem,
+				Message: fmt.Sprintf("Error dump %T: '%s'", data["result"], err)}})
+	}
+	return string(result)
+}
+
+// no new tasks, returns after "drained" event (all tasks finished),
+// drain state is kept until end
+func (worker *Worker) Drain(ctx context.Context) error {
+	worker.Lock(true)
+	rlClient := (*worker).client
+	(*worker).draining = rlClient != nil
+	drained := (*worker).drained
+	worker.Unlock(true)
+	if rlClient == nil {
+		return errors.New("Worker isn't connected.")
+	}
+	_, err := rlClient.Request(
+		ctx, "statusupdate", transport.MethodParams{Data: fmt.Sprint(connectionsupport.ClientStatusDrain)})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
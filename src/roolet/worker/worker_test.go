@@ -0,0 +1,190 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"roolet/client"
+	"roolet/options"
+	"roolet/testsupport"
+	"roolet/transport"
+	"roolet/worker"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sumParams struct {
+	Values []int `json:"values"`
+}
+
+func sum(ctx context.Context, params sumParams) (int, error) {
+	if len(params.Values) == 0 {
+		return 0, errors.New("Values not found.")
+	}
+	result := 0
+	for _, value := range params.Values {
+		result += value
+	}
+	return result, nil
+}
+
+func TestWorkerMethods(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "svc")
+	node := testsupport.StartBroker(t, testsupport.NewOption(keyDir), nil)
+	clientOption := client.Option{Addr: node.Addr(), Key: "svc", PrivateKey: keys["svc"]}
+	rlWorker := worker.NewWorker(clientOption, 2)
+	if err := rlWorker.HandleFunc("test_sum", sum); err != nil {
+		t.Fatal(err)
+	}
+	if err := rlWorker.HandleFunc("test_wrong", func(value int) int { return value }); err == nil {
+		t.Error("Wrong method signature accepted.")
+	}
+	rlWorker.Handle("test_panic", func(ctx context.Context, params transport.MethodParams) (interface{}, error) {
+		panic("broken method")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	serveCtx, stop := context.WithCancel(ctx)
+	served := make(chan error, 1)
+	go func() { served <- rlWorker.Serve(serveCtx) }()
+	// wait registration
+	time.Sleep(500 * time.Millisecond)
+	rlClient, err := client.Dial(ctx, clientOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rlClient.Close()
+	cases := []struct {
+		json string
+		code int
+	}{
+		{"{\"values\": [1, 2, 3]}", 0},
+		{"{\"values\": \"x\"}", transport.ErrorCodeMethodParamsFormatWrong},
+		{"{}", transport.ErrorCodeInternalProblem}}
+	for _, testCase := range cases {
+		result, err := rlClient.CallWait(ctx, "test_sum", transport.MethodParams{Json: testCase.json})
+		if err != nil {
+			t.Fatalf("Call failed: %s", err)
+		}
+		answer := struct {
+			Result int                        `json:"result"`
+			Error  transport.ErrorDescription `json:"error"`
+		}{}
+		if err := json.Unmarshal([]byte(result), &answer); err != nil {
+			t.Fatalf("Wrong result %s: %s", result, err)
+		}
+		if answer.Error.Code != testCase.code || (testCase.code == 0 && answer.Result != 6) {
+			t.Errorf("Unexpected result for %s: %s", testCase.json, result)
+		}
+	}
+	if result, err := rlClient.CallWait(ctx, "test_panic", transport.MethodParams{}); err != nil ||
+		!strings.Contains(result, fmt.Sprintf("\"code\":%d", transport.ErrorCodeInternalProblem)) {
+		//
+		t.Errorf("Panic of method must be error of task: %s %v", result, err)
+	}
+	if err := rlWorker.Drain(ctx); err != nil {
+		t.Errorf("Drain failed: %s", err)
+	}
+	if _, err := rlClient.Call(ctx, "test_sum", transport.MethodParams{}); err == nil {
+		t.Error("Call to drained server accepted.")
+	}
+	stop()
+	if err := <-served; err != nil {
+		t.Errorf("Serve failed: %s", err)
+	}
+}
+
+func TestResultOfLimitedKey(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "svc")
+	option := testsupport.NewOption(keyDir)
+	option.RateLimits.Keys = map[string]options.RateLimit{"*": options.RateLimit{Rate: 0.001, Burst: 10}}
+	node := testsupport.StartBroker(t, option, nil)
+	// worker and client with same key
+	clientOption := client.Option{Addr: node.Addr(), Key: "svc", PrivateKey: keys["svc"]}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	limited := make(chan struct{})
+	rlWorker := worker.NewWorker(clientOption, 1)
+	rlWorker.HandleFunc("test_wait", func(taskCtx context.Context, params sumParams) (int, error) {
+		select {
+		case <-limited:
+		case <-ctx.Done():
+		}
+		return 1, nil
+	})
+	served := make(chan error, 1)
+	go func() { served <- rlWorker.Serve(ctx) }()
+	defer func() {
+		cancel()
+		<-served
+	}()
+	time.Sleep(500 * time.Millisecond)
+	rlClient, err := client.Dial(ctx, clientOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rlClient.Close()
+	taskId, err := rlClient.Call(ctx, "test_wait", transport.MethodParams{Json: "{}"})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	for index := 0; index < 20 && err == nil; index++ {
+		_, err = rlClient.Request(ctx, "getresult", transport.MethodParams{Task: taskId})
+		if client.ErrorCode(err) == transport.ErrorCodeResultNotReady {
+			err = nil
+		}
+	}
+	if client.ErrorCode(err) != transport.ErrorCodeRateLimited {
+		t.Fatalf("Key limit must be exceeded: %v", err)
+	}
+	close(limited)
+	for !node.Core().RpcManager.ResultBufferDict.Exists(taskId) {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Result of worker is rejected by key limit.")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestTaskAfterStop(t *testing.T) {
+	keyDir, keys := testsupport.NewKeyDir(t, "svc")
+	node := testsupport.StartBroker(t, testsupport.NewOption(keyDir), nil)
+	clientOption := client.Option{Addr: node.Addr(), Key: "svc", PrivateKey: keys["svc"]}
+	started := make(chan struct{}, 1)
+	rlWorker := worker.NewWorker(clientOption, 1)
+	rlWorker.HandleFunc("test_long", func(ctx context.Context, params sumParams) (int, error) {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(300 * time.Millisecond):
+			return 1, nil
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	serveCtx, stop := context.WithCancel(ctx)
+	served := make(chan error, 1)
+	go func() { served <- rlWorker.Serve(serveCtx) }()
+	time.Sleep(500 * time.Millisecond)
+	rlClient, err := client.Dial(ctx, clientOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rlClient.Close()
+	taskId, err := rlClient.Call(ctx, "test_long", transport.MethodParams{})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	<-started
+	// running task is finished with result
+	stop()
+	if err := <-served; err != nil {
+		t.Errorf("Serve failed: %s", err)
+	}
+	if result, err := rlClient.Result(ctx, taskId); err != nil || result != "{\"result\":1}" {
+		t.Errorf("Task must be finished after stop: %s %v", result, err)
+	}
+}